@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"file-downloader/internal"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+)
+
+const ctlUsage = `Usage: file-downloader ctl [-addr address] <command> [arguments]
+
+Commands:
+  add [-dir dir] [-priority n] url...  Queue downloads (mirrors separated by |)
+  list                                 List the jobs
+  pause id...                          Pause jobs, keeping their partial files
+  resume id...                         Resume paused jobs
+  cancel id...                         Cancel jobs and remove their partial files
+  events [-after seq] [-progress]      Print job events as JSON lines
+  wait [id...]                         Wait until the jobs finished; fails if one did not complete
+
+`
+
+// runCtl runs a command against the control API of a daemon and returns the exit code.
+func runCtl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	addrFlag := flags.String("addr", internal.DefaultDaemonAddress, "Address of the daemon: host:port or unix:PATH")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), ctlUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	client := internal.NewDaemonClient(*addrFlag)
+
+	var err error
+	switch command, args := flags.Arg(0), flags.Args()[1:]; command {
+	case "add":
+		err = ctlAdd(ctx, client, args)
+	case "list":
+		var jobs []internal.JobInfo
+		jobs, err = client.Jobs(ctx)
+		if err == nil {
+			printJobs(jobs...)
+		}
+	case "pause", "resume", "cancel":
+		err = ctlAction(ctx, client, command, args)
+	case "events":
+		err = ctlEvents(ctx, client, args)
+	case "wait":
+		err = ctlWait(ctx, client, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func ctlAdd(ctx context.Context, client *internal.DaemonClient, args []string) error {
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	dirFlag := flags.String("dir", "", "Directory inside the daemon's download directory")
+	priorityFlag := flags.Int("priority", 0, "Priority of the downloads; higher priorities start first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no URLs given")
+	}
+
+	entries := internal.EntriesFromURLs(flags.Args())
+	for i := range entries {
+		entries[i].Dir = *dirFlag
+		entries[i].Priority = *priorityFlag
+	}
+
+	jobs, err := client.Enqueue(ctx, entries)
+	if err != nil {
+		return err
+	}
+	printJobs(jobs...)
+	return nil
+}
+
+func ctlAction(ctx context.Context, client *internal.DaemonClient, action string, args []string) error {
+	ids, err := parseJobIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return errors.New("no job IDs given")
+	}
+
+	for _, id := range ids {
+		var job internal.JobInfo
+		switch action {
+		case "pause":
+			job, err = client.Pause(ctx, id)
+		case "resume":
+			job, err = client.Resume(ctx, id)
+		case "cancel":
+			job, err = client.Cancel(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+		printJobs(job)
+	}
+	return nil
+}
+
+func ctlEvents(ctx context.Context, client *internal.DaemonClient, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	afterFlag := flags.Int64("after", 0, "Only print kept events with a higher seq")
+	progressFlag := flags.Bool("progress", false, "Include progress events")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	err := client.Events(ctx, *afterFlag, *progressFlag, func(event internal.JobEvent) error {
+		return encoder.Encode(event)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// ctlWait waits until the given jobs, or all unfinished jobs, reached a final state.
+// The event stream replays the kept events, so a job that finishes while the stream is
+// opened is not missed.
+func ctlWait(ctx context.Context, client *internal.DaemonClient, args []string) error {
+	ids, err := parseJobIDs(args)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[int]bool)
+	var finished []internal.JobInfo
+	if len(ids) == 0 {
+		jobs, err := client.Jobs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if !job.State.Final() {
+				pending[job.ID] = true
+			}
+		}
+	}
+	for _, id := range ids {
+		job, err := client.Job(ctx, id)
+		if err != nil {
+			return err
+		}
+		if job.State.Final() {
+			finished = append(finished, job)
+		} else {
+			pending[id] = true
+		}
+	}
+
+	errDone := errors.New("done")
+	if len(pending) > 0 {
+		err = client.Events(ctx, 0, false, func(event internal.JobEvent) error {
+			if !pending[event.Index] || !event.Type.Final() {
+				return nil
+			}
+			delete(pending, event.Index)
+			finished = append(finished, internal.JobInfo{
+				ID:    event.Index,
+				State: internal.JobState(event.Type),
+				URL:   event.URL,
+				Path:  event.Path,
+				Bytes: event.Bytes,
+				Total: event.Total,
+				Error: event.Error,
+			})
+			if len(pending) == 0 {
+				return errDone
+			}
+			return nil
+		})
+		if !errors.Is(err, errDone) {
+			if err == nil {
+				err = errors.New("daemon closed the event stream")
+			}
+			return err
+		}
+	}
+
+	printJobs(finished...)
+	failed := 0
+	for _, job := range finished {
+		if job.State == internal.JobFailed || job.State == internal.JobCancelled {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d job(s) did not complete", failed)
+	}
+	return nil
+}
+
+func parseJobIDs(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job ID %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// printJobs writes a table of jobs to stdout.
+func printJobs(jobs ...internal.JobInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tPROGRESS\tPATH\tERROR")
+	for _, job := range jobs {
+		progress := fmt.Sprintf("%.2f MB", float64(job.Bytes)/(1024*1024))
+		if job.Total > 0 {
+			progress = fmt.Sprintf("%.1f%%", float64(job.Bytes)/float64(job.Total)*100)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", job.ID, job.State, progress, job.Path, job.Error)
+	}
+	_ = w.Flush()
+}
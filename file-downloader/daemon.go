@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"file-downloader/internal"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runDaemon serves the control API on address and downloads the jobs submitted to it
+// until an interrupt signal pauses the active jobs. Entries from the command line are
+// queued first.
+func runDaemon(address, directory string, opts internal.Options, concurrency int,
+	mode internal.ProgressMode, out io.Writer, entries []internal.Entry) {
+	daemon, err := internal.NewDaemon(directory, opts, concurrency)
+	if err != nil {
+		log.Fatalf("Error starting daemon: %v", err)
+	}
+	listener, err := internal.ListenDaemon(address)
+	if err != nil {
+		log.Fatalf("Error starting daemon: %v", err)
+	}
+
+	// Progress bars need a fixed set of downloads, so jobs are logged as lines instead.
+	if mode == internal.ProgressAuto || mode == internal.ProgressANSI {
+		mode = internal.ProgressPlain
+	}
+	var wg sync.WaitGroup
+	if renderer := internal.NewRenderer(mode, os.Stdout); renderer != nil {
+		daemon.Watch(&wg, renderer)
+	}
+
+	if len(entries) > 0 {
+		if _, err := daemon.Enqueue(entries); err != nil {
+			log.Fatalf("Error queueing downloads: %v", err)
+		}
+	}
+
+	server := &http.Server{Handler: daemon.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error serving control API: %v", err)
+		}
+	}()
+	fmt.Fprintf(out, "Daemon listening on %s, downloading to %s\n\n", address, directory)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	fmt.Fprintln(out, "\nReceived interrupt signal, pausing downloads...")
+	// Closing the daemon ends the event streams, so the server can shut down.
+	daemon.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = server.Shutdown(shutdownCtx)
+	wg.Wait()
+}
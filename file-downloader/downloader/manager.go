@@ -0,0 +1,250 @@
+// Package downloader embeds the file downloader in other programs. A Manager downloads
+// the files added to it into one directory, with a shared queue, retry policy and rate
+// limit, and reports their progress to event handlers:
+//
+//	m, err := downloader.New("downloads", downloader.WithConcurrency(4))
+//	if err != nil {
+//		return err
+//	}
+//	defer m.Close()
+//	m.Subscribe(func(e downloader.Event) { log.Println(e.Type, e.URL) })
+//	if _, err := m.AddURLs("https://example.com/a.iso"); err != nil {
+//		return err
+//	}
+//	return m.Wait()
+package downloader
+
+import (
+	"cmp"
+	"errors"
+	"file-downloader/internal"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+type (
+	// Entry describes a file to download.
+	Entry = internal.Entry
+	// Credentials authenticate the requests of an Entry.
+	Credentials = internal.Credentials
+	// RetryPolicy controls how failed downloads are retried.
+	RetryPolicy = internal.RetryPolicy
+	// HTTPTimeouts limits the phases of an HTTP request before the body is read.
+	HTTPTimeouts = internal.HTTPTimeouts
+	// Event describes a change in the progress or lifecycle of a download. Its Index
+	// is the ID of the Job.
+	Event = internal.Event
+	// EventType identifies what happened to a download.
+	EventType = internal.EventType
+	// Job describes a download added to a Manager and its latest progress.
+	Job = internal.JobInfo
+	// JobState is the stage of a Job.
+	JobState = internal.JobState
+)
+
+// The event types, in the order they usually occur.
+const (
+	EventQueued     = internal.EventQueued
+	EventStarted    = internal.EventStarted
+	EventProgress   = internal.EventProgress
+	EventRetry      = internal.EventRetry
+	EventMirror     = internal.EventMirror
+	EventExtracting = internal.EventExtracting
+	EventCompleted  = internal.EventCompleted
+	EventFailed     = internal.EventFailed
+	EventSkipped    = internal.EventSkipped
+	EventUpToDate   = internal.EventUpToDate
+	EventPaused     = internal.EventPaused
+	EventCancelled  = internal.EventCancelled
+)
+
+// The job states.
+const (
+	JobQueued    = internal.JobQueued
+	JobActive    = internal.JobActive
+	JobPaused    = internal.JobPaused
+	JobCompleted = internal.JobCompleted
+	JobFailed    = internal.JobFailed
+	JobSkipped   = internal.JobSkipped
+	JobUpToDate  = internal.JobUpToDate
+	JobCancelled = internal.JobCancelled
+)
+
+// DefaultRetryPolicy returns the retry policy of a Manager created without WithRetryPolicy.
+func DefaultRetryPolicy() RetryPolicy {
+	return internal.DefaultRetryPolicy()
+}
+
+// DefaultHTTPTimeouts returns the timeouts of a Manager created without WithTimeouts
+// or WithHTTPClient.
+func DefaultHTTPTimeouts() HTTPTimeouts {
+	return internal.DefaultHTTPTimeouts()
+}
+
+// Manager downloads the files added to it into a directory. Downloads added at any
+// time share one queue, ordered by the Priority of their entries. It is safe for
+// concurrent use.
+type Manager struct {
+	daemon *internal.Daemon
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	idle     *sync.Cond
+	pending  int
+	closed   bool
+	handlers map[int]func(Event)
+	nextID   int
+}
+
+// New returns a Manager downloading into directory, which is created if needed.
+func New(directory string, options ...Option) (*Manager, error) {
+	cfg := defaultConfig()
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	daemon, err := internal.NewDaemon(directory, cfg.opts, cfg.concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{daemon: daemon, handlers: make(map[int]func(Event))}
+	m.idle = sync.NewCond(&m.mu)
+	daemon.Watch(&m.wg, dispatcher{m})
+	return m, nil
+}
+
+// Add queues the entries and returns their jobs. Entries are validated before any of
+// them is queued, so an error means none was added.
+func (m *Manager) Add(entries ...Entry) ([]Job, error) {
+	// Counted first, as a download may finish before Enqueue returns.
+	m.mu.Lock()
+	m.pending += len(entries)
+	m.mu.Unlock()
+
+	jobs, err := m.daemon.Enqueue(entries)
+	if err != nil {
+		m.mu.Lock()
+		m.pending -= len(entries)
+		m.idle.Broadcast()
+		m.mu.Unlock()
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// AddURLs queues a download for every URL. Mirrors of a file are appended to its URL
+// separated by "|".
+func (m *Manager) AddURLs(urls ...string) ([]Job, error) {
+	return m.Add(internal.EntriesFromURLs(urls)...)
+}
+
+// Jobs returns every job in the order they were added.
+func (m *Manager) Jobs() []Job {
+	return m.daemon.Jobs()
+}
+
+// Wait blocks until every job added so far finished and the event handlers received
+// its final event, or the Manager was closed. It returns an error describing every
+// job that failed; cancelled jobs are not errors.
+func (m *Manager) Wait() error {
+	m.mu.Lock()
+	for m.pending > 0 && !m.closed {
+		m.idle.Wait()
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, job := range m.daemon.Jobs() {
+		if job.State == JobFailed {
+			errs = append(errs, fmt.Errorf("job %d %s: %s", job.ID, job.URL, job.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Cancel stops every job that has not finished and removes its partial file. Jobs
+// added later are downloaded as usual.
+func (m *Manager) Cancel() {
+	jobs := m.daemon.Jobs()
+	// Queued jobs go first, so stopping an active job does not start one of them.
+	slices.SortStableFunc(jobs, func(a, b Job) int {
+		return cmp.Compare(stateOrder(a.State), stateOrder(b.State))
+	})
+	for _, job := range jobs {
+		if !job.State.Final() {
+			// A job that finishes meanwhile cannot be cancelled anymore, which is fine.
+			_, _ = m.daemon.Cancel(job.ID)
+		}
+	}
+}
+
+func stateOrder(state JobState) int {
+	if state == JobActive {
+		return 1
+	}
+	return 0
+}
+
+// Close stops the Manager. Active downloads are stopped, keeping their partial files,
+// so a Manager for the same directory continues them. Close returns once the event
+// handlers received the last event; jobs cannot be added afterwards.
+func (m *Manager) Close() {
+	m.daemon.Close()
+	m.wg.Wait()
+}
+
+// Subscribe calls handler with every event of the Manager, including progress events,
+// until unsubscribe is called. Handlers are called one event at a time from a single
+// goroutine, so a slow handler slows down the downloads. Subscribe before adding
+// downloads to receive all of their events.
+func (m *Manager) Subscribe(handler func(Event)) (unsubscribe func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID
+	m.nextID++
+	m.handlers[id] = handler
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.handlers, id)
+	}
+}
+
+// dispatcher passes the events of the daemon to the handlers of a Manager.
+type dispatcher struct {
+	m *Manager
+}
+
+// Render calls the handlers for every event until the Manager is closed.
+func (d dispatcher) Render(events <-chan Event) {
+	m := d.m
+	for event := range events {
+		m.mu.Lock()
+		handlers := make([]func(Event), 0, len(m.handlers))
+		for id := 0; id < m.nextID; id++ {
+			if handler, ok := m.handlers[id]; ok {
+				handlers = append(handlers, handler)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, handler := range handlers {
+			handler(event)
+		}
+
+		if event.Type.Final() {
+			m.mu.Lock()
+			m.pending--
+			m.idle.Broadcast()
+			m.mu.Unlock()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.idle.Broadcast()
+}
@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestManager(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	transport := &countingTransport{}
+	m, err := New(dir,
+		WithConcurrency(1),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithRateLimit(1024*1024),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer m.Close()
+
+	var mu sync.Mutex
+	types := make(map[int][]EventType)
+	m.Subscribe(func(e Event) {
+		if e.Type == EventProgress {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		types[e.Index] = append(types[e.Index], e.Type)
+	})
+
+	jobs, err := m.AddURLs(server.URL+"/a.bin", server.URL+"/missing.bin")
+	if err != nil {
+		t.Fatalf("AddURLs() error = %v", err)
+	}
+	more, err := m.Add(Entry{URL: server.URL + "/b.bin", Priority: 1})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if len(jobs) != 2 || len(more) != 1 || more[0].ID != 3 {
+		t.Fatalf("jobs = %+v, %+v, want IDs 1 to 3", jobs, more)
+	}
+
+	err = m.Wait()
+	if err == nil || !strings.Contains(err.Error(), "missing.bin") || strings.Contains(err.Error(), "a.bin") {
+		t.Errorf("Wait() error = %v, want only the missing file", err)
+	}
+
+	// The handlers received every final event before Wait returned.
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[int][]EventType{
+		1: {EventQueued, EventStarted, EventCompleted},
+		2: {EventQueued, EventStarted, EventFailed},
+		3: {EventQueued, EventStarted, EventCompleted},
+	}
+	for id, wantTypes := range want {
+		if !slices.Equal(types[id], wantTypes) {
+			t.Errorf("events of job %d = %v, want %v", id, types[id], wantTypes)
+		}
+	}
+
+	for _, name := range []string{"a.bin", "b.bin"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s does not match the source (err %v)", name, err)
+		}
+	}
+	if n := transport.requests.Load(); n < 3 {
+		t.Errorf("HTTP client sent %d requests, want every request", n)
+	}
+}
+
+func TestManagerCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	// Registered before the Manager, so the Manager stops its downloads first.
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	m, err := New(dir, WithConcurrency(1))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(m.Close)
+
+	started := make(chan struct{}, 1)
+	unsubscribe := m.Subscribe(func(e Event) {
+		if e.Type == EventProgress && e.Bytes > 0 {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	if _, err := m.AddURLs(server.URL+"/a.bin", server.URL+"/b.bin"); err != nil {
+		t.Fatalf("AddURLs() error = %v", err)
+	}
+	<-started
+
+	m.Cancel()
+	if err := m.Wait(); err != nil {
+		t.Errorf("Wait() error = %v, want nil for cancelled jobs", err)
+	}
+	for _, job := range m.Jobs() {
+		if job.State != JobCancelled {
+			t.Errorf("job %d state = %s, want %s", job.ID, job.State, JobCancelled)
+		}
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, "*.part*")); len(parts) > 0 {
+		t.Errorf("partial files left behind: %v", parts)
+	}
+}
@@ -0,0 +1,110 @@
+package downloader
+
+import (
+	"file-downloader/internal"
+	"net/http"
+	"time"
+)
+
+// DefaultStallTimeout is the stall timeout of a Manager created without WithStallTimeout.
+const DefaultStallTimeout = 30 * time.Second
+
+// Option configures a Manager.
+type Option func(*config)
+
+type config struct {
+	opts        internal.Options
+	concurrency int
+}
+
+func defaultConfig() config {
+	return config{
+		opts: internal.Options{
+			Resume:       true,
+			Retry:        internal.DefaultRetryPolicy(),
+			StallTimeout: DefaultStallTimeout,
+			Hosts:        internal.NewHostLimiter(0, 0),
+		},
+	}
+}
+
+// WithConcurrency limits the number of files downloaded at once. Zero or less, the
+// default, starts every download right away.
+func WithConcurrency(n int) Option {
+	return func(c *config) {
+		c.concurrency = n
+	}
+}
+
+// WithHostLimits downloads at most maxPerHost files at once from the same host, zero
+// or less for no cap, and sends requests to the same host at least delay apart. Hosts
+// answering 429 or 503 are backed off from either way.
+func WithHostLimits(maxPerHost int, delay time.Duration) Option {
+	return func(c *config) {
+		c.opts.Hosts = internal.NewHostLimiter(maxPerHost, delay)
+	}
+}
+
+// WithRetryPolicy sets how failed downloads are retried, instead of DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *config) {
+		c.opts.Retry = policy
+	}
+}
+
+// WithHTTPClient sends the HTTP and HTTPS requests with client instead of
+// http.DefaultClient, for example to set timeouts, a proxy or a cookie jar.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.opts.HTTPClient = client
+	}
+}
+
+// WithTimeouts sends the HTTP and HTTPS requests with a client limiting the connection,
+// TLS handshake and response header phases, replacing a client set by WithHTTPClient.
+// Without either option, DefaultHTTPTimeouts apply.
+func WithTimeouts(timeouts HTTPTimeouts) Option {
+	return func(c *config) {
+		c.opts.HTTPClient = internal.NewHTTPClient(timeouts)
+	}
+}
+
+// WithMinSpeed fails an attempt that stays below bytesPerSecond for d, so it is retried.
+func WithMinSpeed(bytesPerSecond int64, d time.Duration) Option {
+	return func(c *config) {
+		c.opts.MinSpeed = bytesPerSecond
+		c.opts.MinSpeedTime = d
+	}
+}
+
+// WithRateLimit caps the combined speed of all downloads of the Manager in bytes per
+// second. Zero or less means no limit.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(c *config) {
+		c.opts.RateLimiter = internal.NewRateLimiter(bytesPerSecond)
+	}
+}
+
+// WithSegments downloads each file over n concurrent range requests when the server
+// supports them.
+func WithSegments(n int) Option {
+	return func(c *config) {
+		c.opts.Segments = n
+	}
+}
+
+// WithHeader sends header with every request. Headers of an Entry replace the ones
+// with the same name.
+func WithHeader(header http.Header) Option {
+	return func(c *config) {
+		c.opts.Header = header
+	}
+}
+
+// WithStallTimeout fails an attempt that receives no data for d, so it is retried.
+// Zero disables stall detection.
+func WithStallTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.opts.StallTimeout = d
+	}
+}
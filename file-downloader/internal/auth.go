@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Credentials authenticate the requests to a host.
+type Credentials struct {
+	Username string
+	Password string
+
+	// BearerToken is sent as "Authorization: Bearer <token>" instead of basic auth when set.
+	BearerToken string
+}
+
+// ParseBasicAuth parses credentials given as "user:password". The password may be empty.
+func ParseBasicAuth(s string) (*Credentials, error) {
+	username, password, _ := strings.Cut(s, ":")
+	if username == "" {
+		return nil, errors.New("invalid credentials: expected user:password")
+	}
+	return &Credentials{Username: username, Password: password}, nil
+}
+
+// authorization returns the value of the Authorization header.
+func (c *Credentials) authorization() string {
+	if c.BearerToken != "" {
+		return "Bearer " + c.BearerToken
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// String hides the secrets so credentials can be printed safely.
+func (c *Credentials) String() string {
+	if c.BearerToken != "" {
+		return "Bearer [REDACTED]"
+	}
+	return c.Username + ":[REDACTED]"
+}
+
+// credentials returns the credentials for requests to rawURL. Credentials given for the
+// download are only sent to the host of its URL, so mirrors on other hosts never see them;
+// other hosts are looked up in the netrc file. URLs with a user name authenticate themselves.
+func (f *FileDownload) credentials(rawURL string) *Credentials {
+	return credentialsFor(rawURL, f.auth, f.authHost, f.opts.Netrc)
+}
+
+// credentialsFor returns auth for requests to authHost, and otherwise the netrc
+// credentials of the URL's host.
+func credentialsFor(rawURL string, auth *Credentials, authHost string, netrc *Netrc) *Credentials {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User != nil || u.Host == "" {
+		return nil
+	}
+	if auth != nil && u.Host == authHost {
+		return auth
+	}
+	return netrc.Lookup(u.Hostname())
+}
+
+// authorize returns header with an Authorization header for creds, unless creds is nil
+// or the header already has one. header is cloned before it is changed.
+func authorize(header http.Header, creds *Credentials) http.Header {
+	if creds == nil || header.Get("Authorization") != "" {
+		return header
+	}
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Authorization", creds.authorization())
+	return header
+}
+
+// urlHost returns the host and port of a URL, or "" if it has none.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// Netrc holds the credentials of a .netrc file, keyed by host name.
+// A nil *Netrc has no credentials.
+type Netrc struct {
+	machines map[string]*Credentials
+	fallback *Credentials
+}
+
+// DefaultNetrcPath returns the path of the user's netrc file: $NETRC if set,
+// otherwise .netrc in the home directory (_netrc on Windows).
+func DefaultNetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(home, "_netrc")); err == nil {
+		return filepath.Join(home, "_netrc")
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// LoadNetrc reads a netrc file.
+func LoadNetrc(path string) (*Netrc, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netrc file: %w", err)
+	}
+	defer safeClose(file)
+
+	return parseNetrc(file)
+}
+
+// parseNetrc parses the "machine", "default", "login" and "password" tokens of a netrc
+// file. Macro definitions ("macdef") are skipped up to the next blank line.
+func parseNetrc(r io.Reader) (*Netrc, error) {
+	netrc := &Netrc{machines: make(map[string]*Credentials)}
+
+	scanner := bufio.NewScanner(r)
+	var current *Credentials
+	var pending string
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		for _, token := range strings.Fields(line) {
+			if pending != "" {
+				switch pending {
+				case "machine":
+					current = &Credentials{}
+					netrc.machines[strings.ToLower(token)] = current
+				case "login":
+					if current != nil {
+						current.Username = token
+					}
+				case "password":
+					if current != nil {
+						current.Password = token
+					}
+				}
+				pending = ""
+				continue
+			}
+
+			switch token {
+			case "machine", "login", "password", "account":
+				pending = token
+			case "default":
+				current = &Credentials{}
+				netrc.fallback = current
+			case "macdef":
+				inMacro = true
+				pending = "macdef"
+			}
+		}
+		if pending == "macdef" {
+			pending = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read netrc file: %w", err)
+	}
+
+	return netrc, nil
+}
+
+// Lookup returns the credentials for a host name, falling back to the "default" entry.
+// Entries without a login are ignored.
+func (n *Netrc) Lookup(host string) *Credentials {
+	if n == nil {
+		return nil
+	}
+	if creds, ok := n.machines[strings.ToLower(host)]; ok && creds.Username != "" {
+		return creds
+	}
+	if n.fallback != nil && n.fallback.Username != "" {
+		return n.fallback
+	}
+	return nil
+}
+
+// LoadCookieFile reads cookies from a file in the Netscape format written by curl and
+// browser extensions: one cookie per line with domain, subdomain flag, path, secure flag,
+// expiry, name and value separated by tabs. Expired cookies are dropped.
+func LoadCookieFile(path string) (http.CookieJar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cookie file: %w", err)
+	}
+	defer safeClose(file)
+
+	return parseCookieFile(file, time.Now())
+}
+
+func parseCookieFile(r io.Reader, now time.Time) (http.CookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line = rest
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: invalid cookie: expected 7 tab-separated fields", lineNumber)
+		}
+
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid cookie expiry %q", lineNumber, fields[4])
+		}
+
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(now) {
+				continue
+			}
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: domain, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cookie file: %w", err)
+	}
+
+	return jar, nil
+}
+
+// RedactURL hides the user information of a URL so it can be printed without leaking
+// credentials. The user name is kept next to a password, but a user name on its own
+// is often an access token and is hidden as well. A URL that cannot be parsed has
+// everything between "://" and the last "@" of its host part hidden.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactUnparsedURL(rawURL)
+	}
+	if u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	} else {
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}
+
+// redactUnparsedURL hides the user information of a URL that url.Parse rejected.
+func redactUnparsedURL(rawURL string) string {
+	start := strings.Index(rawURL, "://")
+	if start < 0 {
+		return rawURL
+	}
+	start += len("://")
+
+	authority := rawURL[start:]
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority = authority[:end]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return rawURL
+	}
+	return rawURL[:start] + "xxxxx" + rawURL[start+at:]
+}
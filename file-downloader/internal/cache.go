@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CacheFileName is the name of the file in each download directory that records the
+// validators of the files downloaded into it.
+const CacheFileName = ".file-downloader-cache.json"
+
+// ErrNotModified is returned by a Fetcher when the conditions of a request show that the
+// file did not change since it was downloaded.
+var ErrNotModified = errors.New("not modified")
+
+// cacheRecord describes a completed download, so a later run can ask the source
+// whether the file changed instead of downloading it again.
+type cacheRecord struct {
+	FileName string `json:"file_name"`
+	// Source is the URL the file was downloaded from, which is the download's URL or a mirror.
+	Source       string    `json:"source"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	// Digest is the checksum of the file in "algorithm=hex" form.
+	Digest string `json:"digest"`
+}
+
+// Cache records the validators, size and digest of completed downloads in a
+// CacheFileName file per download directory, keyed by URL. It is safe for concurrent use.
+type Cache struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]*cacheRecord
+}
+
+// NewCache returns a cache whose records are loaded from the download directories on first use.
+func NewCache() *Cache {
+	return &Cache{dirs: make(map[string]map[string]*cacheRecord)}
+}
+
+// records returns the records of a directory, loading them on first use. A missing or
+// damaged cache file starts out empty. Must be called with c.mu locked.
+func (c *Cache) records(dir string) map[string]*cacheRecord {
+	records, ok := c.dirs[dir]
+	if ok {
+		return records
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, CacheFileName))
+	if err != nil || json.Unmarshal(data, &records) != nil || records == nil {
+		records = make(map[string]*cacheRecord)
+	}
+	c.dirs[dir] = records
+	return records
+}
+
+// lookup returns the record of url in dir, or nil if there is none.
+func (c *Cache) lookup(dir, url string) *cacheRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records(dir)[url]
+}
+
+// store saves the record of url in dir and rewrites the directory's cache file.
+func (c *Cache) store(dir, url string, record *cacheRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records := c.records(dir)
+	records[url] = record
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, CacheFileName)
+	err = os.WriteFile(path+PartSuffix, data, 0o644)
+	if err == nil {
+		err = os.Rename(path+PartSuffix, path)
+	}
+	if err != nil {
+		safeRemove(path + PartSuffix)
+		return fmt.Errorf("failed to save download cache: %w", err)
+	}
+	return nil
+}
+
+// revalidation returns the cache record of the download when the file from a previous
+// run can be revalidated with the source instead of downloaded again. The file must
+// still have the recorded size and modification time, and match the expected checksum.
+func (f *FileDownload) revalidation() *cacheRecord {
+	cache := f.opts.Cache
+	if cache == nil || (f.opts.OnConflict != "" && f.opts.OnConflict != ConflictOverwrite) || fileExists(f.partPath()) {
+		return nil
+	}
+
+	dir := filepath.Dir(f.partBase)
+	record := cache.lookup(dir, RedactURL(f.URL))
+	if record == nil || (record.ETag == "" && record.LastModified == "") {
+		return nil
+	}
+	if f.fixedName && record.FileName != filepath.Base(f.partBase) {
+		return nil
+	}
+	if f.Checksum != nil && record.Digest != f.Checksum.String() {
+		return nil
+	}
+
+	info, err := os.Stat(filepath.Join(dir, record.FileName))
+	if err != nil || !info.Mode().IsRegular() || info.Size() != record.Size || !info.ModTime().Equal(record.ModTime) {
+		return nil
+	}
+	return record
+}
+
+// addConditions asks the source to answer with ErrNotModified when the file of a
+// previous run is still current. Only requests for the whole file from the source the
+// file came from are conditional, as validators differ between mirrors.
+func (f *FileDownload) addConditions(req *FetchRequest) {
+	record := f.cached
+	if record == nil || req.Offset != 0 || req.Length != 0 || RedactURL(req.URL) != record.Source {
+		return
+	}
+	req.IfNoneMatch = record.ETag
+	req.IfModifiedSince = record.LastModified
+}
+
+// upToDate moves the download to the file of the previous run after the source
+// confirmed that it did not change.
+func (f *FileDownload) upToDate() {
+	record := f.cached
+	path := filepath.Join(filepath.Dir(f.partBase), record.FileName)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.FilePath = path
+	f.totalBytes = record.Size
+	f.downloaded = record.Size
+	f.digest = record.Digest
+}
+
+// digestHasher returns a hash for the digest of a download without a checksum.
+func digestHasher() hash.Hash {
+	return sha256.New()
+}
+
+// needsDigest reports whether the digest of a completed download is recorded, by the
+// download cache or the journal.
+func (f *FileDownload) needsDigest() bool {
+	return f.opts.Cache != nil || f.opts.Journal != nil
+}
+
+// fileDigest returns the digest of the completed file at FilePath in "algorithm=hex"
+// form. h holds the hash of the file's content, or is nil to hash the file.
+func (f *FileDownload) fileDigest(h hash.Hash) (string, error) {
+	if f.Checksum != nil {
+		// The file was verified against the checksum.
+		return f.Checksum.String(), nil
+	}
+	if h == nil {
+		h = digestHasher()
+		err := hashFile(h, f.Path())
+		if err != nil {
+			return "", err
+		}
+	}
+	return "sha256=" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Digest returns the digest of the completed file in "algorithm=hex" form, or an empty
+// string if it was not recorded.
+func (f *FileDownload) Digest() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.digest
+}
+
+// cacheFile records the completed file at FilePath, described by the resume metadata
+// of the download and its digest.
+func (f *FileDownload) cacheFile(meta *partialMeta, digest string) error {
+	cache := f.opts.Cache
+	if cache == nil || meta == nil || digest == "" {
+		return nil
+	}
+
+	path := f.Path()
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to check downloaded file: %w", err)
+	}
+
+	return cache.store(filepath.Dir(path), RedactURL(f.URL), &cacheRecord{
+		FileName:     filepath.Base(path),
+		Source:       RedactURL(meta.source()),
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		Size:         info.Size(),
+		ModTime:      info.ModTime(),
+		Digest:       digest,
+	})
+}
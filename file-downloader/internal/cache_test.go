@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConditionalRedownload(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		opts Options
+		// change modifies the remote or local file between the runs.
+		change      func(dir string, content *[]byte, etag *string)
+		wantState   State
+		wantContent []byte
+	}{
+		{
+			name:        "unchanged",
+			wantState:   StateUpToDate,
+			wantContent: []byte("version 1"),
+		},
+		{
+			name:        "unchanged segmented",
+			opts:        Options{Segments: 2},
+			wantState:   StateUpToDate,
+			wantContent: []byte("version 1"),
+		},
+		{
+			name: "changed at the source",
+			change: func(dir string, content *[]byte, etag *string) {
+				*content, *etag = []byte("version 2"), `"v2"`
+			},
+			wantState:   StateDone,
+			wantContent: []byte("version 2"),
+		},
+		{
+			name: "changed locally",
+			change: func(dir string, content *[]byte, etag *string) {
+				if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte("edited"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantState:   StateDone,
+			wantContent: []byte("version 1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			content, etag := []byte("version 1"), `"v1"`
+			var notModified int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Header.Get("If-None-Match") == etag {
+					notModified++
+				}
+				w.Header().Set("ETag", etag)
+				http.ServeContent(w, r, "data.txt", modTime, bytes.NewReader(content))
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			entry := Entry{URL: server.URL + "/data.txt"}
+
+			first := runDownloadIn(t, dir, entry, Options{Cache: NewCache()})
+			if first.State() != StateDone {
+				t.Fatalf("first run state = %v, error = %v", first.State(), first.Err())
+			}
+
+			if tt.change != nil {
+				mu.Lock()
+				tt.change(dir, &content, &etag)
+				mu.Unlock()
+			}
+
+			// A new cache reads the records written by the first run.
+			opts := tt.opts
+			opts.Cache = NewCache()
+			second := runDownloadIn(t, dir, entry, opts)
+			if second.State() != tt.wantState {
+				t.Fatalf("second run state = %v, want %v (error = %v)", second.State(), tt.wantState, second.Err())
+			}
+			if tt.wantState == StateUpToDate && notModified != 1 {
+				t.Errorf("server answered %d conditional requests with 304, want 1", notModified)
+			}
+			checkContent(t, second, tt.wantContent)
+		})
+	}
+}
+
+func TestCacheRecord(t *testing.T) {
+	content := []byte("hello")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	d := runDownloadIn(t, dir, Entry{URL: server.URL + "/hello.txt"}, Options{Cache: NewCache()})
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+
+	record := NewCache().lookup(dir, server.URL+"/hello.txt")
+	if record == nil {
+		t.Fatalf("no cache record in %s", CacheFileName)
+	}
+	want := cacheRecord{
+		FileName: "hello.txt",
+		Source:   server.URL + "/hello.txt",
+		ETag:     `"abc"`,
+		Size:     int64(len(content)),
+		ModTime:  record.ModTime,
+		Digest:   "sha256=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if *record != want {
+		t.Errorf("cache record = %+v, want %+v", *record, want)
+	}
+}
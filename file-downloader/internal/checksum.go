@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hashConstructors maps the supported algorithm names to their hash constructors.
+var hashConstructors = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashPreference lists the supported algorithms from strongest to weakest.
+var hashPreference = []string{"sha512", "sha256", "sha1", "md5"}
+
+// Checksum is an expected digest of a downloaded file.
+type Checksum struct {
+	Algorithm string
+	Digest    []byte
+}
+
+// String returns the checksum in the "algorithm=hex" form used in URL fragments.
+func (c *Checksum) String() string {
+	return c.Algorithm + "=" + hex.EncodeToString(c.Digest)
+}
+
+// newHash returns a hash for the checksum's algorithm.
+func (c *Checksum) newHash() hash.Hash {
+	return hashConstructors[c.Algorithm]()
+}
+
+// ChecksumError is returned when a downloaded file does not match its expected digest.
+type ChecksumError struct {
+	Expected *Checksum
+	Actual   []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s %x, got %x",
+		e.Expected.Algorithm, e.Expected.Digest, e.Actual)
+}
+
+// ParseChecksum parses a checksum of the form "algorithm=hex" or "algorithm:hex",
+// for example "sha256=e3b0c442...". Supported algorithms are md5, sha1, sha256 and sha512.
+func ParseChecksum(spec string) (*Checksum, error) {
+	algorithm, digest, ok := strings.Cut(spec, "=")
+	if !ok {
+		algorithm, digest, ok = strings.Cut(spec, ":")
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid checksum %q: expected algorithm=digest", spec)
+	}
+
+	return newChecksum(algorithm, digest)
+}
+
+// newChecksum validates the algorithm name and hex digest.
+func newChecksum(algorithm, digest string) (*Checksum, error) {
+	algorithm = normalizeAlgorithm(algorithm)
+	newHash, ok := hashConstructors[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s digest: %w", algorithm, err)
+	}
+	if len(decoded) != newHash().Size() {
+		return nil, fmt.Errorf("invalid %s digest: expected %d bytes, got %d", algorithm, newHash().Size(), len(decoded))
+	}
+
+	return &Checksum{Algorithm: algorithm, Digest: decoded}, nil
+}
+
+// normalizeAlgorithm turns algorithm names such as "SHA-256" into the names of hashConstructors.
+func normalizeAlgorithm(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "")
+}
+
+// splitChecksumFragment removes a checksum fragment such as "#sha256=..." from a URL.
+// URLs without a checksum fragment are returned unchanged with a nil checksum.
+func splitChecksumFragment(rawURL string) (string, *Checksum, error) {
+	base, fragment, ok := strings.Cut(rawURL, "#")
+	if !ok {
+		return rawURL, nil, nil
+	}
+
+	algorithm, _, ok := strings.Cut(fragment, "=")
+	if !ok {
+		return rawURL, nil, nil
+	}
+	if _, supported := hashConstructors[normalizeAlgorithm(algorithm)]; !supported {
+		return rawURL, nil, nil
+	}
+
+	checksum, err := ParseChecksum(fragment)
+	if err != nil {
+		return "", nil, err
+	}
+	return base, checksum, nil
+}
+
+// LoadChecksumFile reads a checksum file in the format written by sha256sum and
+// similar tools ("<hex digest>  <file name>", with "*" marking binary mode) or in
+// the BSD format ("SHA256 (<file name>) = <hex digest>"). It returns the
+// checksums keyed by file name.
+func LoadChecksumFile(path string) (map[string]*Checksum, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checksum file: %w", err)
+	}
+	defer safeClose(file)
+
+	return parseChecksumFile(file, filepath.Base(path))
+}
+
+// parseChecksumFile parses checksum lines. The algorithm of the GNU format is taken
+// from the file name (e.g. SHA512SUMS or file.sha1) or, failing that, from the digest length.
+func parseChecksumFile(r io.Reader, fileName string) (map[string]*Checksum, error) {
+	checksums := make(map[string]*Checksum)
+	defaultAlgorithm := algorithmFromFileName(fileName)
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, checksum, err := parseChecksumLine(line, defaultAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		checksums[name] = checksum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checksum file: %w", err)
+	}
+
+	return checksums, nil
+}
+
+func parseChecksumLine(line string, defaultAlgorithm string) (string, *Checksum, error) {
+	// BSD format: SHA256 (file.tar.gz) = 0123...
+	if open := strings.Index(line, " ("); open > 0 {
+		if closing := strings.LastIndex(line, ") = "); closing > open {
+			checksum, err := newChecksum(line[:open], line[closing+4:])
+			if err != nil {
+				return "", nil, err
+			}
+			return line[open+2 : closing], checksum, nil
+		}
+	}
+
+	digest, name, ok := strings.Cut(line, " ")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid checksum line %q", line)
+	}
+	name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+
+	algorithm := defaultAlgorithm
+	if algorithm == "" {
+		algorithm = algorithmFromDigestLength(len(digest) / 2)
+	}
+	checksum, err := newChecksum(algorithm, digest)
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Base(name), checksum, nil
+}
+
+// algorithmFromFileName guesses the algorithm from names such as SHA256SUMS or file.md5.
+func algorithmFromFileName(fileName string) string {
+	name := strings.ToLower(fileName)
+	for _, algorithm := range hashPreference {
+		if strings.Contains(name, algorithm) {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// algorithmFromDigestLength guesses the algorithm from the digest size in bytes.
+func algorithmFromDigestLength(size int) string {
+	for algorithm, newHash := range hashConstructors {
+		if newHash().Size() == size {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// checksumHasher returns a hash for the download's checksum that has already consumed
+// the first offset bytes of the partial file. Without a checksum it returns the hash for
+// the digest recorded in the download cache, or nil when the cache is disabled.
+func (f *FileDownload) checksumHasher(offset int64) (hash.Hash, error) {
+	var h hash.Hash
+	switch {
+	case f.Checksum != nil:
+		h = f.Checksum.newHash()
+	case f.needsDigest():
+		h = digestHasher()
+	default:
+		return nil, nil
+	}
+
+	if offset == 0 {
+		return h, nil
+	}
+
+	file, err := os.Open(f.partPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partial file: %w", err)
+	}
+	defer safeClose(file)
+
+	_, err = io.CopyN(h, file, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash partial file: %w", err)
+	}
+	return h, nil
+}
+
+// verifyChecksum compares the expected checksum against h, or against a hash of the
+// whole partial file when h is nil. A file that does not match is deleted.
+func (f *FileDownload) verifyChecksum(h hash.Hash) error {
+	if f.Checksum == nil {
+		return nil
+	}
+
+	if h == nil {
+		var err error
+		h, err = f.checksumHasher(0)
+		if err == nil {
+			err = hashFile(h, f.partPath())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	actual := h.Sum(nil)
+	if !bytes.Equal(actual, f.Checksum.Digest) {
+		f.removePartial()
+		return &ChecksumError{Expected: f.Checksum, Actual: actual}
+	}
+	return nil
+}
+
+// hashFile writes the contents of the file at path to h.
+func hashFile(h hash.Hash, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file for checksum: %w", err)
+	}
+	defer safeClose(file)
+
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestParseChecksum(t *testing.T) {
+	tests := []struct {
+		name          string
+		spec          string
+		wantAlgorithm string
+		wantErr       bool
+	}{
+		{
+			name:          "sha256 with equals",
+			spec:          "sha256=" + emptySHA256,
+			wantAlgorithm: "sha256",
+		},
+		{
+			name:          "sha256 with colon",
+			spec:          "SHA-256:" + emptySHA256,
+			wantAlgorithm: "sha256",
+		},
+		{
+			name:          "md5",
+			spec:          "md5=d41d8cd98f00b204e9800998ecf8427e",
+			wantAlgorithm: "md5",
+		},
+		{
+			name:    "unsupported algorithm",
+			spec:    "crc32=00000000",
+			wantErr: true,
+		},
+		{
+			name:    "wrong digest length",
+			spec:    "sha256=d41d8cd98f00b204e9800998ecf8427e",
+			wantErr: true,
+		},
+		{
+			name:    "not hex",
+			spec:    "md5=zz1d8cd98f00b204e9800998ecf8427e",
+			wantErr: true,
+		},
+		{
+			name:    "missing algorithm",
+			spec:    emptySHA256,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChecksum(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Algorithm != tt.wantAlgorithm {
+				t.Errorf("ParseChecksum() algorithm = %v, want %v", got.Algorithm, tt.wantAlgorithm)
+			}
+		})
+	}
+}
+
+func TestSplitChecksumFragment(t *testing.T) {
+	tests := []struct {
+		name         string
+		url          string
+		wantURL      string
+		wantChecksum bool
+		wantErr      bool
+	}{
+		{
+			name:    "no fragment",
+			url:     "https://example.com/file.txt",
+			wantURL: "https://example.com/file.txt",
+		},
+		{
+			name:         "checksum fragment",
+			url:          "https://example.com/file.txt#sha256=" + emptySHA256,
+			wantURL:      "https://example.com/file.txt",
+			wantChecksum: true,
+		},
+		{
+			name:         "hyphenated algorithm",
+			url:          "https://example.com/file.txt#SHA-256=" + emptySHA256,
+			wantURL:      "https://example.com/file.txt",
+			wantChecksum: true,
+		},
+		{
+			name:    "invalid hyphenated digest",
+			url:     "https://example.com/file.txt#sha-256=abc",
+			wantErr: true,
+		},
+		{
+			name:    "unrelated fragment",
+			url:     "https://example.com/file.txt#section",
+			wantURL: "https://example.com/file.txt#section",
+		},
+		{
+			name:    "invalid digest",
+			url:     "https://example.com/file.txt#sha256=abc",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL, checksum, err := splitChecksumFragment(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitChecksumFragment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if gotURL != tt.wantURL {
+				t.Errorf("splitChecksumFragment() url = %v, want %v", gotURL, tt.wantURL)
+			}
+			if (checksum != nil) != tt.wantChecksum {
+				t.Errorf("splitChecksumFragment() checksum = %v, want checksum %v", checksum, tt.wantChecksum)
+			}
+		})
+	}
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	input := `# generated by sha256sum
+` + emptySHA256 + `  empty.txt
+` + emptySHA256 + ` *dir/binary.bin
+MD5 (other.txt) = d41d8cd98f00b204e9800998ecf8427e
+`
+
+	checksums, err := parseChecksumFile(strings.NewReader(input), "SHA256SUMS")
+	if err != nil {
+		t.Fatalf("parseChecksumFile() error = %v", err)
+	}
+
+	want := map[string]string{
+		"empty.txt":  "sha256",
+		"binary.bin": "sha256",
+		"other.txt":  "md5",
+	}
+	if len(checksums) != len(want) {
+		t.Fatalf("parseChecksumFile() returned %d entries, want %d", len(checksums), len(want))
+	}
+	for name, algorithm := range want {
+		checksum, ok := checksums[name]
+		if !ok {
+			t.Errorf("missing checksum for %s", name)
+			continue
+		}
+		if checksum.Algorithm != algorithm {
+			t.Errorf("checksum for %s algorithm = %v, want %v", name, checksum.Algorithm, algorithm)
+		}
+	}
+
+	_, err = parseChecksumFile(strings.NewReader("nothex  file.txt\n"), "SHA256SUMS")
+	if err == nil {
+		t.Error("parseChecksumFile() expected error for invalid digest")
+	}
+}
+
+func TestChecksumMismatchRemovesFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tampered"))
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256([]byte("original"))
+	url := server.URL + "/file.txt#sha256=" + hex.EncodeToString(sum[:])
+
+	downloads, err := PrepareDownloads(EntriesFromURLs([]string{url}), t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	var wg sync.WaitGroup
+	err = d.Start(context.Background(), &wg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for range d.LoadedBytes {
+	}
+	wg.Wait()
+
+	var checksumErr *ChecksumError
+	if !errors.As(d.Err(), &checksumErr) {
+		t.Fatalf("download error = %v, want ChecksumError", d.Err())
+	}
+	for _, path := range []string{d.FilePath, d.partPath()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed after checksum mismatch", path)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MaxListingSize is the largest directory listing page that is read when crawling.
+const MaxListingSize = 8 * 1024 * 1024
+
+// CrawlOptions controls which files a recursive crawl of directory listings finds.
+type CrawlOptions struct {
+	// MaxDepth is the number of subdirectory levels below the starting URL that are
+	// crawled. Zero only takes the files listed on the starting page.
+	MaxDepth int
+
+	// Include lists glob patterns of the files to download; when empty every file is
+	// included. Exclude lists patterns of files and directories to leave out. Patterns
+	// without a "/" match the name, others the path relative to the starting URL.
+	Include []string
+	Exclude []string
+
+	// SameHost restricts the downloads to files on the host of the starting URL.
+	// Subdirectories are only crawled on that host either way.
+	SameHost bool
+}
+
+// hrefPattern matches the link targets of an HTML page.
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*?href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// Crawl expands entries that point at HTML directory listings, such as Apache and nginx
+// autoindex pages, into entries for the files they link to. Subdirectories below the
+// listing are crawled up to the depth limit, and their structure is kept in the Dir of
+// the entries. The other fields of an entry are copied to the files found from it.
+// Listings are fetched with the headers and credentials of opts.
+func Crawl(ctx context.Context, entries []Entry, crawlOpts CrawlOptions, opts Options) ([]Entry, error) {
+	for _, pattern := range slices.Concat(crawlOpts.Include, crawlOpts.Exclude) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	var found []Entry
+	for _, entry := range entries {
+		files, err := crawlEntry(ctx, entry, crawlOpts, opts)
+		if err != nil {
+			if entry.Line > 0 {
+				return nil, fmt.Errorf("line %d: %w", entry.Line, err)
+			}
+			return nil, err
+		}
+		found = append(found, files...)
+	}
+	return found, nil
+}
+
+// crawlEntry crawls the listing at the URL of an entry breadth first.
+func crawlEntry(ctx context.Context, entry Entry, crawlOpts CrawlOptions, opts Options) ([]Entry, error) {
+	root, err := url.Parse(entry.URL)
+	if err != nil || (root.Scheme != "http" && root.Scheme != "https") || root.Host == "" {
+		return nil, fmt.Errorf("cannot crawl %s: only http and https listings are supported", RedactURL(entry.URL))
+	}
+	root.Fragment = ""
+	root.RawQuery = ""
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+		root.RawPath = ""
+	}
+
+	type page struct {
+		url   *url.URL
+		depth int
+	}
+	queue := []page{{url: root}}
+	visited := map[string]bool{root.String(): true}
+	seen := make(map[string]bool)
+
+	var files []Entry
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		links, err := fetchListing(ctx, current.url.String(), entry, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to crawl %s: %w", RedactURL(current.url.String()), err)
+		}
+
+		for _, link := range links {
+			target, err := current.url.Parse(link)
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.RawQuery != "" {
+				// Sorting links such as "?C=M;O=A" lead to the same listing.
+				continue
+			}
+			target.Fragment = ""
+			if target.Host == root.Host {
+				target.User = root.User
+			}
+
+			relative, below := strings.CutPrefix(target.Path, root.Path)
+			below = below && target.Host == root.Host
+			relative = strings.TrimSuffix(relative, "/")
+
+			if strings.HasSuffix(target.Path, "/") {
+				// Parent and sibling directories, and listings on other hosts, are not crawled.
+				if !below || relative == "" || visited[target.String()] || current.depth >= crawlOpts.MaxDepth {
+					continue
+				}
+				if matchAny(crawlOpts.Exclude, relative) {
+					continue
+				}
+				visited[target.String()] = true
+				queue = append(queue, page{url: target, depth: current.depth + 1})
+				continue
+			}
+
+			if !below {
+				// Files outside the crawled directory are only taken from other hosts,
+				// and saved next to the listing that links them.
+				if crawlOpts.SameHost || target.Host == root.Host {
+					continue
+				}
+				pageDir, _ := strings.CutPrefix(current.url.Path, root.Path)
+				relative = path.Join(pageDir, path.Base(target.Path))
+			}
+			if seen[target.String()] || !included(crawlOpts, relative) {
+				continue
+			}
+			seen[target.String()] = true
+
+			dir, err := crawlDir(path.Dir(relative))
+			if err != nil {
+				continue
+			}
+
+			file := entry
+			file.URL = target.String()
+			file.Mirrors = nil
+			file.FileName = ""
+			file.Checksum = ""
+			file.Dir = filepath.Join(entry.Dir, dir)
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// fetchListing downloads a listing page and returns the targets of its links.
+func fetchListing(ctx context.Context, pageURL string, entry Entry, opts Options) ([]string, error) {
+	fetcher, err := fetcherFor(pageURL, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := entry.Auth
+	if auth == nil {
+		auth = opts.Auth
+	}
+	header := mergeHeaders(opts.Header, entry.Header)
+	creds := credentialsFor(pageURL, auth, urlHost(entry.URL), opts.Netrc)
+
+	if err := opts.Hosts.wait(ctx, pageURL); err != nil {
+		return nil, err
+	}
+	result, err := fetcher.Fetch(ctx, &FetchRequest{URL: pageURL, Header: authorize(header, creds)})
+	opts.Hosts.observe(pageURL, err)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(result.Body)
+
+	page, err := io.ReadAll(io.LimitReader(result.Body, MaxListingSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listing: %w", err)
+	}
+	return parseLinks(string(page)), nil
+}
+
+// parseLinks returns the href targets of the links in an HTML page.
+func parseLinks(page string) []string {
+	var links []string
+	for _, match := range hrefPattern.FindAllStringSubmatch(page, -1) {
+		link := match[1] + match[2] + match[3]
+		link = strings.TrimSpace(html.UnescapeString(link))
+		if link != "" && !strings.HasPrefix(link, "#") {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// included reports whether a file at a path relative to the crawled directory passes the
+// include and exclude patterns.
+func included(crawlOpts CrawlOptions, relative string) bool {
+	if matchAny(crawlOpts.Exclude, relative) {
+		return false
+	}
+	return len(crawlOpts.Include) == 0 || matchAny(crawlOpts.Include, relative)
+}
+
+// matchAny reports whether one of the patterns matches a relative path. Patterns without
+// a "/" are matched against the last path element.
+func matchAny(patterns []string, relative string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		target := relative
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(relative)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// crawlDir converts the directory of a crawled file to a local path, rejecting names
+// that are not valid file names.
+func crawlDir(dir string) (string, error) {
+	if dir == "." {
+		return "", nil
+	}
+	parts := strings.Split(dir, "/")
+	for _, part := range parts {
+		if err := validateFileName(part); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(parts...), nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCrawl(t *testing.T) {
+	listings := map[string][]string{
+		"/pub/":          {"../", "?C=N;O=D", "a.csv", "b.txt", "sub/", "/other/", "http://elsewhere.example/x.csv"},
+		"/pub/sub/":      {"../", "c.csv", "deep/", "tmp/"},
+		"/pub/sub/deep/": {"d.csv"},
+		"/pub/sub/tmp/":  {"e.csv"},
+	}
+	var gotAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAgent = r.Header.Get("User-Agent")
+		links, ok := listings[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><body><h1>Index of %s</h1><pre>\n", r.URL.Path)
+		for _, link := range links {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link, link)
+		}
+		fmt.Fprint(w, "</pre></body></html>")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		opts CrawlOptions
+		want []string
+	}{
+		{
+			name: "everything",
+			opts: CrawlOptions{MaxDepth: 5, SameHost: true},
+			want: []string{"a.csv", "b.txt", "sub/c.csv", "sub/deep/d.csv", "sub/tmp/e.csv"},
+		},
+		{
+			name: "depth limit",
+			opts: CrawlOptions{MaxDepth: 1, SameHost: true},
+			want: []string{"a.csv", "b.txt", "sub/c.csv"},
+		},
+		{
+			name: "include and exclude",
+			opts: CrawlOptions{MaxDepth: 5, SameHost: true, Include: []string{"*.csv"}, Exclude: []string{"tmp", "sub/deep/d.csv"}},
+			want: []string{"a.csv", "sub/c.csv"},
+		},
+		{
+			name: "other hosts",
+			opts: CrawlOptions{MaxDepth: 0},
+			want: []string{"a.csv", "b.txt", "x.csv"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := []Entry{{URL: server.URL + "/pub", Dir: "mirror", Priority: 3}}
+			opts := Options{Header: http.Header{"User-Agent": {"crawler"}}}
+
+			found, err := Crawl(context.Background(), entries, tt.opts, opts)
+			if err != nil {
+				t.Fatalf("Crawl() error = %v", err)
+			}
+
+			var got []string
+			for _, entry := range found {
+				name := entry.URL[strings.LastIndex(entry.URL, "/")+1:]
+				rel, err := filepath.Rel("mirror", filepath.Join(entry.Dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+				if entry.Priority != 3 {
+					t.Errorf("entry %s priority = %d, want the priority of the listing", entry.URL, entry.Priority)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Crawl() found %v, want %v", got, tt.want)
+			}
+			if gotAgent != "crawler" {
+				t.Errorf("listing request User-Agent = %q, want the configured header", gotAgent)
+			}
+		})
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	page := `<a href="a.txt">a</a> <A HREF='b%20c.txt'>b</A> <a class=x href=d/>d</a>
+<a href="#top">top</a> <a name="anchor">no link</a> <a href="e.txt?x=1&amp;y=2">e</a>`
+
+	want := []string{"a.txt", "b%20c.txt", "d/", "e.txt?x=1&y=2"}
+	if got := parseLinks(page); !slices.Equal(got, want) {
+		t.Errorf("parseLinks() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,566 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// DaemonHistorySize is the number of lifecycle events the daemon keeps, so clients
+	// that connect later can still read the completion of earlier jobs.
+	DaemonHistorySize = 1000
+
+	// DaemonEventBuffer is the number of events buffered for an event stream. A client
+	// that falls further behind is disconnected and has to reconnect.
+	DaemonEventBuffer = 1024
+)
+
+var (
+	// ErrJobNotFound is returned for a job ID the daemon does not know.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobState is returned when a job cannot be paused, resumed or cancelled in its current state.
+	ErrJobState = errors.New("invalid job state")
+	// ErrDaemonClosed is returned when jobs are submitted to a daemon that is shutting down.
+	ErrDaemonClosed = errors.New("daemon is shutting down")
+)
+
+// JobState is the stage of a daemon job. The final states are named after the events
+// that end a download.
+type JobState string
+
+const (
+	// JobQueued means the job waits for a free slot.
+	JobQueued JobState = "queued"
+	// JobActive means the job is downloading.
+	JobActive JobState = "active"
+	// JobPaused means the job was stopped and waits to be resumed.
+	JobPaused JobState = "paused"
+	// JobCompleted means the file was downloaded.
+	JobCompleted JobState = "completed"
+	// JobFailed means the download stopped with an error.
+	JobFailed JobState = "failed"
+	// JobSkipped means the download did not run because its file exists.
+	JobSkipped JobState = "skipped"
+	// JobUpToDate means the file of an earlier download did not change at the source.
+	JobUpToDate JobState = "up_to_date"
+	// JobCancelled means the job was cancelled and its partial file removed.
+	JobCancelled JobState = "cancelled"
+)
+
+// Final reports whether the job will not run again.
+func (s JobState) Final() bool {
+	return s != JobQueued && s != JobActive && s != JobPaused
+}
+
+// JobInfo describes a daemon job and its latest progress.
+type JobInfo struct {
+	ID    int      `json:"id"`
+	State JobState `json:"state"`
+	URL   string   `json:"url"`
+	Path  string   `json:"path,omitempty"`
+	Bytes int64    `json:"bytes"`
+	Total int64    `json:"total"`
+	Speed float64  `json:"speed"`
+	Error string   `json:"error,omitempty"`
+}
+
+// JobEvent is an event of a daemon job. Seq numbers the events in the order the daemon
+// sent them, and the Index of the event is the job ID.
+type JobEvent struct {
+	Seq int64 `json:"seq"`
+	Event
+}
+
+// job is a download submitted to the daemon. A paused job that ran before is prepared
+// again when it is resumed, and continues from its partial file.
+type job struct {
+	id       int
+	entry    Entry
+	opts     Options
+	state    JobState
+	download *FileDownload
+	run      *jobRun
+	last     Event
+}
+
+// jobRun is one run of a job's download, from its start until its final event.
+type jobRun struct {
+	download *FileDownload
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// stop is the state the run was stopped for, JobPaused or JobCancelled, if any.
+	stop JobState
+}
+
+// subscriber receives the events of the daemon. Lossless subscribers are sent every
+// event, others are dropped when their buffer is full.
+type subscriber struct {
+	events   chan JobEvent
+	lossless bool
+}
+
+// Daemon runs downloads that are submitted while it runs. All jobs share one queue,
+// ordered by priority, and the options of the daemon, including its rate limiter, so
+// at most limit jobs download at once. It is safe for concurrent use.
+type Daemon struct {
+	dir   string
+	opts  Options
+	limit int
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	mu          sync.Mutex
+	jobs        []*job
+	running     int
+	closed      bool
+	seq         int64
+	history     []JobEvent
+	subscribers map[*subscriber]bool
+}
+
+// NewDaemon returns a daemon downloading into directory. A limit of zero or less runs
+// every job at once.
+func NewDaemon(directory string, opts Options, limit int) (*Daemon, error) {
+	err := ensureDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	d := &Daemon{
+		dir:         directory,
+		opts:        opts,
+		limit:       limit,
+		ctx:         ctx,
+		stop:        stop,
+		subscribers: make(map[*subscriber]bool),
+	}
+	if opts.Hosts.capped() {
+		d.wg.Add(1)
+		go d.watchHosts()
+	}
+	return d, nil
+}
+
+// watchHosts schedules queued jobs whenever a host slot is released, which happens
+// outside the runs finishing when a job moves on to a mirror on another host.
+func (d *Daemon) watchHosts() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.opts.Hosts.released():
+			d.schedule()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// Enqueue adds a job for every entry and starts them as slots become free. Entries are
+// validated like a batch; a target path used by another unfinished job is rejected.
+func (d *Daemon) Enqueue(entries []Entry) ([]JobInfo, error) {
+	return d.enqueue(entries, d.opts)
+}
+
+// submitted returns the options of jobs submitted over the control API. They leave out
+// the credentials, netrc and headers given at startup, which any local client could
+// otherwise have sent to a host of its choice; a header such as an API key cannot be
+// told apart from others, so none are kept. Such jobs name their own instead.
+func (d *Daemon) submitted() Options {
+	opts := d.opts
+	opts.Auth = nil
+	opts.Netrc = nil
+	opts.Header = nil
+	return opts
+}
+
+// enqueue adds a job for every entry, downloaded with opts.
+func (d *Daemon) enqueue(entries []Entry, opts Options) ([]JobInfo, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("no downloads given")
+	}
+
+	entries = sortByPriority(entries)
+	downloads, err := PrepareDownloads(entries, d.dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, ErrDaemonClosed
+	}
+	for _, download := range downloads {
+		if other := d.jobAt(download.Path()); other != nil {
+			d.mu.Unlock()
+			return nil, fmt.Errorf("target path %s is used by job %d", download.Path(), other.id)
+		}
+	}
+
+	infos := make([]JobInfo, 0, len(downloads))
+	for i, download := range downloads {
+		j := &job{id: len(d.jobs) + 1, entry: entries[i], opts: opts, state: JobQueued, download: download}
+		download.index = j.id - 1
+		d.jobs = append(d.jobs, j)
+		d.record(j, nil, download.event(EventQueued, nil))
+		infos = append(infos, j.info())
+	}
+	d.mu.Unlock()
+
+	d.schedule()
+	return infos, nil
+}
+
+// jobAt returns the unfinished job writing to path, or nil. Must be called with d.mu locked.
+func (d *Daemon) jobAt(path string) *job {
+	for _, j := range d.jobs {
+		if !j.state.Final() && filepath.Clean(j.download.Path()) == filepath.Clean(path) {
+			return j
+		}
+	}
+	return nil
+}
+
+// Jobs returns every job in the order they were submitted.
+func (d *Daemon) Jobs() []JobInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	infos := make([]JobInfo, 0, len(d.jobs))
+	for _, j := range d.jobs {
+		infos = append(infos, j.info())
+	}
+	return infos
+}
+
+// Job returns the job with the given ID.
+func (d *Daemon) Job(id int) (JobInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	j, err := d.job(id)
+	if err != nil {
+		return JobInfo{}, err
+	}
+	return j.info(), nil
+}
+
+// job returns the job with the given ID. Must be called with d.mu locked.
+func (d *Daemon) job(id int) (*job, error) {
+	if id < 1 || id > len(d.jobs) {
+		return nil, fmt.Errorf("job %d: %w", id, ErrJobNotFound)
+	}
+	return d.jobs[id-1], nil
+}
+
+// Pause stops a queued or active job, keeping its partial file so it can be resumed.
+// It returns once an active job has stopped. Pausing a paused job does nothing.
+func (d *Daemon) Pause(id int) (JobInfo, error) {
+	return d.halt(id, JobPaused)
+}
+
+// Cancel stops a job that has not finished and removes its partial file.
+func (d *Daemon) Cancel(id int) (JobInfo, error) {
+	return d.halt(id, JobCancelled)
+}
+
+// halt stops a job for the paused or cancelled state.
+func (d *Daemon) halt(id int, state JobState) (JobInfo, error) {
+	d.mu.Lock()
+	j, err := d.job(id)
+	if err != nil {
+		d.mu.Unlock()
+		return JobInfo{}, err
+	}
+	if j.state.Final() || (j.state == JobPaused && state == JobPaused) {
+		defer d.mu.Unlock()
+		if j.state == state {
+			return j.info(), nil
+		}
+		return JobInfo{}, fmt.Errorf("job %d is %s: %w", id, j.state, ErrJobState)
+	}
+
+	run, download := j.run, j.download
+	if j.state == JobActive {
+		// The final event of the run reports the new state.
+		run.stop = state
+		run.cancel()
+	} else {
+		d.record(j, nil, j.download.event(EventType(state), nil))
+	}
+	j.state = state
+	d.mu.Unlock()
+
+	if run != nil {
+		<-run.done
+	}
+	if state == JobCancelled {
+		download.removePartial()
+	}
+	return d.Job(id)
+}
+
+// Resume queues a paused job again. A job that already ran is prepared again and
+// continues from its partial file.
+func (d *Daemon) Resume(id int) (JobInfo, error) {
+	d.mu.Lock()
+	j, err := d.job(id)
+	if err != nil {
+		d.mu.Unlock()
+		return JobInfo{}, err
+	}
+	if j.state != JobPaused {
+		defer d.mu.Unlock()
+		if j.state == JobQueued || j.state == JobActive {
+			return j.info(), nil
+		}
+		return JobInfo{}, fmt.Errorf("job %d is %s: %w", id, j.state, ErrJobState)
+	}
+	started := j.run != nil
+	d.mu.Unlock()
+
+	var download *FileDownload
+	if started {
+		downloads, err := PrepareDownloads([]Entry{j.entry}, d.dir, j.opts)
+		if err != nil {
+			return JobInfo{}, err
+		}
+		download = downloads[0]
+		download.index = j.id - 1
+	}
+
+	d.mu.Lock()
+	if j.state != JobPaused {
+		defer d.mu.Unlock()
+		return JobInfo{}, fmt.Errorf("job %d is %s: %w", id, j.state, ErrJobState)
+	}
+	if download != nil {
+		j.download = download
+		j.run = nil
+	}
+	j.state = JobQueued
+	d.record(j, nil, j.download.event(EventQueued, nil))
+	info := j.info()
+	d.mu.Unlock()
+
+	d.schedule()
+	return info, nil
+}
+
+// schedule starts queued jobs while slots are free, highest priority first. Jobs whose
+// host has no free slot stay queued.
+func (d *Daemon) schedule() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hosts := d.opts.Hosts
+	for !d.closed && (d.limit <= 0 || d.running < d.limit) {
+		var next *job
+		for _, j := range d.jobs {
+			if j.state == JobQueued && (next == nil || j.entry.Priority > next.entry.Priority) && hosts.available(j.download.Mirror()) {
+				next = j
+			}
+		}
+		if next == nil || !hosts.tryAcquire(next.download.Mirror()) {
+			break
+		}
+		next.download.takeSlot(next.download.Mirror())
+
+		ctx, cancel := context.WithCancel(d.ctx)
+		next.run = &jobRun{download: next.download, cancel: cancel, done: make(chan struct{})}
+		next.state = JobActive
+		d.running++
+		d.launch(ctx, next.run, next)
+	}
+}
+
+// launch starts a run of a job's download, monitored like a batch of one. Must be
+// called with d.mu locked; the events of the run are recorded by another goroutine.
+func (d *Daemon) launch(ctx context.Context, run *jobRun, j *job) {
+	StartProgressListener([]*FileDownload{run.download}, &d.wg, &jobRenderer{daemon: d, job: j, run: run})
+
+	release := func() {
+		run.cancel()
+		run.download.releaseSlot()
+		d.mu.Lock()
+		d.running--
+		close(run.done)
+		d.mu.Unlock()
+		d.schedule()
+	}
+	go func() {
+		// start sends the started event, which is recorded under d.mu.
+		_ = run.download.start(ctx, &d.wg, release)
+	}()
+}
+
+// jobRenderer records the events of one run of a job.
+type jobRenderer struct {
+	daemon *Daemon
+	job    *job
+	run    *jobRun
+}
+
+// Render records the events until the channel is closed.
+func (r *jobRenderer) Render(events <-chan Event) {
+	for event := range events {
+		if event.Type == EventQueued {
+			// The daemon sent it when the job was queued.
+			continue
+		}
+		r.daemon.mu.Lock()
+		r.daemon.record(r.job, r.run, event)
+		r.daemon.mu.Unlock()
+	}
+}
+
+// record updates the job from an event of the given run, or of no run, and sends the
+// event to the subscribers. A run that was stopped fails with the cancellation, which
+// is reported as the state it was stopped for. Must be called with d.mu locked.
+func (d *Daemon) record(j *job, run *jobRun, event Event) {
+	if run != nil && run.stop != "" && event.Type == EventFailed {
+		event.Type = EventType(run.stop)
+		event.Error = ""
+	}
+
+	// Events of an earlier run of a resumed job do not change it.
+	if run == nil || run == j.run {
+		j.last = event
+		switch {
+		case event.Type.Final() || event.Type == EventPaused:
+			j.state = JobState(event.Type)
+		case event.Type == EventStarted:
+			j.state = JobActive
+		}
+	}
+
+	d.seq++
+	jobEvent := JobEvent{Seq: d.seq, Event: event}
+	if event.Type != EventProgress {
+		d.history = append(d.history, jobEvent)
+		if len(d.history) > DaemonHistorySize {
+			d.history = d.history[len(d.history)-DaemonHistorySize:]
+		}
+	}
+
+	for sub := range d.subscribers {
+		if sub.lossless {
+			sub.events <- jobEvent
+			continue
+		}
+		select {
+		case sub.events <- jobEvent:
+		default:
+			delete(d.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// info describes the job. Must be called with d.mu locked.
+func (j *job) info() JobInfo {
+	return JobInfo{
+		ID:    j.id,
+		State: j.state,
+		URL:   j.last.URL,
+		Path:  j.last.Path,
+		Bytes: j.last.Bytes,
+		Total: j.last.Total,
+		Speed: j.last.Speed,
+		Error: j.last.Error,
+	}
+}
+
+// Subscribe returns the kept lifecycle events after the sequence number after, and a
+// channel receiving every later event, including progress. The channel is closed when
+// the subscriber falls more than DaemonEventBuffer events behind, when unsubscribe is
+// called or when the daemon closes.
+func (d *Daemon) Subscribe(after int64) (history []JobEvent, events <-chan JobEvent, unsubscribe func()) {
+	return d.subscribe(after, false)
+}
+
+func (d *Daemon) subscribe(after int64, lossless bool) ([]JobEvent, <-chan JobEvent, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var history []JobEvent
+	for _, event := range d.history {
+		if event.Seq > after {
+			history = append(history, event)
+		}
+	}
+
+	sub := &subscriber{events: make(chan JobEvent, DaemonEventBuffer), lossless: lossless}
+	if d.closed {
+		close(sub.events)
+		return history, sub.events, func() {}
+	}
+	d.subscribers[sub] = true
+
+	unsubscribe := func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.subscribers[sub] {
+			delete(d.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return history, sub.events, unsubscribe
+}
+
+// Watch passes every event of the daemon to the renderers, each running in its own
+// goroutine tracked by wg until the daemon is closed. Renderers are never skipped
+// events, so a slow renderer slows down the daemon.
+func (d *Daemon) Watch(wg *sync.WaitGroup, renderers ...Renderer) {
+	for _, renderer := range renderers {
+		_, events, _ := d.subscribe(0, true)
+		output := make(chan Event)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer close(output)
+			for event := range events {
+				output <- event.Event
+			}
+		}()
+		go func(r Renderer) {
+			defer wg.Done()
+			r.Render(output)
+		}(renderer)
+	}
+}
+
+// Close stops the daemon. Active jobs are paused, keeping their partial files, and
+// Close returns once they stopped and every event stream was closed.
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, j := range d.jobs {
+		if j.state == JobActive {
+			j.run.stop = JobPaused
+			j.state = JobPaused
+		}
+	}
+	d.mu.Unlock()
+
+	d.stop()
+	d.wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for sub := range d.subscribers {
+		delete(d.subscribers, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultDaemonAddress is the address the daemon listens on when none is given.
+	DefaultDaemonAddress = "127.0.0.1:7480"
+
+	// MaxJobRequestSize is the largest request body accepted when submitting jobs.
+	MaxJobRequestSize = 1024 * 1024
+)
+
+// apiError is the JSON body of an error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the JSON API of the daemon:
+//
+//	GET  /jobs                list the jobs
+//	POST /jobs                submit a JSON manifest, answering with the new jobs
+//	GET  /jobs/{id}           describe a job
+//	POST /jobs/{id}/pause     pause a job
+//	POST /jobs/{id}/resume    resume a paused job
+//	POST /jobs/{id}/cancel    cancel a job
+//	GET  /events              stream JobEvents as JSON lines
+//
+// /events first sends the kept lifecycle events with a seq above the "after" query
+// parameter, then the events as they happen; progress events only with "progress=true".
+//
+// The API is not authenticated, so requests from web pages are refused: requests with
+// an Origin header or a Host other than a loopback address are rejected, and jobs must
+// be submitted as application/json, which browsers cannot send across origins without
+// asking first.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Jobs())
+	})
+	mux.HandleFunc("POST /jobs", d.handleEnqueue)
+	mux.HandleFunc("GET /jobs/{id}", d.handleJob(d.Job))
+	mux.HandleFunc("POST /jobs/{id}/pause", d.handleJob(d.Pause))
+	mux.HandleFunc("POST /jobs/{id}/resume", d.handleJob(d.Resume))
+	mux.HandleFunc("POST /jobs/{id}/cancel", d.handleJob(d.Cancel))
+	mux.HandleFunc("GET /events", d.handleEvents)
+	return localOnly(mux)
+}
+
+// localOnly rejects requests sent by web pages: those with an Origin header, and those
+// whose Host is not a loopback address, which a page could reach by DNS rebinding.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+			return
+		}
+		if !isLoopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not allowed, use a loopback address", r.Host))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether the host of a Host header, with or without port, is
+// localhost or a loopback IP address.
+func isLoopbackHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (d *Daemon) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("jobs must be submitted as application/json"))
+		return
+	}
+
+	entries, err := decodeJobRequest(http.MaxBytesReader(w, r.Body, MaxJobRequestSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	infos, err := d.enqueue(entries, d.submitted())
+	if err != nil {
+		writeError(w, errorStatus(err, http.StatusBadRequest), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, infos)
+}
+
+// localSchemes are the URL schemes of local content, which jobs submitted over the API
+// may not download: they would let any local user copy files readable by the daemon.
+var localSchemes = []string{"file", "data"}
+
+// decodeJobRequest reads the entries of a JSON manifest sent to the daemon. Directories
+// must stay inside the download directory, URLs must not read local content, and
+// credentials are taken literally.
+func decodeJobRequest(r io.Reader) ([]Entry, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	var manifest []manifestEntry
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid JSON manifest: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(manifest))
+	for i, m := range manifest {
+		if m.Dir != "" && !filepath.IsLocal(m.Dir) {
+			return nil, fmt.Errorf("entry %d: dir %q is not inside the download directory", i+1, m.Dir)
+		}
+		entry, err := m.entry(0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		for _, rawURL := range append([]string{entry.URL}, entry.Mirrors...) {
+			if u, err := url.Parse(rawURL); err == nil && slices.Contains(localSchemes, strings.ToLower(u.Scheme)) {
+				return nil, fmt.Errorf("entry %d: %s URLs cannot be submitted to the daemon", i+1, u.Scheme)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// handleJob serves a request for one job with action.
+func (d *Daemon) handleJob(action func(id int) (JobInfo, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("job %q: %w", r.PathValue("id"), ErrJobNotFound))
+			return
+		}
+
+		info, err := action(id)
+		if err != nil {
+			writeError(w, errorStatus(err, http.StatusInternalServerError), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func (d *Daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	progress, _ := strconv.ParseBool(query.Get("progress"))
+
+	history, events, unsubscribe := d.Subscribe(after)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+
+	for _, event := range history {
+		_ = encoder.Encode(event)
+	}
+	_ = controller.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == EventProgress && !progress {
+				continue
+			}
+			if encoder.Encode(event) != nil || controller.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// errorStatus returns the HTTP status for an error of the daemon.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrJobState):
+		return http.StatusConflict
+	case errors.Is(err, ErrDaemonClosed):
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// ListenDaemon listens on a daemon address: "unix:PATH" for a Unix socket, or
+// "host:port" for TCP on a loopback interface, as the API is not authenticated.
+// A socket file left behind by a daemon that is no longer running is replaced, and the
+// socket is created accessible only to the user running the daemon.
+func ListenDaemon(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", path); err == nil {
+				safeClose(conn)
+				return nil, fmt.Errorf("a daemon is already listening on %s", path)
+			}
+			safeRemove(path)
+		}
+		return listenSocket(path)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daemon address %q: %w", address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("invalid daemon address %q: only loopback addresses and unix sockets are allowed", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// APIError is an error response of the daemon.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Is matches the daemon errors that the status code stands for, such as ErrJobNotFound.
+func (e *APIError) Is(target error) bool {
+	return errorStatus(target, 0) == e.StatusCode
+}
+
+// DaemonClient talks to the API of a daemon.
+type DaemonClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewDaemonClient returns a client for the daemon at address, in the form accepted by ListenDaemon.
+func NewDaemonClient(address string) *DaemonClient {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return &DaemonClient{baseURL: "http://" + address, client: &http.Client{}}
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &DaemonClient{baseURL: "http://localhost", client: &http.Client{Transport: transport}}
+}
+
+// Enqueue submits entries as new jobs.
+func (c *DaemonClient) Enqueue(ctx context.Context, entries []Entry) ([]JobInfo, error) {
+	manifest := make([]manifestEntry, 0, len(entries))
+	for _, entry := range entries {
+		manifest = append(manifest, newManifestEntry(entry))
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []JobInfo
+	err = c.call(ctx, http.MethodPost, "/jobs", body, &infos)
+	return infos, err
+}
+
+// Jobs lists the jobs of the daemon.
+func (c *DaemonClient) Jobs(ctx context.Context) ([]JobInfo, error) {
+	var infos []JobInfo
+	err := c.call(ctx, http.MethodGet, "/jobs", nil, &infos)
+	return infos, err
+}
+
+// Job describes a job.
+func (c *DaemonClient) Job(ctx context.Context, id int) (JobInfo, error) {
+	var info JobInfo
+	err := c.call(ctx, http.MethodGet, "/jobs/"+strconv.Itoa(id), nil, &info)
+	return info, err
+}
+
+// Pause pauses a job.
+func (c *DaemonClient) Pause(ctx context.Context, id int) (JobInfo, error) {
+	return c.action(ctx, id, "pause")
+}
+
+// Resume resumes a paused job.
+func (c *DaemonClient) Resume(ctx context.Context, id int) (JobInfo, error) {
+	return c.action(ctx, id, "resume")
+}
+
+// Cancel cancels a job.
+func (c *DaemonClient) Cancel(ctx context.Context, id int) (JobInfo, error) {
+	return c.action(ctx, id, "cancel")
+}
+
+func (c *DaemonClient) action(ctx context.Context, id int, action string) (JobInfo, error) {
+	var info JobInfo
+	err := c.call(ctx, http.MethodPost, "/jobs/"+strconv.Itoa(id)+"/"+action, nil, &info)
+	return info, err
+}
+
+// Events calls fn for the events of the daemon with a seq above after, including
+// progress events when progress is set, until ctx is done, the daemon closes the
+// stream or fn returns an error, which Events then returns.
+func (c *DaemonClient) Events(ctx context.Context, after int64, progress bool, fn func(JobEvent) error) error {
+	query := url.Values{"after": {strconv.FormatInt(after, 10)}, "progress": {strconv.FormatBool(progress)}}
+	resp, err := c.do(ctx, http.MethodGet, "/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer safeClose(resp.Body)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event JobEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("invalid event from daemon: %w", err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+// call sends a request and decodes the JSON response into result.
+func (c *DaemonClient) call(ctx context.Context, method, path string, body []byte, result any) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer safeClose(resp.Body)
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	return nil
+}
+
+// do sends a request, turning error responses into an *APIError.
+func (c *DaemonClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach daemon: %w", err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer safeClose(resp.Body)
+
+	var apiErr apiError
+	if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+		apiErr.Error = resp.Status
+	}
+	return nil, &APIError{StatusCode: resp.StatusCode, Message: apiErr.Error}
+}
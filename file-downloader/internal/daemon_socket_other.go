@@ -0,0 +1,11 @@
+//go:build !unix
+
+package internal
+
+import "net"
+
+// listenSocket listens on a Unix socket at path. File modes do not restrict sockets on
+// this platform, so access is left to the permissions of the directory.
+func listenSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
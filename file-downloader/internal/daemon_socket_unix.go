@@ -0,0 +1,17 @@
+//go:build unix
+
+package internal
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenSocket listens on a Unix socket at path that only the current user may connect
+// to. The umask is set while the socket is created, so it never has a wider mode, not
+// even until a later chmod; the daemon creates no other files at the same time.
+func listenSocket(path string) (net.Listener, error) {
+	umask := syscall.Umask(0o177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
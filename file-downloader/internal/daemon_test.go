@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDaemon runs a daemon behind a test server and returns a client for it.
+func newTestDaemon(t *testing.T, dir string, opts Options, limit int) (*Daemon, *DaemonClient) {
+	t.Helper()
+
+	daemon, err := NewDaemon(dir, opts, limit)
+	if err != nil {
+		t.Fatalf("NewDaemon() error = %v", err)
+	}
+	server := httptest.NewServer(daemon.Handler())
+	t.Cleanup(func() {
+		daemon.Close()
+		server.Close()
+	})
+	return daemon, NewDaemonClient(strings.TrimPrefix(server.URL, "http://"))
+}
+
+// waitForJob polls a job until cond holds for it.
+func waitForJob(t *testing.T, client *DaemonClient, id int, cond func(JobInfo) bool) JobInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := client.Job(context.Background(), id)
+		if err != nil {
+			t.Fatalf("Job(%d) error = %v", id, err)
+		}
+		if cond(info) {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d did not reach the expected state, last %+v", id, info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func inState(state JobState) func(JobInfo) bool {
+	return func(info JobInfo) bool { return info.State == state }
+}
+
+func TestDaemonJobs(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	var blocked atomic.Bool
+	blocked.Store(true)
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/slow.bin" && blocked.Load() {
+			// Send half of the file, then hang until the client goes away.
+			w.Header().Set("Content-Length", "100000")
+			_, _ = w.Write(content[:50000])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		if r.URL.Path == "/slow.bin" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	// Registered before the daemon, so the daemon stops its downloads first.
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	_, client := newTestDaemon(t, dir, Options{Resume: true, Retry: RetryPolicy{MaxAttempts: 1}}, 1)
+	ctx := context.Background()
+
+	jobs, err := client.Enqueue(ctx, []Entry{{URL: server.URL + "/slow.bin"}, {URL: server.URL + "/fast.bin"}})
+	if err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != 1 || jobs[1].ID != 2 {
+		t.Fatalf("Enqueue() = %+v, want jobs 1 and 2", jobs)
+	}
+
+	// With one slot, the second job waits until the first one is paused.
+	waitForJob(t, client, 1, func(info JobInfo) bool { return info.Bytes == 50000 })
+	if info, _ := client.Job(ctx, 2); info.State != JobQueued {
+		t.Errorf("job 2 state = %s while job 1 runs, want %s", info.State, JobQueued)
+	}
+	info, err := client.Pause(ctx, 1)
+	if err != nil || info.State != JobPaused {
+		t.Fatalf("Pause() = %+v, %v, want a paused job", info, err)
+	}
+	waitForJob(t, client, 2, inState(JobCompleted))
+
+	blocked.Store(false)
+	if _, err := client.Resume(ctx, 1); err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	info = waitForJob(t, client, 1, inState(JobCompleted))
+	got, err := os.ReadFile(info.Path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("job 1 file does not match the source (err %v)", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(ranges, []string{"bytes=50000-"}) {
+		t.Errorf("resumed requests sent Range %q, want a continuation", ranges)
+	}
+
+	// The event stream replays the lifecycle of the jobs.
+	var types []EventType
+	errDone := errors.New("done")
+	err = client.Events(ctx, 0, false, func(event JobEvent) error {
+		if event.Index == 1 {
+			types = append(types, event.Type)
+		}
+		if event.Index == 1 && event.Type == EventCompleted {
+			return errDone
+		}
+		return nil
+	})
+	if !errors.Is(err, errDone) {
+		t.Fatalf("Events() error = %v", err)
+	}
+	want := []EventType{EventQueued, EventStarted, EventPaused, EventQueued, EventStarted, EventCompleted}
+	if !slices.Equal(types, want) {
+		t.Errorf("job 1 events = %v, want %v", types, want)
+	}
+
+	if _, err := client.Resume(ctx, 1); !errors.Is(err, ErrJobState) {
+		t.Errorf("Resume() of a completed job error = %v, want ErrJobState", err)
+	}
+	if _, err := client.Pause(ctx, 42); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Pause() of an unknown job error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestDaemonCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	// Registered before the daemon, so the daemon stops its downloads first.
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	_, client := newTestDaemon(t, dir, Options{Resume: true, Retry: RetryPolicy{MaxAttempts: 1}}, 1)
+	ctx := context.Background()
+
+	if _, err := client.Enqueue(ctx, []Entry{{URL: server.URL + "/a.bin"}, {URL: server.URL + "/b.bin"}}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	waitForJob(t, client, 1, func(info JobInfo) bool { return info.Bytes > 0 })
+
+	// Cancelling the queued job does not wait for a slot.
+	if info, err := client.Cancel(ctx, 2); err != nil || info.State != JobCancelled {
+		t.Fatalf("Cancel() of a queued job = %+v, %v", info, err)
+	}
+	if info, err := client.Cancel(ctx, 1); err != nil || info.State != JobCancelled {
+		t.Fatalf("Cancel() of an active job = %+v, %v", info, err)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, "*"+PartSuffix+"*")); len(parts) > 0 {
+		t.Errorf("partial files left behind: %v", parts)
+	}
+	if _, err := client.Pause(ctx, 1); !errors.Is(err, ErrJobState) {
+		t.Errorf("Pause() of a cancelled job error = %v, want ErrJobState", err)
+	}
+
+	// The path of a cancelled job can be used again.
+	jobs, err := client.Enqueue(ctx, []Entry{{URL: server.URL + "/a.bin"}})
+	if err != nil || jobs[0].ID != 3 {
+		t.Fatalf("Enqueue() = %+v, %v, want job 3", jobs, err)
+	}
+	if _, err := client.Enqueue(ctx, []Entry{{URL: server.URL + "/a.bin"}}); err == nil {
+		t.Error("Enqueue() accepted a path used by an unfinished job")
+	}
+}
+
+func TestDaemonRejectsRequests(t *testing.T) {
+	t.Setenv("DAEMON_TEST_SECRET", "s3cret")
+	_, client := newTestDaemon(t, t.TempDir(), Options{}, 1)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "absolute dir", body: `[{"url": "https://example.com/a", "dir": "/etc"}]`},
+		{name: "parent dir", body: `[{"url": "https://example.com/a", "dir": "../up"}]`},
+		{name: "unknown field", body: `[{"url": "https://example.com/a", "target": "x"}]`},
+		{name: "invalid URL", body: `[{"url": "ftp://example.com/a"}]`},
+		{name: "file URL", body: `[{"url": "file:///home/user/.ssh/id_rsa", "filename": "stolen"}]`},
+		{name: "data URL", body: `[{"url": "data:,hello"}]`},
+		{name: "file mirror", body: `[{"url": "https://example.com/a", "mirrors": ["FILE:///etc/shadow"]}]`},
+		{name: "empty", body: `[]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.do(context.Background(), http.MethodPost, "/jobs", []byte(tt.body))
+			if err == nil {
+				safeClose(resp.Body)
+				t.Fatal("request was accepted")
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+				t.Errorf("error = %v, want a 400 response", err)
+			}
+		})
+	}
+
+	entries, err := decodeJobRequest(strings.NewReader(`[{"url": "https://example.com/a", "bearer_token": "${DAEMON_TEST_SECRET}"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entries[0].Auth.BearerToken; got != "${DAEMON_TEST_SECRET}" {
+		t.Errorf("bearer token = %q, want it unexpanded", got)
+	}
+}
+
+func TestDaemonKeepsCredentialsFromSubmittedJobs(t *testing.T) {
+	netrc, err := parseNetrc(strings.NewReader("default login user password secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   Options
+		header string
+		want   string
+	}{
+		{name: "bearer", opts: Options{Auth: &Credentials{BearerToken: "secret"}}, header: "Authorization", want: "Bearer secret"},
+		{name: "authorization header", opts: Options{Header: http.Header{"Authorization": {"Token secret"}}}, header: "Authorization", want: "Token secret"},
+		{name: "api key header", opts: Options{Header: http.Header{"X-Api-Key": {"secret"}}}, header: "X-Api-Key", want: "secret"},
+		{name: "netrc default", opts: Options{Netrc: netrc}, header: "Authorization", want: "Basic dXNlcjpzZWNyZXQ="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := func(got *atomic.Value) *httptest.Server {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					got.Store(r.Header.Get(tt.header))
+					_, _ = w.Write([]byte("data"))
+				}))
+				t.Cleanup(server.Close)
+				return server
+			}
+			var trustedGot, otherGot atomic.Value
+			trusted := received(&trustedGot)
+			other := received(&otherGot)
+
+			daemon, client := newTestDaemon(t, t.TempDir(), tt.opts, 2)
+			started, err := daemon.Enqueue([]Entry{{URL: trusted.URL + "/a.bin"}})
+			if err != nil {
+				t.Fatalf("Enqueue() error = %v", err)
+			}
+			submitted, err := client.Enqueue(context.Background(), []Entry{{URL: other.URL + "/b.bin"}})
+			if err != nil {
+				t.Fatalf("client Enqueue() error = %v", err)
+			}
+			waitForJob(t, client, started[0].ID, inState(JobCompleted))
+			waitForJob(t, client, submitted[0].ID, inState(JobCompleted))
+
+			if got := trustedGot.Load(); got != tt.want {
+				t.Errorf("%s of a job queued at startup = %q, want %q", tt.header, got, tt.want)
+			}
+			if got := otherGot.Load(); got != "" {
+				t.Errorf("%s of a job submitted over the API = %q, want none", tt.header, got)
+			}
+		})
+	}
+}
+
+func TestDaemonRejectsBrowserRequests(t *testing.T) {
+	daemon, err := NewDaemon(t.TempDir(), Options{}, 1)
+	if err != nil {
+		t.Fatalf("NewDaemon() error = %v", err)
+	}
+	server := httptest.NewServer(daemon.Handler())
+	t.Cleanup(func() {
+		daemon.Close()
+		server.Close()
+	})
+
+	body := `[{"url": "https://example.com/a"}]`
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		origin      string
+		host        string
+		wantStatus  int
+	}{
+		{name: "text/plain body", method: http.MethodPost, contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "form body", method: http.MethodPost, contentType: "application/x-www-form-urlencoded", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "origin", method: http.MethodPost, contentType: "application/json", origin: "https://evil.example", wantStatus: http.StatusForbidden},
+		{name: "origin on GET", method: http.MethodGet, origin: "https://evil.example", wantStatus: http.StatusForbidden},
+		{name: "rebound host", method: http.MethodGet, host: "evil.example:7480", wantStatus: http.StatusForbidden},
+		{name: "localhost", method: http.MethodGet, host: "localhost:7480", wantStatus: http.StatusOK},
+		{name: "IPv6 loopback", method: http.MethodGet, host: "[::1]:7480", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+"/jobs", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			safeClose(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+	if jobs := daemon.Jobs(); len(jobs) != 0 {
+		t.Errorf("rejected requests created jobs: %+v", jobs)
+	}
+}
+
+func TestListenDaemon(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "daemon.sock")
+
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "127.0.0.1:0"},
+		{address: "localhost:0"},
+		{address: "unix:" + socket},
+		{address: "0.0.0.0:0", wantErr: true},
+		{address: ":0", wantErr: true},
+		{address: "example.com:7480", wantErr: true},
+		{address: "7480", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			listener, err := ListenDaemon(tt.address)
+			if err == nil {
+				defer safeClose(listener)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListenDaemon() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if path, ok := strings.CutPrefix(tt.address, "unix:"); ok && err == nil && runtime.GOOS != "windows" {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != 0o600 {
+					t.Errorf("socket mode = %v, want 0600", info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
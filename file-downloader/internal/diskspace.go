@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// errDiskSpaceUnsupported is returned by diskSpace on platforms where the free space
+// of a file system cannot be determined.
+var errDiskSpaceUnsupported = errors.New("free disk space cannot be determined on this platform")
+
+// DiskSpaceShortage describes a file system without room for the downloads going to it.
+type DiskSpaceShortage struct {
+	// Dir is a directory on the file system that receives downloads.
+	Dir    string
+	Needed int64
+	Free   int64
+}
+
+func (s DiskSpaceShortage) String() string {
+	return fmt.Sprintf("%s needed in %s, but only %s free", formatBytes(s.Needed, 0), s.Dir, formatBytes(s.Free, 0))
+}
+
+// CheckDiskSpace compares the bytes still to be written to each directory with the free
+// space of the file systems the directories are on, counting directories on the same
+// file system together. File systems whose free space cannot be determined are skipped.
+func CheckDiskSpace(needed map[string]int64) []DiskSpaceShortage {
+	dirs := make([]string, 0, len(needed))
+	for dir := range needed {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+
+	type fileSystem struct {
+		dir    string
+		needed int64
+		free   int64
+	}
+	var order []uint64
+	systems := make(map[uint64]*fileSystem)
+	for _, dir := range dirs {
+		free, device, err := diskSpace(filepath.Clean(dir))
+		if err != nil {
+			continue
+		}
+		fs, ok := systems[device]
+		if !ok {
+			fs = &fileSystem{dir: dir, free: free}
+			systems[device] = fs
+			order = append(order, device)
+		}
+		fs.needed += needed[dir]
+	}
+
+	var shortages []DiskSpaceShortage
+	for _, device := range order {
+		if fs := systems[device]; fs.needed > fs.free {
+			shortages = append(shortages, DiskSpaceShortage{Dir: fs.dir, Needed: fs.needed, Free: fs.free})
+		}
+	}
+	return shortages
+}
+
+// PlannedSpace returns the bytes the downloads still have to write to each directory, as
+// far as their sizes are known before any request is sent, such as from a Metalink file.
+// Bytes already in the partial files of resumed downloads are subtracted.
+func PlannedSpace(downloads []*FileDownload) map[string]int64 {
+	needed := make(map[string]int64)
+	for _, d := range downloads {
+		size := d.entry.Size
+		if size <= 0 || d.State() == StateSkipped {
+			continue
+		}
+		if d.canResume() {
+			if info, err := os.Stat(d.partPath()); err == nil {
+				size -= min(info.Size(), size)
+			}
+		}
+		needed[filepath.Dir(d.FilePath)] += size
+	}
+	return needed
+}
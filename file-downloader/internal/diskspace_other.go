@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package internal
+
+// diskSpace is not implemented on this platform.
+func diskSpace(dir string) (int64, uint64, error) {
+	return 0, 0, errDiskSpaceUnsupported
+}
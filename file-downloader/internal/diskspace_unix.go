@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package internal
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskSpace returns the bytes available to unprivileged users on the file system of
+// dir, and the ID of the device holding it.
+func diskSpace(dir string) (int64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, fmt.Errorf("failed to check free space of %s: %w", dir, err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, 0, fmt.Errorf("failed to check %s: %w", dir, err)
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), uint64(st.Dev), nil
+}
@@ -1,14 +1,19 @@
 package internal
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,14 +21,201 @@ const (
 	DefaultBufferSize = 32 * 1024
 )
 
+// Options holds the settings shared by every download in a batch.
+type Options struct {
+	// Resume continues interrupted downloads from their partial files
+	// instead of starting over.
+	Resume bool
+
+	// Segments is the number of concurrent range requests used for a single file
+	// when the server supports them. Values below 2 download over one connection.
+	Segments int
+
+	// Retry controls how failed downloads are retried.
+	Retry RetryPolicy
+
+	// RateLimiter caps the combined throughput of all downloads. It may be nil.
+	RateLimiter *RateLimiter
+
+	// Hosts caps the downloads per host, spaces out the requests to a host and backs
+	// off from hosts that answer 429 or 503. It may be nil.
+	Hosts *HostLimiter
+
+	// OnConflict decides what happens when a target file already exists
+	// or is used twice in a batch. The zero value overwrites existing files.
+	OnConflict ConflictPolicy
+
+	// Checksums maps file names to their expected digests, typically loaded
+	// from a SHA256SUMS style file. A checksum in the URL fragment takes precedence.
+	Checksums map[string]*Checksum
+
+	// MirrorStrategy decides in which order the mirrors of a download are tried.
+	// The zero value tries them in the order they are listed.
+	MirrorStrategy MirrorStrategy
+
+	// Locations lists preferred country codes, such as "de". Mirrors located in them,
+	// as given by the Locations of an entry, are tried first, in this order.
+	Locations []string
+
+	// StallTimeout fails an attempt that receives no data for this long, so it is
+	// retried or continued from another mirror. Zero disables stall detection.
+	StallTimeout time.Duration
+
+	// MinSpeed fails an attempt whose speed stays below this many bytes per second for
+	// MinSpeedTime, so it is retried like a stalled one. Zero disables the check.
+	MinSpeed     int64
+	MinSpeedTime time.Duration
+
+	// Header holds request headers sent with every download, such as User-Agent.
+	// Headers of an entry replace the ones with the same name.
+	Header http.Header
+
+	// HTTPClient sends the requests of HTTP and HTTPS downloads in place of the client of
+	// the registered HTTPFetcher. It may be nil.
+	HTTPClient *http.Client
+
+	// Auth authenticates the requests of every download that has no credentials
+	// of its own. It is only sent to the host of the download's URL.
+	Auth *Credentials
+
+	// Netrc supplies credentials by host name for requests without other credentials.
+	// It may be nil.
+	Netrc *Netrc
+
+	// Cache records completed downloads so that later runs only download files that
+	// changed at the source. It may be nil.
+	Cache *Cache
+
+	// Extract unpacks downloaded archives. It may be nil.
+	Extract *ExtractOptions
+
+	// Journal records the state of every download of the batch, so an interrupted batch
+	// can be resumed. It only receives events when it is also passed to
+	// StartProgressListener as a renderer. It may be nil.
+	Journal *Journal
+}
+
+// State is the stage of a download's lifecycle.
+type State int
+
+const (
+	// StateQueued means the download is waiting for a free slot.
+	StateQueued State = iota
+	// StateActive means the download is transferring data.
+	StateActive
+	// StateDone means the download completed successfully.
+	StateDone
+	// StateFailed means the download stopped with an error.
+	StateFailed
+	// StateSkipped means the download did not run because its file already exists.
+	StateSkipped
+	// StateUpToDate means the source confirmed that the file of a previous run did not change.
+	StateUpToDate
+	// StateExtracting means the download completed and its archive is being unpacked.
+	StateExtracting
+)
+
+// String returns the display name of the state.
+func (s State) String() string {
+	switch s {
+	case StateQueued:
+		return "Queued"
+	case StateActive:
+		return "Active"
+	case StateDone:
+		return "Done"
+	case StateFailed:
+		return "Failed"
+	case StateSkipped:
+		return "Skipped"
+	case StateUpToDate:
+		return "Up to date"
+	case StateExtracting:
+		return "Extracting"
+	default:
+		return "Unknown"
+	}
+}
+
 // FileDownload represents a single file download with its progress channel.
 type FileDownload struct {
 	URL         string
 	FilePath    string
 	LoadedBytes chan int64
+
+	// Mirrors lists alternative URLs serving the same file, used when URL fails.
+	Mirrors []string
+
+	// Checksum is the expected digest of the file, or nil if it is not verified.
+	Checksum *Checksum
+	// Header holds extra request headers sent with every request for the file.
+	Header http.Header
+
+	entry       Entry
+	opts        Options
+	cached      *cacheRecord
+	pieces      *pieceDigests
+	auth        *Credentials
+	authHost    string
+	sources     []string
+	source      int
+	index       int
+	events      chan<- Event
+	limiter     *RateLimiter
+	partBase    string
+	fixedName   bool
+	claims      *pathClaims
+	state       State
+	startedAt   time.Time
+	attempt     int
+	retryAt     time.Time
+	activeAt    time.Time
+	stallPauses int
+	waited      time.Duration
 	totalBytes  int64
+	downloaded  int64
+	received    int64
+	digest      string
 	mu          sync.RWMutex
 	err         error
+
+	extractDir     string
+	extractedBytes int64
+	// extracted is set when the archive was unpacked while it downloaded.
+	extracted bool
+
+	// tries counts the attempts made in this run, including mirror switches.
+	// It is only used by the download goroutine.
+	tries int
+
+	// slot is a URL of the host whose download slot the download holds, if any.
+	// It moves to the host of every mirror the download requests from.
+	slot   string
+	slotMu sync.Mutex
+}
+
+// State returns the current lifecycle state of the download.
+func (f *FileDownload) State() State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.state
+}
+
+// setState sets the lifecycle state, recording the start time when the download becomes active.
+func (f *FileDownload) setState(state State) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+	if state == StateActive {
+		f.startedAt = time.Now()
+	}
+}
+
+// StartedAt returns the time the download left the queue, or the zero time if it is still queued.
+func (f *FileDownload) StartedAt() time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.startedAt
 }
 
 // Err returns the error that occurred during download, if any.
@@ -54,131 +246,537 @@ func (f *FileDownload) setTotalBytes(total int64) {
 	f.totalBytes = total
 }
 
-// Prepare validates the URL and prepares the file path, but does NOT make any HTTP requests.
+// Downloaded returns the number of bytes of the file that are on disk,
+// including any bytes kept from a previous run.
+func (f *FileDownload) Downloaded() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.downloaded
+}
+
+// setDownloaded sets the number of bytes on disk in a thread-safe manner.
+func (f *FileDownload) setDownloaded(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.downloaded = n
+}
+
+// report records n newly written bytes and sends them to the LoadedBytes channel.
+func (f *FileDownload) report(n int64) {
+	f.mu.Lock()
+	f.downloaded += n
+	f.received += n
+	f.activeAt = time.Now()
+	f.mu.Unlock()
+	f.LoadedBytes <- n
+}
+
+// Prepare validates the entry and prepares the file path, but does NOT make any HTTP requests.
 // This allows for setup of UI to consume the LoadedBytes channel before data starts flowing.
 // The actual HTTP request is deferred until Start() is called.
-func (f *FileDownload) Prepare(url string, directory string) error {
-	f.URL = url
+// The entry's directory is resolved relative to directory unless it is absolute.
+func (f *FileDownload) Prepare(entry Entry, directory string, opts Options) error {
+	f.URL = entry.URL
+	f.entry = entry
+	f.opts = opts
 
-	err := validateURL(url)
+	url, checksum, err := splitChecksumFragment(entry.URL)
 	if err != nil {
 		return err
 	}
+	f.URL = url
 
-	fileName, err := extractFileName(url)
+	err = validateURL(url)
 	if err != nil {
 		return err
 	}
 
+	f.Mirrors = nil
+	for _, mirror := range entry.Mirrors {
+		mirror, mirrorChecksum, err := splitChecksumFragment(mirror)
+		if err != nil {
+			return err
+		}
+		err = validateURL(mirror)
+		if err != nil {
+			return fmt.Errorf("invalid mirror: %w", err)
+		}
+		if checksum == nil {
+			checksum = mirrorChecksum
+		}
+		f.Mirrors = append(f.Mirrors, mirror)
+	}
+
+	fileName := entry.FileName
+	if fileName == "" {
+		fileName, err = extractFileName(url)
+		if err != nil {
+			return err
+		}
+	} else if err := validateFileName(fileName); err != nil {
+		return err
+	}
+
+	if entry.Dir != "" {
+		if filepath.IsAbs(entry.Dir) {
+			directory = entry.Dir
+		} else {
+			directory = filepath.Join(directory, entry.Dir)
+		}
+	}
+
 	err = ensureDirectory(directory)
 	if err != nil {
 		return err
 	}
 
+	if entry.Checksum != "" {
+		checksum, err = ParseChecksum(entry.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.pieces = nil
+	if entry.Pieces != nil {
+		f.pieces, err = entry.Pieces.digests(entry.Size)
+		if err != nil {
+			return err
+		}
+	}
+
 	f.FilePath = filepath.Join(directory, fileName)
+	f.partBase = f.FilePath
+	f.fixedName = entry.FileName != ""
+	f.Header = mergeHeaders(opts.Header, entry.Header)
+	f.auth = cmp.Or(entry.Auth, opts.Auth)
+	f.authHost = urlHost(url)
+	f.sources = preferLocations(append([]string{url}, f.Mirrors...), entry.Locations, opts.Locations)
+	f.limiter = NewRateLimiter(entry.RateLimit)
 	f.LoadedBytes = make(chan int64)
 
+	f.Checksum = checksum
+	if f.Checksum == nil {
+		f.Checksum = opts.Checksums[fileName]
+	}
+
 	return nil
 }
 
 // Start makes the HTTP request, begins reading from the response, writing to file,
 // and sending progress updates. Accepts a context for cancellation support.
+// Data is written to a partial file that is renamed to FilePath once complete.
 func (f *FileDownload) Start(ctx context.Context, wg *sync.WaitGroup) error {
+	return f.start(ctx, wg, nil)
+}
+
+// start runs the download in a new goroutine and calls release, if set, once it finishes.
+func (f *FileDownload) start(ctx context.Context, wg *sync.WaitGroup, release func()) error {
 	if f.URL == "" {
 		return errors.New("download not prepared: URL is empty")
 	}
 
+	if f.State() == StateSkipped {
+		f.emit(EventSkipped, nil)
+		close(f.LoadedBytes)
+		if release != nil {
+			release()
+		}
+		return nil
+	}
+
+	f.setState(StateActive)
+	f.emit(EventStarted, nil)
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer close(f.LoadedBytes)
+		if release != nil {
+			defer release()
+		}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
-		if err != nil {
-			f.setErr(fmt.Errorf("failed to create request: %w", err))
+		err := f.run(ctx)
+		if err == nil && f.opts.Extract != nil && !f.extracted {
+			err = f.extract(ctx)
+		}
+		if errors.Is(err, errSkipped) {
+			f.setState(StateSkipped)
+			f.emit(EventSkipped, nil)
+			return
+		}
+		if errors.Is(err, ErrNotModified) {
+			f.upToDate()
+			f.setState(StateUpToDate)
+			f.emit(EventUpToDate, nil)
 			return
 		}
-
-		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			f.setErr(fmt.Errorf("failed to fetch URL: %w", err))
+			if !f.opts.Resume {
+				f.removePartial()
+			}
+			f.setErr(err)
+			f.setState(StateFailed)
+			f.emit(EventFailed, err)
 			return
 		}
-		defer safeClose(resp.Body)
+		f.setState(StateDone)
+		f.emit(EventCompleted, nil)
+	}()
 
-		if resp.StatusCode != http.StatusOK {
-			f.setErr(fmt.Errorf("bad status: %s", resp.Status))
-			return
+	return nil
+}
+
+// download transfers the file into the partial file, continuing from a previous
+// run when possible, and moves it into place when the transfer completes.
+func (f *FileDownload) download(ctx context.Context) error {
+	if f.opts.Segments > 1 && !f.streamExtraction(f.Path()) {
+		handled, err := f.downloadSegmented(ctx)
+		if handled {
+			return err
 		}
+	}
+	return f.downloadStream(ctx)
+}
+
+// downloadStream downloads the file over a single connection.
+func (f *FileDownload) downloadStream(ctx context.Context) error {
+	offset, validator, expectedTotal := f.resumePoint()
 
-		f.setTotalBytes(resp.ContentLength)
+	result, err := f.fetch(ctx, offset, 0, validator)
+	if err != nil {
+		return err
+	}
 
-		file, err := os.Create(f.FilePath)
+	if offset > 0 && partialMismatch(result, validator, expectedTotal) {
+		// The partial file was started from a mirror with a different file; start over.
+		safeClose(result.Body)
+		result, err = f.fetch(ctx, 0, 0, "")
 		if err != nil {
-			f.setErr(fmt.Errorf("failed to create file: %w", err))
-			return
+			return err
 		}
-		defer safeClose(file)
+	}
+	defer safeClose(result.Body)
 
-		buffer := make([]byte, DefaultBufferSize)
-		for {
-			select {
-			case <-ctx.Done():
-				f.setErr(ctx.Err())
-				return
-			default:
-			}
+	// A zero offset means a fresh download, or the source sent the whole file
+	// because it changed since the partial file was written.
+	if result.Offset != 0 && result.Offset != offset {
+		return fmt.Errorf("source resumed at byte %d, expected %d", result.Offset, offset)
+	}
+	offset = result.Offset
+	total := result.Size
 
-			n, err := resp.Body.Read(buffer)
-			if n > 0 {
-				_, writeErr := file.Write(buffer[:n])
-				if writeErr != nil {
-					f.setErr(fmt.Errorf("failed to write to file: %w", writeErr))
-					return
-				}
-				f.LoadedBytes <- int64(n)
+	err = f.useServerFileName(result.FileName)
+	if err != nil {
+		return err
+	}
+
+	if offset == 0 && f.streamExtraction(f.Path()) {
+		return f.extractStream(ctx, result)
+	}
+
+	f.setTotalBytes(total)
+	f.setDownloaded(offset)
+
+	err = savePartialMeta(f.metaPath(), newPartialMeta(f.URL, f.Mirror(), result))
+	if err != nil {
+		return fmt.Errorf("failed to save resume metadata: %w", err)
+	}
+
+	hasher, err := f.checksumHasher(offset)
+	if err != nil {
+		return err
+	}
+
+	file, err := openPartFile(f.partPath(), offset)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = file
+	if hasher != nil {
+		w = io.MultiWriter(file, hasher)
+	}
+
+	err = f.copyBody(ctx, w, result.Body)
+	if err == nil {
+		err = syncFile(file)
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close file: %w", closeErr)
+	}
+
+	return f.finish(ctx, hasher)
+}
+
+// finish verifies the size, pieces and checksum of the completed partial file, atomically
+// moves it to FilePath, records it in the download cache and removes its metadata.
+// h holds the hash of the streamed data, or is nil to hash the file from disk.
+func (f *FileDownload) finish(ctx context.Context, h hash.Hash) error {
+	info, err := os.Stat(f.partPath())
+	if err != nil {
+		return fmt.Errorf("failed to check downloaded file: %w", err)
+	}
+	if total := f.TotalBytes(); total >= 0 && info.Size() != total {
+		return fmt.Errorf("incomplete download: got %d bytes, expected %d: %w", info.Size(), total, io.ErrUnexpectedEOF)
+	}
+	if size := f.entry.Size; size > 0 && info.Size() != size {
+		f.removePartial()
+		return fmt.Errorf("size mismatch: got %d bytes, expected %d", info.Size(), size)
+	}
+
+	repaired, err := f.repairPieces(ctx)
+	if err != nil {
+		return err
+	}
+	if repaired {
+		// The hash of the streamed data includes the corrupted pieces.
+		h = nil
+	}
+
+	err = f.verifyChecksum(h)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.partPath(), f.Path())
+	if err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	syncDir(filepath.Dir(f.Path()))
+
+	if f.Checksum != nil || f.needsDigest() {
+		digest, err := f.fileDigest(h)
+		if err != nil {
+			log.Printf("Warning: no digest of %s: %v", f.Path(), err)
+		}
+		f.mu.Lock()
+		f.digest = digest
+		f.mu.Unlock()
+	}
+
+	meta, err := loadPartialMeta(f.metaPath())
+	if err == nil {
+		err = f.cacheFile(meta, f.Digest())
+	}
+	if err != nil {
+		log.Printf("Warning: %s is not cached: %v", f.Path(), err)
+	}
+	safeRemove(f.metaPath())
+	return nil
+}
+
+// copyBody streams the response body to w, reporting progress as it goes.
+func (f *FileDownload) copyBody(ctx context.Context, w io.Writer, body io.Reader) error {
+	buffer := make([]byte, DefaultBufferSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if throttleErr := f.throttle(ctx, n); throttleErr != nil {
+				return throttleErr
 			}
-			if err != nil {
-				if err != io.EOF {
-					f.setErr(fmt.Errorf("failed to read response: %w", err))
-				}
-				return
+			_, writeErr := w.Write(buffer[:n])
+			if writeErr != nil {
+				return fmt.Errorf("failed to write to file: %w", writeErr)
 			}
+			f.report(int64(n))
 		}
-	}()
+		if err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+			return nil
+		}
+	}
+}
 
-	return nil
+// openPartFile opens the partial file for writing at offset, truncating anything after it.
+// A zero offset starts the file from scratch.
+func openPartFile(path string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		safeClose(file)
+		return nil, fmt.Errorf("failed to prepare file for writing: %w", err)
+	}
+
+	return file, nil
 }
 
 // PrepareDownloads prepares all downloads without starting them.
 // It validates URLs and sets up file paths but does not make HTTP requests.
-func PrepareDownloads(urls []string, directory string) ([]*FileDownload, error) {
+// Downloads are ordered by descending entry priority, keeping the input order for equal priorities.
+// Errors for entries read from a manifest include the manifest line number.
+func PrepareDownloads(entries []Entry, directory string, opts Options) ([]*FileDownload, error) {
 	err := ensureDirectory(directory)
 	if err != nil {
 		return nil, err
 	}
 
-	downloads := make([]*FileDownload, 0, len(urls))
-	for _, url := range urls {
+	entries = sortByPriority(entries)
+
+	claims := newPathClaims()
+	downloads := make([]*FileDownload, 0, len(entries))
+	for _, entry := range entries {
 		d := &FileDownload{}
-		err := d.Prepare(url, directory)
+		err := d.Prepare(entry, directory, opts)
+		if err == nil {
+			err = claims.resolve(d, opts.OnConflict)
+		}
+		if errors.Is(err, errSkipped) {
+			d.setState(StateSkipped)
+			err = nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to prepare download for %s: %w", url, err)
+			if entry.Line > 0 {
+				return nil, fmt.Errorf("line %d: failed to prepare download for %s: %w", entry.Line, RedactURL(entry.URL), err)
+			}
+			return nil, fmt.Errorf("failed to prepare download for %s: %w", RedactURL(entry.URL), err)
 		}
+		d.partBase = d.FilePath
+		d.claims = claims
+		d.index = len(downloads)
 		downloads = append(downloads, d)
 	}
 
 	return downloads, nil
 }
 
+// sortByPriority returns a copy of entries ordered by descending priority, keeping the
+// input order for equal priorities.
+func sortByPriority(entries []Entry) []Entry {
+	entries = slices.Clone(entries)
+	slices.SortStableFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	return entries
+}
+
 // StartAll starts all downloads with the provided context and WaitGroup.
+// At most limit downloads run at once; the rest stay queued and are started in order
+// as running downloads finish. A limit of zero or less starts every download immediately.
+// When Options.Hosts caps the downloads per host, a download also waits for a slot of
+// the host it starts from, letting the downloads of other hosts go first; so does a
+// download whose host is not ready for another request, as long as other downloads are.
+// A download that moves on to a mirror takes its slot along to the host of the mirror.
 // It returns immediately after starting all goroutines; use WaitGroup to wait for completion.
-func StartAll(ctx context.Context, downloads []*FileDownload, wg *sync.WaitGroup) error {
+func StartAll(ctx context.Context, downloads []*FileDownload, limit int, wg *sync.WaitGroup) error {
+	capped := false
 	for _, d := range downloads {
-		err := d.Start(ctx, wg)
-		if err != nil {
-			return fmt.Errorf("failed to start download for %s: %w", d.URL, err)
+		if d.URL == "" {
+			return fmt.Errorf("failed to start download: download not prepared: URL is empty")
+		}
+		capped = capped || d.opts.Hosts.capped()
+	}
+
+	if !capped && (limit <= 0 || limit >= len(downloads)) {
+		for _, d := range downloads {
+			err := d.Start(ctx, wg)
+			if err != nil {
+				return fmt.Errorf("failed to start download for %s: %w", RedactURL(d.URL), err)
+			}
 		}
+		return nil
+	}
+
+	if limit <= 0 {
+		limit = len(downloads)
 	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		schedule(ctx, slices.Clone(downloads), limit, wg)
+	}()
+
 	return nil
 }
+
+// schedule starts the queued downloads in order as slots become free: at most limit
+// at once and at most the cap of Options.Hosts per host. Downloads whose host is
+// backing off or spacing out its requests are passed over until it is ready.
+func schedule(ctx context.Context, queued []*FileDownload, limit int, wg *sync.WaitGroup) {
+	// Buffered for every download, so releasing a slot never blocks.
+	done := make(chan struct{}, len(queued))
+	running := 0
+
+	for len(queued) > 0 {
+		if ctx.Err() != nil {
+			// Queued downloads still run so they fail with the
+			// cancellation error and close their channels.
+			for _, d := range queued {
+				_ = d.start(ctx, wg, nil)
+			}
+			return
+		}
+
+		next := -1
+		var wake time.Time
+		if running < limit {
+			now := time.Now()
+			for i, d := range queued {
+				source := d.Mirror()
+				if at := d.opts.Hosts.readyAt(source); at.After(now) {
+					if wake.IsZero() || at.Before(wake) {
+						wake = at
+					}
+					continue
+				}
+				if d.opts.Hosts.tryAcquire(source) {
+					d.takeSlot(source)
+					next = i
+					break
+				}
+			}
+		}
+
+		if next >= 0 {
+			d := queued[next]
+			queued = slices.Delete(queued, next, next+1)
+			running++
+			_ = d.start(ctx, wg, func() {
+				d.releaseSlot()
+				done <- struct{}{}
+			})
+			continue
+		}
+
+		// Downloads of a batch share their options, so a slot freed by a download
+		// moving to a mirror on another host is seen on the limiter of any of them.
+		released := queued[0].opts.Hosts.released()
+
+		var ready <-chan time.Time
+		var timer *time.Timer
+		if !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			ready = timer.C
+		}
+		select {
+		case <-done:
+			running--
+		case <-ready:
+		case <-released:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startBatch prepares and starts the entries through StartAll, waits for them and fails on any error.
+func startBatch(t *testing.T, entries []Entry, opts Options, limit int) []*FileDownload {
+	t.Helper()
+
+	downloads, err := PrepareDownloads(entries, t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	var wg sync.WaitGroup
+	StartProgressListener(downloads, &wg)
+	if err := StartAll(context.Background(), downloads, limit, &wg); err != nil {
+		t.Fatalf("StartAll() error = %v", err)
+	}
+	wg.Wait()
+	for _, d := range downloads {
+		if d.Err() != nil {
+			t.Fatalf("download of %s failed: %v", d.URL, d.Err())
+		}
+	}
+	return downloads
+}
+
+func TestStartAllConcurrency(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts *HostLimiter
+	}{
+		{name: "without host limiter"},
+		{name: "with uncapped host limiter", hosts: NewHostLimiter(0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, peak, requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				n := running.Add(1)
+				defer running.Add(-1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+
+				time.Sleep(30 * time.Millisecond)
+				_, _ = w.Write([]byte(r.URL.Path))
+			}))
+			defer server.Close()
+
+			const limit = 3
+			var entries []Entry
+			for i := range 10 {
+				entries = append(entries, Entry{URL: fmt.Sprintf("%s/%d.bin", server.URL, i)})
+			}
+			downloads := startBatch(t, entries, Options{Hosts: tt.hosts}, limit)
+
+			if got := peak.Load(); got > limit {
+				t.Errorf("%d downloads ran at once, want at most %d", got, limit)
+			} else if got < limit {
+				t.Errorf("at most %d downloads ran at once, want the queue to fill all %d slots", got, limit)
+			}
+			if got := requests.Load(); got != int32(len(entries)) {
+				t.Errorf("server received %d requests, want %d", got, len(entries))
+			}
+			for _, d := range downloads {
+				if d.State() != StateDone {
+					t.Errorf("download of %s ended in state %v, want done", d.URL, d.State())
+				}
+				if _, err := os.Stat(d.FilePath); err != nil {
+					t.Errorf("downloaded file missing: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStartAllRefillsFinishedSlots(t *testing.T) {
+	// The first download holds its slot until every other one has been
+	// requested, so the batch only finishes if each freed slot is handed
+	// to the next queued download while the slow one is still running.
+	const fast = 5
+	release := make(chan struct{})
+	var fastRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.bin" {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		} else if fastRequests.Add(1) == fast {
+			close(release)
+		}
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	entries := []Entry{{URL: server.URL + "/slow.bin"}}
+	for i := range fast {
+		entries = append(entries, Entry{URL: fmt.Sprintf("%s/%d.bin", server.URL, i)})
+	}
+
+	start := time.Now()
+	startBatch(t, entries, Options{}, 2)
+
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("batch took %v, want queued downloads to start as soon as a slot frees up", elapsed)
+	}
+	if got := fastRequests.Load(); got != fast {
+		t.Errorf("server received %d requests for queued downloads, want %d", got, fast)
+	}
+}
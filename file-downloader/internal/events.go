@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened to a download.
+type EventType string
+
+const (
+	// EventQueued is sent for every download waiting to start when monitoring begins.
+	EventQueued EventType = "queued"
+	// EventStarted is sent when a download leaves the queue.
+	EventStarted EventType = "started"
+	// EventProgress is sent periodically for every active download.
+	EventProgress EventType = "progress"
+	// EventRetry is sent when an attempt failed and the download waits to retry.
+	EventRetry EventType = "retry"
+	// EventMirror is sent when a mirror failed and the download continues from the next one.
+	EventMirror EventType = "mirror"
+	// EventCompleted is sent when a download finished successfully.
+	EventCompleted EventType = "completed"
+	// EventFailed is sent when a download stopped with an error.
+	EventFailed EventType = "failed"
+	// EventSkipped is sent when a download did not run because its file exists.
+	EventSkipped EventType = "skipped"
+	// EventUpToDate is sent when the source confirmed that the file of a previous run did not change.
+	EventUpToDate EventType = "up_to_date"
+	// EventExtracting is sent when a download starts unpacking its archive, which is
+	// after it completed or, for archives unpacked while downloading, when data arrives.
+	EventExtracting EventType = "extracting"
+	// EventPaused is sent by the daemon when a job was paused; resuming it queues it again.
+	EventPaused EventType = "paused"
+	// EventCancelled is sent by the daemon when a job was cancelled.
+	EventCancelled EventType = "cancelled"
+)
+
+// Final reports whether no further events follow for the download.
+func (t EventType) Final() bool {
+	return t == EventCompleted || t == EventFailed || t == EventSkipped || t == EventUpToDate || t == EventCancelled
+}
+
+// Event describes a change in a download's progress or lifecycle.
+type Event struct {
+	Type  EventType `json:"type"`
+	Time  time.Time `json:"time"`
+	Index int       `json:"index"`
+	URL   string    `json:"url"`
+	Path  string    `json:"path,omitempty"`
+	// Mirror is the URL the file is downloaded from, set for downloads with mirrors.
+	Mirror string `json:"mirror,omitempty"`
+	// Bytes is the number of bytes on disk, including bytes resumed from a previous run.
+	Bytes int64 `json:"bytes"`
+	// Total is the size of the file once the server responded, or -1 if it did not send one.
+	Total int64 `json:"total"`
+	// Speed is the current speed in bytes per second, or the average speed for completed downloads.
+	Speed float64 `json:"speed"`
+	// Elapsed is the time in seconds since the download started.
+	Elapsed     float64   `json:"elapsed"`
+	Attempt     int       `json:"attempt,omitempty"`
+	MaxAttempts int       `json:"max_attempts,omitempty"`
+	RetryAt     time.Time `json:"retry_at,omitzero"`
+	Error       string    `json:"error,omitempty"`
+	// ExtractDir is the directory the archive is unpacked into, set once extraction started.
+	ExtractDir string `json:"extract_dir,omitempty"`
+	// Extracted is the number of bytes of the archive unpacked so far.
+	Extracted int64 `json:"extracted,omitempty"`
+	// Stalled is set on the progress of an active download that received no data for
+	// StalledAfter, or half the stall timeout if that is shorter.
+	Stalled bool `json:"stalled,omitempty"`
+	// Digest is the digest of a completed file in "algorithm=hex" form, set when it is
+	// verified against a checksum or recorded by the cache or journal.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Renderer presents download events, for example as progress bars or log lines.
+type Renderer interface {
+	// Render consumes events until the channel is closed.
+	Render(events <-chan Event)
+}
+
+// ProgressInfo tracks the speed of a download from its LoadedBytes channel.
+type ProgressInfo struct {
+	mu           sync.RWMutex
+	downloaded   int64
+	lastUpdate   time.Time
+	lastBytes    int64
+	currentSpeed float64
+}
+
+// monitor merges the lifecycle events sent by downloads with periodic progress
+// events and fans them out to the renderers.
+type monitor struct {
+	downloads []*FileDownload
+	infos     []*ProgressInfo
+	lifecycle chan Event
+	outputs   []chan Event
+}
+
+// StartProgressListener monitors downloads and passes their events to the renderers.
+// One listener goroutine per download consumes its LoadedBytes channel to track speed,
+// a dispatcher goroutine sends lifecycle events as they happen and progress events every
+// ProgressUpdateInterval, and each renderer runs in its own goroutine.
+// It must be called before the downloads are started, even without renderers, and every
+// download must then be started so the listeners finish.
+func StartProgressListener(downloads []*FileDownload, wg *sync.WaitGroup, renderers ...Renderer) {
+	m := &monitor{
+		downloads: downloads,
+		infos:     make([]*ProgressInfo, len(downloads)),
+		lifecycle: make(chan Event),
+	}
+
+	for i, download := range downloads {
+		m.infos[i] = &ProgressInfo{}
+		download.events = m.lifecycle
+	}
+
+	for _, renderer := range renderers {
+		output := make(chan Event, len(downloads)+1)
+		m.outputs = append(m.outputs, output)
+
+		wg.Add(1)
+		go func(r Renderer) {
+			defer wg.Done()
+			r.Render(output)
+		}(renderer)
+	}
+
+	// The outputs have room for one event per download, so this does not block.
+	for _, download := range downloads {
+		if download.State() == StateQueued {
+			m.publish(download.event(EventQueued, nil))
+		}
+	}
+
+	for i, download := range downloads {
+		wg.Add(1)
+		go listenToProgress(download, m.infos[i], wg)
+	}
+
+	wg.Add(1)
+	go m.dispatch(wg)
+}
+
+func listenToProgress(download *FileDownload, info *ProgressInfo, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for bytes := range download.LoadedBytes {
+		info.mu.Lock()
+		if info.lastUpdate.IsZero() {
+			// Downloads may wait in the queue, so timing starts when the download does.
+			info.lastUpdate = download.StartedAt()
+		}
+		info.downloaded += bytes
+		updateSpeed(info)
+		info.mu.Unlock()
+	}
+}
+
+// updateSpeed updates the current download speed. Must be called with info.mu locked.
+func updateSpeed(info *ProgressInfo) {
+	now := time.Now()
+	timeDiff := now.Sub(info.lastUpdate).Seconds()
+
+	if timeDiff >= SpeedUpdateThreshold {
+		bytesDiff := info.downloaded - info.lastBytes
+		info.currentSpeed = float64(bytesDiff) / timeDiff
+		info.lastUpdate = now
+		info.lastBytes = info.downloaded
+	}
+}
+
+func (m *monitor) dispatch(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		for _, output := range m.outputs {
+			close(output)
+		}
+	}()
+
+	remaining := len(m.downloads)
+	ticker := time.NewTicker(ProgressUpdateInterval)
+	defer ticker.Stop()
+
+	for remaining > 0 {
+		select {
+		case event := <-m.lifecycle:
+			m.publish(event)
+			if event.Type.Final() {
+				remaining--
+			}
+		case <-ticker.C:
+			for i, download := range m.downloads {
+				if state := download.State(); state != StateActive && state != StateExtracting {
+					continue
+				}
+				event := download.event(EventProgress, nil)
+				if event.RetryAt.IsZero() {
+					m.infos[i].mu.RLock()
+					event.Speed = m.infos[i].currentSpeed
+					m.infos[i].mu.RUnlock()
+				}
+				m.publish(event)
+			}
+		}
+	}
+}
+
+func (m *monitor) publish(event Event) {
+	for _, output := range m.outputs {
+		output <- event
+	}
+}
+
+// event builds an event describing the download's current state.
+func (f *FileDownload) event(t EventType, err error) Event {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	event := Event{
+		Type:        t,
+		Time:        time.Now(),
+		Index:       f.index + 1,
+		URL:         RedactURL(f.URL),
+		Path:        f.FilePath,
+		Bytes:       f.downloaded,
+		Total:       f.totalBytes,
+		Attempt:     f.attempt,
+		MaxAttempts: f.opts.Retry.attempts(),
+	}
+
+	if !f.startedAt.IsZero() {
+		elapsed := event.Time.Sub(f.startedAt)
+		event.Elapsed = elapsed.Seconds()
+		if t == EventCompleted && elapsed > 0 {
+			event.Speed = float64(f.received) / elapsed.Seconds()
+		}
+	}
+	if len(f.sources) > 1 {
+		event.Mirror = RedactURL(f.mirror())
+	}
+	if f.retryAt.After(event.Time) {
+		event.RetryAt = f.retryAt
+	} else if f.state == StateActive && f.stallPauses == 0 && !f.activeAt.IsZero() {
+		event.Stalled = event.Time.Sub(f.activeAt) >= f.stalledAfter()
+	}
+	if f.extractDir != "" {
+		event.ExtractDir = f.extractDir
+		event.Extracted = f.extractedBytes
+	}
+	if t == EventCompleted || t == EventUpToDate {
+		event.Digest = f.digest
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	return event
+}
+
+// emit sends a lifecycle event to the monitor, if there is one.
+func (f *FileDownload) emit(t EventType, err error) {
+	if f.events != nil {
+		f.events <- f.event(t, err)
+	}
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	var failures int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky.bin":
+			if failures == 0 {
+				failures++
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/missing.bin":
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	urls := []string{server.URL + "/ok.bin", server.URL + "/flaky.bin", server.URL + "/missing.bin"}
+	opts := Options{Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}}
+	downloads, err := PrepareDownloads(EntriesFromURLs(urls), t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	StartProgressListener(downloads, &wg, NewJSONRenderer(&out))
+	err = StartAll(context.Background(), downloads, 1, &wg)
+	if err != nil {
+		t.Fatalf("StartAll() error = %v", err)
+	}
+	wg.Wait()
+
+	types := make(map[int][]EventType)
+	var completed Event
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid JSON event %q: %v", scanner.Text(), err)
+		}
+		if event.Type == EventProgress {
+			continue
+		}
+		types[event.Index] = append(types[event.Index], event.Type)
+		if event.Index == 1 && event.Type == EventCompleted {
+			completed = event
+		}
+	}
+
+	want := map[int][]EventType{
+		1: {EventQueued, EventStarted, EventCompleted},
+		2: {EventQueued, EventStarted, EventRetry, EventCompleted},
+		3: {EventQueued, EventStarted, EventFailed},
+	}
+	for index, wantTypes := range want {
+		if !slices.Equal(types[index], wantTypes) {
+			t.Errorf("events for download %d = %v, want %v", index, types[index], wantTypes)
+		}
+	}
+	if completed.Bytes != int64(len(content)) || completed.Total != int64(len(content)) {
+		t.Errorf("completed event bytes = %d/%d, want %d/%d", completed.Bytes, completed.Total, len(content), len(content))
+	}
+}
+
+func TestPlainRendererFormat(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{
+			name:  "started",
+			event: Event{Type: EventStarted, Time: start, URL: "https://example.com/a.bin"},
+			want:  "Started https://example.com/a.bin",
+		},
+		{
+			name:  "progress too soon",
+			event: Event{Type: EventProgress, Time: start.Add(time.Second), Bytes: 512 * 1024, Total: 1024 * 1024},
+			want:  "",
+		},
+		{
+			name:  "progress",
+			event: Event{Type: EventProgress, Time: start.Add(PlainProgressInterval), Bytes: 512 * 1024, Total: 1024 * 1024, Speed: 2048},
+			want:  "0.50/1.00 MB (50.0%) at 2.00 KB/s",
+		},
+		{
+			name:  "stalled",
+			event: Event{Type: EventProgress, Time: start.Add(PlainProgressInterval + time.Second), Bytes: 512 * 1024, Total: 1024 * 1024, Stalled: true},
+			want:  "Stalled at 0.50/1.00 MB (50.0%), no data received",
+		},
+		{
+			name:  "still stalled",
+			event: Event{Type: EventProgress, Time: start.Add(PlainProgressInterval + 2*time.Second), Bytes: 512 * 1024, Total: 1024 * 1024, Stalled: true},
+			want:  "",
+		},
+		{
+			name: "retry",
+			event: Event{Type: EventRetry, Time: start, Attempt: 1, MaxAttempts: 3,
+				RetryAt: start.Add(2 * time.Second), Error: "bad status: 503 Service Unavailable"},
+			want: "Attempt 1/3 failed: bad status: 503 Service Unavailable; retrying in 2s",
+		},
+		{
+			name:  "failed",
+			event: Event{Type: EventFailed, Time: start, Error: "bad status: 404 Not Found"},
+			want:  "Failed: bad status: 404 Not Found",
+		},
+	}
+
+	r := NewPlainRenderer(&strings.Builder{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.format(tt.event); got != tt.want {
+				t.Errorf("format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
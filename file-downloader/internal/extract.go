@@ -0,0 +1,463 @@
+package internal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractOptions controls how downloaded archives are unpacked.
+type ExtractOptions struct {
+	// Dir is the directory archives are unpacked into. When empty, an archive is
+	// unpacked into a directory named after it next to the archive, and a gzip
+	// compressed file next to the archive.
+	Dir string
+
+	// DeleteArchive removes the archive once it was unpacked. Tar and gzip archives
+	// without an expected checksum are then unpacked while they download, without
+	// writing the archive to disk.
+	DeleteArchive bool
+}
+
+// errExtractionStopped stops a download that is unpacked while it downloads when the
+// extraction failed.
+var errExtractionStopped = errors.New("extraction stopped")
+
+// archiveKind is the format of an archive, detected from its file name.
+type archiveKind string
+
+const (
+	archiveNone  archiveKind = ""
+	archiveTar   archiveKind = "tar"
+	archiveTarGz archiveKind = "tar.gz"
+	archiveGzip  archiveKind = "gz"
+	archiveZip   archiveKind = "zip"
+)
+
+// detectArchive returns the archive format of a file name and the name without the
+// archive extension.
+func detectArchive(name string) (archiveKind, string) {
+	lower := strings.ToLower(name)
+	for _, candidate := range []struct {
+		ext  string
+		kind archiveKind
+	}{
+		{".tar.gz", archiveTarGz},
+		{".tgz", archiveTarGz},
+		{".tar", archiveTar},
+		{".zip", archiveZip},
+		{".gz", archiveGzip},
+	} {
+		if strings.HasSuffix(lower, candidate.ext) && len(name) > len(candidate.ext) {
+			return candidate.kind, name[:len(name)-len(candidate.ext)]
+		}
+	}
+	return archiveNone, name
+}
+
+// streamable reports whether the archive can be unpacked from a single pass over its data.
+func (k archiveKind) streamable() bool {
+	return k == archiveTar || k == archiveTarGz || k == archiveGzip
+}
+
+// extractTarget returns the directory the archive at path is unpacked into.
+func (f *FileDownload) extractTarget(path string) string {
+	kind, base := detectArchive(filepath.Base(path))
+	if f.opts.Extract.Dir != "" {
+		return f.opts.Extract.Dir
+	}
+	if kind == archiveGzip {
+		return filepath.Dir(path)
+	}
+	return filepath.Join(filepath.Dir(path), base)
+}
+
+// unpackedName returns the file name a gzip compressed file is unpacked to in dir,
+// following the conflict policy of the download. base is the name of the archive
+// without its extension.
+func (f *FileDownload) unpackedName(dir, base string) (string, error) {
+	if f.claims == nil {
+		f.claims = newPathClaims()
+	}
+	path, err := f.claims.claimUnpacked(f, filepath.Join(dir, base), f.opts.OnConflict)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(path), nil
+}
+
+// streamExtraction reports whether the download is unpacked while it downloads instead of
+// after it completed. This needs an archive that is not kept, a format that can be read
+// in one pass, and no checksum or piece hashes, which could only be verified after unpacking.
+func (f *FileDownload) streamExtraction(path string) bool {
+	extract := f.opts.Extract
+	if extract == nil || !extract.DeleteArchive || f.Checksum != nil || f.pieces != nil || f.cached != nil {
+		return false
+	}
+	kind, _ := detectArchive(filepath.Base(path))
+	return kind.streamable()
+}
+
+// ExtractDir returns the directory the download's archive is unpacked into, or an empty
+// string when it is not unpacked.
+func (f *FileDownload) ExtractDir() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.extractDir
+}
+
+// beginExtraction records that the archive is being unpacked into dir.
+func (f *FileDownload) beginExtraction(dir string) {
+	f.mu.Lock()
+	f.extractDir = dir
+	f.extractedBytes = 0
+	f.mu.Unlock()
+}
+
+// addExtracted records n more bytes of the archive as unpacked.
+func (f *FileDownload) addExtracted(n int64) {
+	f.mu.Lock()
+	f.extractedBytes += n
+	f.mu.Unlock()
+}
+
+// extract unpacks the completed archive at FilePath, and removes it afterwards when
+// configured. Files that are not archives are left alone.
+func (f *FileDownload) extract(ctx context.Context) error {
+	path := f.Path()
+	kind, base := detectArchive(filepath.Base(path))
+	if kind == archiveNone {
+		return nil
+	}
+
+	dir := f.extractTarget(path)
+	if kind == archiveGzip {
+		var err error
+		base, err = f.unpackedName(dir, base)
+		if errors.Is(err, errSkipped) {
+			// The file it would unpack to is kept, and so is the archive.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", filepath.Base(path), err)
+		}
+	}
+	f.beginExtraction(dir)
+	f.setState(StateExtracting)
+	f.emit(EventExtracting, nil)
+
+	var err error
+	if kind == archiveZip {
+		err = f.extractZip(ctx, path, dir)
+	} else {
+		var file *os.File
+		file, err = os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		err = f.unpack(ctx, kind, file, dir, base)
+		safeClose(file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", filepath.Base(path), err)
+	}
+
+	if f.opts.Extract.DeleteArchive {
+		safeRemove(path)
+	}
+	return nil
+}
+
+// extractStream unpacks a tar or gzip archive while its data arrives, without
+// writing the archive to disk. A failed attempt unpacks from the start again.
+func (f *FileDownload) extractStream(ctx context.Context, result *FetchResult) error {
+	path := f.Path()
+	kind, base := detectArchive(filepath.Base(path))
+	dir := f.extractTarget(path)
+	if kind == archiveGzip {
+		var err error
+		base, err = f.unpackedName(dir, base)
+		if errors.Is(err, errSkipped) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	f.setTotalBytes(result.Size)
+	f.setDownloaded(0)
+	f.beginExtraction(dir)
+	f.emit(EventExtracting, nil)
+
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := f.unpack(ctx, kind, reader, dir, base)
+		if err == nil {
+			// Consume the rest of the response, such as the padding after a tar archive.
+			_, err = io.Copy(io.Discard, reader)
+		} else {
+			reader.CloseWithError(errExtractionStopped)
+		}
+		done <- err
+	}()
+
+	err := f.copyBody(ctx, writer, result.Body)
+	writer.CloseWithError(err)
+	extractErr := <-done
+
+	// A download error also fails the extraction, which is then not the cause.
+	if errors.Is(err, errExtractionStopped) || (err == nil && extractErr != nil) {
+		return fmt.Errorf("failed to extract %s: %w", filepath.Base(path), extractErr)
+	}
+	if err != nil {
+		return err
+	}
+	if total := f.TotalBytes(); total >= 0 && f.Downloaded() != total {
+		return fmt.Errorf("incomplete download: got %d bytes, expected %d: %w", f.Downloaded(), total, io.ErrUnexpectedEOF)
+	}
+
+	f.extracted = true
+	return nil
+}
+
+// unpack reads a tar, tar.gz or gzip archive from r into dir. base is the archive's
+// file name without extension, which names the file of a gzip archive.
+func (f *FileDownload) unpack(ctx context.Context, kind archiveKind, r io.Reader, dir, base string) error {
+	r = &extractReader{ctx: ctx, r: r, f: f}
+
+	if kind == archiveTarGz || kind == archiveGzip {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer safeClose(gz)
+		r = gz
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if kind == archiveGzip {
+		return writeExtracted(filepath.Join(dir, base), r, 0o644)
+	}
+	return extractTar(tar.NewReader(r), dir)
+}
+
+// extractTar unpacks the files, directories and links of a tar archive into dir.
+// Other entries, such as devices, are skipped.
+func extractTar(tr *tar.Reader, dir string) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := extractPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0o755)
+		case tar.TypeReg:
+			err = writeExtracted(target, tr, header.FileInfo().Mode())
+		case tar.TypeSymlink:
+			err = extractSymlink(dir, header.Name, header.Linkname)
+		case tar.TypeLink:
+			var source string
+			source, err = extractPath(dir, header.Linkname)
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(target), 0o755)
+			}
+			if err == nil {
+				safeRemove(target)
+				err = os.Link(source, target)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			_ = os.Chtimes(target, header.ModTime, header.ModTime)
+		}
+	}
+}
+
+// extractZip unpacks a zip archive into dir.
+func (f *FileDownload) extractZip(ctx context.Context, path, dir string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer safeClose(archive)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	for _, file := range archive.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target, err := extractPath(dir, file.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, 0o755)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipSymlink(dir, file)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			rc, err = file.Open()
+			if err == nil {
+				err = writeExtracted(target, rc, mode)
+				safeClose(rc)
+			}
+			if err == nil {
+				_ = os.Chtimes(target, file.Modified, file.Modified)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		f.addExtracted(int64(file.CompressedSize64))
+	}
+	return nil
+}
+
+func extractZipSymlink(dir string, file *zip.File) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer safeClose(rc)
+
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return err
+	}
+	return extractSymlink(dir, file.Name, string(target))
+}
+
+// extractPath returns the path of an archive entry inside dir. Entries with absolute
+// paths or ".." elements that would escape dir ("zip slip") are rejected, and so are
+// entries whose path leads outside dir through symbolic links extracted before them.
+func extractPath(dir, name string) (string, error) {
+	name = strings.TrimPrefix(filepath.FromSlash(name), "."+string(filepath.Separator))
+	if name == "" || name == "." {
+		return dir, nil
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("archive entry %q points outside the target directory", name)
+	}
+
+	target := filepath.Join(dir, name)
+	if !resolvesInside(dir, target) {
+		return "", fmt.Errorf("archive entry %q points outside the target directory", name)
+	}
+	return target, nil
+}
+
+// resolvesInside reports whether path, after resolving the symbolic links of its
+// existing part, is dir or inside it. The part of path that does not exist yet is
+// created as plain directories and files, so it cannot lead anywhere else.
+func resolvesInside(dir, path string) bool {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+
+	existing, rest := path, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			path = filepath.Join(resolved, rest)
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) || existing == dir {
+			return false
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	rel, err := filepath.Rel(root, path)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// extractSymlink creates a symbolic link from an archive. The link must point to a
+// path inside dir, so later entries cannot be written through it to other places.
+func extractSymlink(dir, name, linkname string) error {
+	target, err := extractPath(dir, name)
+	if err != nil {
+		return err
+	}
+	resolved := filepath.Join(filepath.Dir(filepath.FromSlash(name)), filepath.FromSlash(linkname))
+	if filepath.IsAbs(linkname) || !filepath.IsLocal(resolved) ||
+		!resolvesInside(dir, filepath.Join(filepath.Dir(target), filepath.FromSlash(linkname))) {
+		return fmt.Errorf("archive link %q points outside the target directory", name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	safeRemove(target)
+	return os.Symlink(linkname, target)
+}
+
+// writeExtracted writes a file from an archive, replacing an existing file. Only the
+// permission bits of mode are kept.
+func writeExtracted(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Remove first so an existing symlink at path is replaced instead of followed.
+	safeRemove(path)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_EXCL, mode.Perm()|0o200)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// extractReader counts the archive bytes read for progress and stops on cancellation.
+type extractReader struct {
+	ctx context.Context
+	r   io.Reader
+	f   *FileDownload
+}
+
+func (r *extractReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.f.addExtracted(int64(n))
+	return n, err
+}
@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// archiveFile is an entry of a test archive. A link is a symlink to its content, a
+// hard link a hard link to it.
+type archiveFile struct {
+	name     string
+	content  string
+	link     bool
+	hardLink bool
+}
+
+func makeTar(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}
+		if file.link {
+			header = &tar.Header{Name: file.name, Linkname: file.content, Typeflag: tar.TypeSymlink}
+		} else if file.hardLink {
+			header = &tar.Header{Name: file.name, Linkname: file.content, Typeflag: tar.TypeLink}
+		} else if strings.HasSuffix(file.name, "/") {
+			header = &tar.Header{Name: file.name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(file.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeGzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func serveArchive(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestExtract(t *testing.T) {
+	files := []archiveFile{
+		{name: "data/"},
+		{name: "data/a.txt", content: "alpha"},
+		{name: "data/nested/b.txt", content: "beta"},
+	}
+	tarData := makeTar(t, files)
+
+	tests := []struct {
+		name   string
+		file   string
+		data   []byte
+		delete bool
+		want   map[string]string
+	}{
+		{name: "tar.gz", file: "files.tar.gz", data: makeGzip(t, tarData), want: map[string]string{"files/data/a.txt": "alpha", "files/data/nested/b.txt": "beta"}},
+		{name: "tar.gz streamed", file: "files.tgz", data: makeGzip(t, tarData), delete: true, want: map[string]string{"files/data/a.txt": "alpha", "files/data/nested/b.txt": "beta"}},
+		{name: "tar", file: "files.tar", data: tarData, want: map[string]string{"files/data/a.txt": "alpha"}},
+		{name: "zip", file: "files.zip", data: makeZip(t, files[1:]), delete: true, want: map[string]string{"files/data/a.txt": "alpha", "files/data/nested/b.txt": "beta"}},
+		{name: "gzip", file: "report.csv.gz", data: makeGzip(t, []byte("a,b\n")), want: map[string]string{"report.csv": "a,b\n"}},
+		{name: "not an archive", file: "plain.txt", data: []byte("plain"), want: map[string]string{"plain.txt": "plain"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := serveArchive(t, tt.data)
+			dir := t.TempDir()
+
+			opts := Options{Extract: &ExtractOptions{DeleteArchive: tt.delete}}
+			d := runDownloadIn(t, dir, Entry{URL: server.URL + "/" + tt.file}, opts)
+			if err := d.Err(); err != nil {
+				t.Fatalf("download error = %v", err)
+			}
+
+			for name, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Errorf("extracted file %s: %v", name, err)
+				} else if string(got) != want {
+					t.Errorf("extracted file %s = %q, want %q", name, got, want)
+				}
+			}
+
+			_, err := os.Stat(filepath.Join(dir, tt.file))
+			if kept := err == nil; kept == tt.delete && tt.name != "not an archive" {
+				t.Errorf("archive kept = %v, want %v", kept, !tt.delete)
+			}
+			if parts, _ := filepath.Glob(filepath.Join(dir, "*"+PartSuffix+"*")); len(parts) > 0 {
+				t.Errorf("partial files left behind: %v", parts)
+			}
+		})
+	}
+}
+
+func TestExtractGzipConflicts(t *testing.T) {
+	server := serveArchive(t, makeGzip(t, []byte("a,b\n")))
+
+	tests := []struct {
+		name      string
+		policy    ConflictPolicy
+		delete    bool
+		want      map[string]string
+		wantState State
+		wantErr   string
+	}{
+		{name: "overwrite", policy: ConflictOverwrite, want: map[string]string{"report.csv": "a,b\n"}, wantState: StateDone},
+		{name: "skip", policy: ConflictSkip, want: map[string]string{"report.csv": "old", "report.csv.gz": ""}, wantState: StateDone},
+		{name: "skip streamed", policy: ConflictSkip, delete: true, want: map[string]string{"report.csv": "old"}, wantState: StateSkipped},
+		{name: "rename", policy: ConflictRename, want: map[string]string{"report.csv": "old", "report-1.csv": "a,b\n"}, wantState: StateDone},
+		{name: "fail", policy: ConflictFail, want: map[string]string{"report.csv": "old"}, wantState: StateFailed, wantErr: "already exists"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "report.csv"), []byte("old"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := Options{OnConflict: tt.policy, Extract: &ExtractOptions{DeleteArchive: tt.delete}}
+			d := runDownloadIn(t, dir, Entry{URL: server.URL + "/report.csv.gz"}, opts)
+			if err := d.Err(); (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("download error = %v, want %q", err, tt.wantErr)
+			}
+			if d.State() != tt.wantState {
+				t.Errorf("download state = %v, want %v", d.State(), tt.wantState)
+			}
+			for name, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("file %s: %v", name, err)
+				} else if want != "" && string(got) != want {
+					t.Errorf("file %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("file of the same batch", func(t *testing.T) {
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("plain"))
+		}))
+		defer plain.Close()
+
+		dir := t.TempDir()
+		entries := []Entry{{URL: plain.URL + "/report.csv"}, {URL: server.URL + "/report.csv.gz"}}
+		downloads, err := PrepareDownloads(entries, dir, Options{Extract: &ExtractOptions{}})
+		if err != nil {
+			t.Fatalf("PrepareDownloads() error = %v", err)
+		}
+		var wg sync.WaitGroup
+		StartProgressListener(downloads, &wg)
+		if err := StartAll(context.Background(), downloads, 0, &wg); err != nil {
+			t.Fatalf("StartAll() error = %v", err)
+		}
+		wg.Wait()
+
+		if err := downloads[1].Err(); err == nil || !strings.Contains(err.Error(), "cannot unpack") {
+			t.Errorf("archive download error = %v, want the unpacked file refused", err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "report.csv")); err != nil || string(got) != "plain" {
+			t.Errorf("report.csv = %q, %v, want the other download kept", got, err)
+		}
+	})
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{name: "tar parent path", file: "evil.tar", data: makeTar(t, []archiveFile{{name: "../evil.txt", content: "x"}})},
+		{name: "tar absolute link", file: "evil.tar", data: makeTar(t, []archiveFile{{name: "link", content: "/tmp", link: true}})},
+		{name: "tar escaping link", file: "evil.tar", data: makeTar(t, []archiveFile{{name: "a/link", content: "../../..", link: true}})},
+		{name: "zip parent path", file: "evil.zip", data: makeZip(t, []archiveFile{{name: "../../evil.txt", content: "x"}})},
+		{name: "tar path through links", file: "evil.tar", data: makeTar(t, []archiveFile{
+			{name: "a", content: ".", link: true},
+			{name: "a/b/"},
+			{name: "a/b/x", content: "../..", link: true},
+			{name: "a/b/x/evil.txt", content: "x"},
+		})},
+		{name: "tar write through later link", file: "evil.tar", data: makeTar(t, []archiveFile{
+			{name: "x", content: "d/..", link: true},
+			{name: "d", content: ".", link: true},
+			{name: "x/evil.txt", content: "x"},
+		})},
+		{name: "tar hard link through links", file: "evil.tar", data: makeTar(t, []archiveFile{
+			{name: "x", content: "d/..", link: true},
+			{name: "d", content: ".", link: true},
+			{name: "stolen", content: "x/secret.txt", hardLink: true},
+		})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := serveArchive(t, tt.data)
+			dir := t.TempDir()
+
+			d := runDownloadIn(t, filepath.Join(dir, "downloads"), Entry{URL: server.URL + "/" + tt.file},
+				Options{Extract: &ExtractOptions{}})
+			if err := d.Err(); err == nil || !strings.Contains(err.Error(), "outside the target directory") {
+				t.Fatalf("download error = %v, want a rejected entry", err)
+			}
+			for _, outside := range []string{filepath.Join(dir, "evil.txt"), filepath.Join(dir, "downloads", "evil.txt")} {
+				if _, err := os.Stat(outside); err == nil {
+					t.Errorf("archive entry was written outside the target directory to %s", outside)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectArchive(t *testing.T) {
+	tests := []struct {
+		name     string
+		wantKind archiveKind
+		wantBase string
+	}{
+		{"data.tar.gz", archiveTarGz, "data"},
+		{"data.TGZ", archiveTarGz, "data"},
+		{"data.tar", archiveTar, "data"},
+		{"data.zip", archiveZip, "data"},
+		{"data.csv.gz", archiveGzip, "data.csv"},
+		{"data.csv", archiveNone, "data.csv"},
+		{".gz", archiveNone, ".gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, base := detectArchive(tt.name)
+			if kind != tt.wantKind || base != tt.wantBase {
+				t.Errorf("detectArchive() = %q, %q, want %q, %q", kind, base, tt.wantKind, tt.wantBase)
+			}
+		})
+	}
+}
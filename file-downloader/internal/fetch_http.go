@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPTimeouts limits the phases of an HTTP request before the response body is read,
+// which is watched by the stall timeout instead. A zero value disables a timeout.
+type HTTPTimeouts struct {
+	// Connect limits establishing the TCP connection, including the DNS lookup.
+	Connect time.Duration
+	// TLSHandshake limits the TLS handshake of HTTPS connections.
+	TLSHandshake time.Duration
+	// ResponseHeader limits the wait for the response headers after the request was sent.
+	ResponseHeader time.Duration
+}
+
+// DefaultHTTPTimeouts returns the timeouts of the client used by an HTTPFetcher without one.
+func DefaultHTTPTimeouts() HTTPTimeouts {
+	return HTTPTimeouts{
+		Connect:        30 * time.Second,
+		TLSHandshake:   10 * time.Second,
+		ResponseHeader: 60 * time.Second,
+	}
+}
+
+// NewHTTPClient returns a client with the timeouts and the proxy settings of the environment.
+// The client has no overall timeout, as a large download may take hours.
+func NewHTTPClient(timeouts HTTPTimeouts) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = timeouts.TLSHandshake
+	transport.ResponseHeaderTimeout = timeouts.ResponseHeader
+	return &http.Client{Transport: transport}
+}
+
+// defaultHTTPClient is used by an HTTPFetcher without a client.
+var defaultHTTPClient = NewHTTPClient(DefaultHTTPTimeouts())
+
+// HTTPFetcher reads files over HTTP and HTTPS, continuing at an offset with Range
+// requests guarded by If-Range.
+type HTTPFetcher struct {
+	// Client sends the requests. If nil, a client with DefaultHTTPTimeouts is used.
+	Client *http.Client
+}
+
+// ValidateURL requires a host.
+func (h *HTTPFetcher) ValidateURL(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL: missing host")
+	}
+	return nil
+}
+
+// Fetch sends a GET request. A server that ignores the range, or answers it with
+// 416 Range Not Satisfiable, results in the whole file.
+func (h *HTTPFetcher) Fetch(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	header := http.Header{}
+	if req.Offset > 0 || req.Length > 0 {
+		if req.Length > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-%d", req.Offset, req.Offset+req.Length-1))
+		} else {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", req.Offset))
+		}
+		if req.Validator != "" {
+			header.Set("If-Range", req.Validator)
+		}
+	} else {
+		setConditions(header, req)
+	}
+
+	resp, err := h.do(ctx, http.MethodGet, req, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && req.Offset > 0 {
+		// The partial data no longer matches the remote file; start over.
+		safeClose(resp.Body)
+		resp, err = h.do(ctx, http.MethodGet, req, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := httpResult(resp)
+	result.Body = resp.Body
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		safeClose(resp.Body)
+		return nil, ErrNotModified
+	case http.StatusOK:
+		// Either the whole file was requested or the server ignored the range
+		// because the file changed since the partial data was written.
+		result.Offset = 0
+	case http.StatusPartialContent:
+		start, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			safeClose(resp.Body)
+			return nil, err
+		}
+		result.Offset = start
+		result.Size = total
+		result.Ranged = true
+		result.AcceptRanges = true
+		if total < 0 && req.Length == 0 && resp.ContentLength >= 0 {
+			result.Size = start + resp.ContentLength
+		}
+	default:
+		safeClose(resp.Body)
+		return nil, newStatusError(resp)
+	}
+
+	return result, nil
+}
+
+// Stat sends a HEAD request. Servers that refuse HEAD requests, as some do for URLs
+// signed for GET only, are asked for the first byte of the file with a GET request.
+func (h *HTTPFetcher) Stat(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	header := http.Header{}
+	setConditions(header, req)
+
+	resp, err := h.do(ctx, http.MethodHead, req, header)
+	if err != nil {
+		return nil, err
+	}
+	safeClose(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return httpResult(resp), nil
+	case http.StatusNotModified:
+		return nil, ErrNotModified
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return h.statFirstByte(ctx, req)
+	default:
+		return nil, newStatusError(resp)
+	}
+}
+
+// statFirstByte returns the metadata of a GET request for the first byte of the file.
+func (h *HTTPFetcher) statFirstByte(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	result, err := h.Fetch(ctx, &FetchRequest{URL: req.URL, Header: req.Header, Length: 1})
+	if err != nil {
+		return nil, err
+	}
+	safeClose(result.Body)
+	result.Body = nil
+	return result, nil
+}
+
+// setConditions adds the If-None-Match and If-Modified-Since headers of a request.
+func setConditions(header http.Header, req *FetchRequest) {
+	if req.IfNoneMatch != "" {
+		header.Set("If-None-Match", req.IfNoneMatch)
+	}
+	if req.IfModifiedSince != "" {
+		header.Set("If-Modified-Since", req.IfModifiedSince)
+	}
+}
+
+// do sends a request with the request's headers and the given extra headers.
+func (h *HTTPFetcher) do(ctx context.Context, method string, req *FetchRequest, header http.Header) (*http.Response, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, method, req.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range req.Header {
+		httpReq.Header[key] = values
+	}
+	for key, values := range header {
+		httpReq.Header[key] = values
+	}
+
+	client := h.Client
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = RedactURL(urlErr.URL)
+		}
+		return nil, fmt.Errorf("failed to fetch URL: %w", err)
+	}
+	return resp, nil
+}
+
+// httpResult returns the file metadata sent with a response.
+func httpResult(resp *http.Response) *FetchResult {
+	return &FetchResult{
+		Size:         resp.ContentLength,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FileName:     contentDispositionFileName(resp.Header.Get("Content-Disposition")),
+		AcceptRanges: strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		URL:          resp.Request.URL.String(),
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileFetcher reads files from the local file system through file:// URLs,
+// including network file systems mounted locally.
+type FileFetcher struct{}
+
+// ValidateURL requires an absolute path on the local host.
+func (FileFetcher) ValidateURL(u *url.URL) error {
+	if u.Host != "" && u.Host != "localhost" {
+		return fmt.Errorf("invalid file URL: host %q is not the local host", u.Host)
+	}
+	if u.Opaque != "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("invalid file URL: path must be absolute")
+	}
+	return nil
+}
+
+// Fetch opens the file and seeks to the offset.
+func (FileFetcher) Fetch(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	path, err := filePath(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	result, err := fileResult(file)
+	if err == nil && notModified(req, result) {
+		err = ErrNotModified
+	}
+	if err != nil {
+		safeClose(file)
+		return nil, err
+	}
+
+	offset := req.Offset
+	if offset > result.Size || (req.Validator != "" && req.Validator != result.ETag && req.Validator != result.LastModified) {
+		offset = 0
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		safeClose(file)
+		return nil, fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	result.Offset = offset
+	result.Ranged = offset == req.Offset
+	result.Body = file
+	if req.Length > 0 && result.Ranged {
+		result.Body = limitReadCloser(file, req.Length)
+	}
+	return result, nil
+}
+
+// Stat returns the size and modification time of the file.
+func (FileFetcher) Stat(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	path, err := filePath(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer safeClose(file)
+
+	result, err := fileResult(file)
+	if err == nil && notModified(req, result) {
+		return nil, ErrNotModified
+	}
+	return result, err
+}
+
+// notModified reports whether the conditions of a request match the file.
+func notModified(req *FetchRequest, result *FetchResult) bool {
+	if req.IfNoneMatch != "" {
+		return req.IfNoneMatch == result.ETag
+	}
+	return req.IfModifiedSince != "" && req.IfModifiedSince == result.LastModified
+}
+
+// filePath returns the local path of a file URL.
+func filePath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL format: %w", err)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// fileResult returns the metadata of an open file. The ETag combines the modification
+// time and size, so a partial download is restarted when the file is replaced.
+func fileResult(file *os.File) (*FetchResult, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file: %s", file.Name())
+	}
+
+	return &FetchResult{
+		Size:         info.Size(),
+		ETag:         fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+		AcceptRanges: true,
+		ContentType:  mime.TypeByExtension(filepath.Ext(file.Name())),
+	}, nil
+}
+
+// DataFetcher reads the content embedded in data: URIs (RFC 2397),
+// such as "data:text/plain;base64,SGVsbG8=".
+type DataFetcher struct{}
+
+// ValidateURL requires a data URI with valid content.
+func (DataFetcher) ValidateURL(u *url.URL) error {
+	_, err := parseDataURL(u.String())
+	return err
+}
+
+// Fetch returns the content from the offset.
+func (DataFetcher) Fetch(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	data, err := parseDataURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := req.Offset
+	if offset > int64(len(data)) {
+		offset = 0
+	}
+	ranged := offset == req.Offset
+	end := int64(len(data))
+	if req.Length > 0 && ranged {
+		end = min(end, offset+req.Length)
+	}
+
+	return &FetchResult{
+		Body:         io.NopCloser(bytes.NewReader(data[offset:end])),
+		Offset:       offset,
+		Ranged:       ranged,
+		Size:         int64(len(data)),
+		AcceptRanges: true,
+		ContentType:  dataMediaType(req.URL),
+	}, nil
+}
+
+// Stat returns the size of the content.
+func (DataFetcher) Stat(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	data, err := parseDataURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &FetchResult{Size: int64(len(data)), AcceptRanges: true, ContentType: dataMediaType(req.URL)}, nil
+}
+
+// dataMediaType returns the media type of a data: URI, which defaults to text/plain.
+func dataMediaType(rawURL string) string {
+	params, _, _ := strings.Cut(rawURL[len("data:"):], ",")
+	if strings.HasSuffix(strings.ToLower(params), ";base64") {
+		params = params[:len(params)-len(";base64")]
+	}
+	if params == "" || strings.HasPrefix(params, ";") {
+		return "text/plain" + params
+	}
+	return params
+}
+
+// parseDataURL decodes the content of a data: URI, either base64 or percent-encoded.
+func parseDataURL(rawURL string) ([]byte, error) {
+	if len(rawURL) < 5 || !strings.EqualFold(rawURL[:5], "data:") {
+		return nil, errors.New("invalid data URI: missing data: prefix")
+	}
+
+	params, data, ok := strings.Cut(rawURL[5:], ",")
+	if !ok {
+		return nil, errors.New("invalid data URI: missing comma")
+	}
+
+	data, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data URI: %w", err)
+	}
+
+	if strings.HasSuffix(strings.ToLower(params), ";base64") {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data URI: %w", err)
+		}
+		return decoded, nil
+	}
+	return []byte(data), nil
+}
+
+// limitReadCloser returns a ReadCloser that reads at most n bytes from rc.
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Fetcher reads files from the URLs of one scheme. Sources that support range reads
+// serve requests with an offset; others return the whole file, which is detected by
+// the Offset of the result.
+type Fetcher interface {
+	// Fetch opens the file for reading from req.Offset. A source that cannot continue
+	// at the offset, or whose file changed since req.Validator was recorded, returns
+	// the whole file with an Offset of 0 and Ranged unset instead. A source that supports
+	// the conditions of the request returns ErrNotModified when the file still matches.
+	Fetch(ctx context.Context, req *FetchRequest) (*FetchResult, error)
+
+	// Stat returns the metadata of the file without reading its content, or
+	// ErrNotModified like Fetch.
+	Stat(ctx context.Context, req *FetchRequest) (*FetchResult, error)
+}
+
+// URLValidator is implemented by fetchers that check their URLs before any download starts.
+type URLValidator interface {
+	ValidateURL(u *url.URL) error
+}
+
+// FetchRequest describes the part of a file to read.
+type FetchRequest struct {
+	URL string
+
+	// Header holds request headers for sources that support them, such as HTTP.
+	Header http.Header
+
+	// Offset is the first byte to read.
+	Offset int64
+
+	// Length is the number of bytes to read from Offset, or 0 to read to the end.
+	Length int64
+
+	// Validator identifies the version of the file the data before Offset came from,
+	// as an ETag or Last-Modified date. Without one the range is read unconditionally.
+	Validator string
+
+	// IfNoneMatch and IfModifiedSince hold the ETag and Last-Modified date of a copy
+	// of the file downloaded earlier. They are only set for requests of the whole file.
+	IfNoneMatch     string
+	IfModifiedSince string
+}
+
+// FetchResult is an opened file or, for Stat, its metadata.
+type FetchResult struct {
+	// Body reads the requested data. It is nil for Stat.
+	Body io.ReadCloser
+
+	// Offset is the position in the file where Body starts.
+	Offset int64
+
+	// Ranged reports whether Body holds the requested range rather than the whole file.
+	Ranged bool
+
+	// Size is the size of the whole file, or -1 if it is unknown.
+	Size int64
+
+	// ETag and LastModified identify the version of the file, if the source knows it.
+	ETag         string
+	LastModified string
+
+	// FileName is a file name suggested by the source, or empty.
+	FileName string
+
+	// ContentType is the media type of the file, if the source knows it.
+	ContentType string
+
+	// URL is the URL the file was read from after following redirects. It is empty for
+	// sources that do not redirect.
+	URL string
+
+	// AcceptRanges reports whether the source can read from an offset.
+	AcceptRanges bool
+}
+
+// fetchers maps URL schemes to the fetcher reading them.
+var fetchers = struct {
+	mu sync.RWMutex
+	m  map[string]Fetcher
+}{
+	m: map[string]Fetcher{
+		"http":  &HTTPFetcher{},
+		"https": &HTTPFetcher{},
+		"file":  FileFetcher{},
+		"data":  DataFetcher{},
+	},
+}
+
+// RegisterFetcher makes URLs with the given scheme downloadable through fetcher,
+// replacing the fetcher registered for the scheme before, if any.
+func RegisterFetcher(scheme string, fetcher Fetcher) {
+	fetchers.mu.Lock()
+	defer fetchers.mu.Unlock()
+	fetchers.m[strings.ToLower(scheme)] = fetcher
+}
+
+// LookupFetcher returns the fetcher registered for a URL scheme.
+func LookupFetcher(scheme string) (Fetcher, bool) {
+	fetchers.mu.RLock()
+	defer fetchers.mu.RUnlock()
+	fetcher, ok := fetchers.m[strings.ToLower(scheme)]
+	return fetcher, ok
+}
+
+// fetcherFor returns the fetcher for a URL. A registered HTTPFetcher sends its requests
+// with the HTTP client of opts, if one is set.
+func fetcherFor(rawURL string, opts Options) (Fetcher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL format: %w", err)
+	}
+	fetcher, ok := LookupFetcher(u.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("unsupported URL scheme '%s'", u.Scheme)
+	}
+	if _, ok := fetcher.(*HTTPFetcher); ok && opts.HTTPClient != nil {
+		fetcher = &HTTPFetcher{Client: opts.HTTPClient}
+	}
+	return fetcher, nil
+}
+
+// fetch opens the file at the current mirror for reading from offset.
+func (f *FileDownload) fetch(ctx context.Context, offset, length int64, validator string) (*FetchResult, error) {
+	req := f.fetchRequest(f.Mirror())
+	req.Offset = offset
+	req.Length = length
+	req.Validator = validator
+	f.addConditions(req)
+
+	fetcher, err := fetcherFor(req.URL, f.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.holdSlot(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	return f.request(ctx, req.URL, func() (*FetchResult, error) {
+		return fetcher.Fetch(ctx, req)
+	})
+}
+
+// stat returns the metadata of the file at the current mirror.
+func (f *FileDownload) stat(ctx context.Context) (*FetchResult, error) {
+	req := f.fetchRequest(f.Mirror())
+	f.addConditions(req)
+
+	fetcher, err := fetcherFor(req.URL, f.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.holdSlot(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	return f.request(ctx, req.URL, func() (*FetchResult, error) {
+		return fetcher.Stat(ctx, req)
+	})
+}
+
+// fetchRequest returns a request for url with the download's headers and the
+// credentials for its host, unless the headers already authorize the request.
+func (f *FileDownload) fetchRequest(url string) *FetchRequest {
+	return &FetchRequest{URL: url, Header: authorize(f.Header, f.credentials(url))}
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPFetcher(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		req        FetchRequest
+		wantOffset int64
+		wantRanged bool
+		wantBody   string
+	}{
+		{name: "whole file", req: FetchRequest{}, wantBody: string(content)},
+		{name: "rest of file", req: FetchRequest{Offset: 10, Validator: `"v1"`}, wantOffset: 10, wantRanged: true, wantBody: "abcdefghij"},
+		{name: "range", req: FetchRequest{Offset: 5, Length: 3, Validator: `"v1"`}, wantOffset: 5, wantRanged: true, wantBody: "567"},
+		{name: "changed file", req: FetchRequest{Offset: 10, Validator: `"v0"`}, wantBody: string(content)},
+		{name: "range not satisfiable", req: FetchRequest{Offset: 30}, wantBody: string(content)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.URL = server.URL + "/file.bin"
+
+			result, err := (&HTTPFetcher{}).Fetch(context.Background(), &req)
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			defer safeClose(result.Body)
+
+			body, err := io.ReadAll(result.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Offset != tt.wantOffset || result.Ranged != tt.wantRanged || string(body) != tt.wantBody {
+				t.Errorf("Fetch() = offset %d, ranged %v, body %q, want %d, %v, %q",
+					result.Offset, result.Ranged, body, tt.wantOffset, tt.wantRanged, tt.wantBody)
+			}
+			if result.Size != int64(len(content)) || result.ETag != `"v1"` {
+				t.Errorf("Fetch() size = %d, ETag = %q", result.Size, result.ETag)
+			}
+		})
+	}
+}
+
+func TestLocalFetchers(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 300*1024)
+	source := filepath.Join(t.TempDir(), "source.bin")
+	if err := os.WriteFile(source, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fileURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(source)}).String()
+
+	tests := []struct {
+		name  string
+		entry Entry
+		opts  Options
+		want  []byte
+	}{
+		{name: "file", entry: Entry{URL: fileURL}, want: content},
+		{name: "segmented file", entry: Entry{URL: fileURL}, opts: Options{Segments: 3}, want: content},
+		{name: "base64 data", entry: Entry{URL: "data:text/plain;base64,SGVsbG8sIHdvcmxkIQ==", FileName: "hello.txt"}, want: []byte("Hello, world!")},
+		{name: "percent-encoded data", entry: Entry{URL: "data:,Hello%2C%20world!", FileName: "hello.txt"}, want: []byte("Hello, world!")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := runDownload(t, tt.entry, tt.opts)
+			if err := d.Err(); err != nil {
+				t.Fatalf("download error = %v", err)
+			}
+			checkContent(t, d, tt.want)
+		})
+	}
+}
+
+func TestDataMediaType(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "data:,hello", want: "text/plain"},
+		{url: "data:;charset=utf-8,hello", want: "text/plain;charset=utf-8"},
+		{url: "data:text/csv,a,b", want: "text/csv"},
+		{url: "data:text/plain;base64,aGVsbG8=", want: "text/plain"},
+		{url: "data:text/plain;BASE64,aGVsbG8=", want: "text/plain"},
+		{url: "data:;Base64,aGVsbG8=", want: "text/plain"},
+	}
+
+	for _, tt := range tests {
+		if got := dataMediaType(tt.url); got != tt.want {
+			t.Errorf("dataMediaType(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestFileFetcherChangedFile(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source.bin")
+	if err := os.WriteFile(source, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	req := &FetchRequest{URL: "file://" + filepath.ToSlash(source), Offset: 4, Validator: `"stale"`}
+
+	result, err := FileFetcher{}.Fetch(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	defer safeClose(result.Body)
+
+	if result.Offset != 0 || result.Ranged {
+		t.Errorf("Fetch() offset = %d, ranged = %v, want the whole file", result.Offset, result.Ranged)
+	}
+}
+
+// memoryFetcher serves a fixed content for every URL.
+type memoryFetcher struct {
+	content []byte
+}
+
+func (m memoryFetcher) Fetch(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	return &FetchResult{Body: io.NopCloser(bytes.NewReader(m.content)), Size: int64(len(m.content))}, nil
+}
+
+func (m memoryFetcher) Stat(ctx context.Context, req *FetchRequest) (*FetchResult, error) {
+	return &FetchResult{Size: int64(len(m.content))}, nil
+}
+
+func TestRegisterFetcher(t *testing.T) {
+	if err := validateURL("mem://bucket/file.bin"); err == nil {
+		t.Fatal("validateURL() accepted an unregistered scheme")
+	}
+
+	RegisterFetcher("mem", memoryFetcher{content: []byte("in memory")})
+	t.Cleanup(func() {
+		fetchers.mu.Lock()
+		delete(fetchers.m, "mem")
+		fetchers.mu.Unlock()
+	})
+
+	d := runDownload(t, Entry{URL: "mem://bucket/file.bin"}, Options{})
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if filepath.Base(d.Path()) != "file.bin" {
+		t.Errorf("Path() = %q, want file.bin", d.Path())
+	}
+	checkContent(t, d, []byte("in memory"))
+}
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MaxGlobURLs is the largest number of URLs a single URL pattern may expand into.
+const MaxGlobURLs = 100_000
+
+// GlobURL is a URL expanded from a pattern, with the value each glob of the pattern
+// took in it, in the order the globs appear.
+type GlobURL struct {
+	URL    string
+	Values []string
+}
+
+// urlGlob is a URL pattern split into its literal text and the values of its globs.
+// literals has one element more than sets: the text before, between and after them.
+type urlGlob struct {
+	literals []string
+	sets     [][]string
+}
+
+// ExpandURLGlob expands a URL pattern curl-style. "{a,b,c}" takes each of the listed
+// values, "[1-10]" each number of the range, padded with zeros to the width of the
+// start when it has leading zeros ("[001-250]"), "[a-z]" each letter, and a ":step"
+// suffix ("[0-100:10]") counts in steps. With several globs the last one varies
+// fastest. A backslash makes the next bracket, brace, comma or backslash literal, and
+// the brackets of an IPv6 host are kept as they are.
+func ExpandURLGlob(pattern string) ([]GlobURL, error) {
+	glob, err := parseURLGlob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL pattern %q: %w", pattern, err)
+	}
+
+	count := 1
+	for _, set := range glob.sets {
+		if count > MaxGlobURLs/len(set) {
+			return nil, fmt.Errorf("URL pattern %q expands to more than %d URLs", pattern, MaxGlobURLs)
+		}
+		count *= len(set)
+	}
+
+	urls := make([]GlobURL, 0, count)
+	indexes := make([]int, len(glob.sets))
+	for {
+		var b strings.Builder
+		values := make([]string, len(glob.sets))
+		for i, set := range glob.sets {
+			values[i] = set[indexes[i]]
+			b.WriteString(glob.literals[i])
+			b.WriteString(values[i])
+		}
+		b.WriteString(glob.literals[len(glob.sets)])
+		urls = append(urls, GlobURL{URL: b.String(), Values: values})
+
+		// Advance the last glob, carrying over to the ones before it.
+		i := len(indexes) - 1
+		for ; i >= 0; i-- {
+			indexes[i]++
+			if indexes[i] < len(glob.sets[i]) {
+				break
+			}
+			indexes[i] = 0
+		}
+		if i < 0 {
+			return urls, nil
+		}
+	}
+}
+
+// parseURLGlob splits a URL pattern into literals and globs.
+func parseURLGlob(pattern string) (*urlGlob, error) {
+	glob := &urlGlob{}
+	var literal strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern) && strings.IndexByte(`[]{},\`, pattern[i+1]) >= 0:
+			i++
+			literal.WriteByte(pattern[i])
+
+		case c == '[' && strings.HasSuffix(pattern[:i], "://"):
+			// An IPv6 host such as http://[::1]:8080/.
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unmatched '[' at position %d", i+1)
+			}
+			literal.WriteString(pattern[i : i+end+1])
+			i += end
+
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unmatched '[' at position %d", i+1)
+			}
+			set, err := parseGlobRange(pattern[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("range at position %d: %w", i+1, err)
+			}
+			glob.literals = append(glob.literals, literal.String())
+			glob.sets = append(glob.sets, set)
+			literal.Reset()
+			i += end
+
+		case c == '{':
+			set, end, err := parseGlobSet(pattern, i)
+			if err != nil {
+				return nil, err
+			}
+			glob.literals = append(glob.literals, literal.String())
+			glob.sets = append(glob.sets, set)
+			literal.Reset()
+			i = end
+
+		case c == ']' || c == '}':
+			return nil, fmt.Errorf("unmatched '%c' at position %d", c, i+1)
+
+		default:
+			literal.WriteByte(c)
+		}
+	}
+
+	glob.literals = append(glob.literals, literal.String())
+	return glob, nil
+}
+
+// parseGlobSet parses the "{a,b,c}" set starting at pattern[start] and returns its
+// values and the position of its closing brace.
+func parseGlobSet(pattern string, start int) ([]string, int, error) {
+	var values []string
+	var value strings.Builder
+	for i := start + 1; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern) && strings.IndexByte(`[]{},\`, pattern[i+1]) >= 0:
+			i++
+			value.WriteByte(pattern[i])
+		case c == ',':
+			values = append(values, value.String())
+			value.Reset()
+		case c == '}':
+			return append(values, value.String()), i, nil
+		case c == '{' || c == '[' || c == ']':
+			return nil, 0, fmt.Errorf("nested '%c' at position %d", c, i+1)
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return nil, 0, fmt.Errorf("unmatched '{' at position %d", start+1)
+}
+
+// parseGlobRange parses the inside of a "[start-end:step]" range.
+func parseGlobRange(s string) ([]string, error) {
+	bounds, stepText, hasStep := strings.Cut(s, ":")
+	step := 1
+	if hasStep {
+		var err error
+		step, err = strconv.Atoi(stepText)
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid step %q", stepText)
+		}
+	}
+
+	first, last, ok := strings.Cut(bounds, "-")
+	if !ok || first == "" || last == "" {
+		return nil, fmt.Errorf("invalid range %q: expected start-end", s)
+	}
+
+	if isLetter(first) && isLetter(last) {
+		if (first[0] >= 'a') != (last[0] >= 'a') || first[0] > last[0] {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		// Counting the values first keeps a huge step from overflowing.
+		count := int(last[0]-first[0])/step + 1
+		values := make([]string, count)
+		for k := range values {
+			values[k] = string(rune(int(first[0]) + k*step))
+		}
+		return values, nil
+	}
+
+	from, err1 := strconv.Atoi(first)
+	to, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || from < 0 || from > to {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+	count := (to-from)/step + 1
+	if count > MaxGlobURLs {
+		return nil, fmt.Errorf("range %q has more than %d values", s, MaxGlobURLs)
+	}
+	width := 0
+	if len(first) > 1 && first[0] == '0' {
+		width = len(first)
+	}
+	values := make([]string, count)
+	for k := range values {
+		values[k] = fmt.Sprintf("%0*d", width, from+k*step)
+	}
+	return values, nil
+}
+
+// isLetter reports whether s is a single ASCII letter.
+func isLetter(s string) bool {
+	return len(s) == 1 && ('a' <= s[0] && s[0] <= 'z' || 'A' <= s[0] && s[0] <= 'Z')
+}
+
+// ExpandFileNameTemplate replaces "#1", "#2"... in template with the values of the
+// first, second... glob of a URL pattern.
+func ExpandFileNameTemplate(template string, values []string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		end := i + 1
+		for end < len(template) && '0' <= template[end] && template[end] <= '9' {
+			end++
+		}
+		if template[i] != '#' || end == i+1 {
+			b.WriteByte(template[i])
+			continue
+		}
+
+		n, err := strconv.Atoi(template[i+1 : end])
+		if err != nil || n < 1 || n > len(values) {
+			return "", fmt.Errorf("file name template %q refers to glob #%s, but the URL has %d", template, template[i+1:end], len(values))
+		}
+		b.WriteString(values[n-1])
+		i = end - 1
+	}
+	return b.String(), nil
+}
+
+// SplitURLList splits a comma-separated list of URLs, leaving the commas of "{a,b}"
+// sets and escaped commas in place.
+func SplitURLList(s string) []string {
+	var urls []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth = max(depth-1, 0)
+		case ',':
+			if depth == 0 {
+				urls = append(urls, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(urls, s[start:])
+}
+
+// EntriesFromURLPatterns creates entries for URL patterns given on the command line,
+// expanding each with ExpandURLGlob unless globOff is set. Mirrors separated by "|" are
+// expanded alike and paired with the URLs of the primary pattern in order. A non-empty
+// output is a file name template for ExpandFileNameTemplate, which may include
+// subdirectories of the download directory.
+func EntriesFromURLPatterns(patterns []string, output string, globOff bool) ([]Entry, error) {
+	var entries []Entry
+	for _, pattern := range patterns {
+		alternatives := strings.Split(pattern, "|")
+		expanded := make([][]GlobURL, len(alternatives))
+		for i, alternative := range alternatives {
+			if globOff {
+				expanded[i] = []GlobURL{{URL: alternative}}
+				continue
+			}
+			urls, err := ExpandURLGlob(alternative)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 && len(urls) != len(expanded[0]) {
+				return nil, fmt.Errorf("mirror pattern %q expands to %d URLs, but %q to %d", alternative, len(urls), alternatives[0], len(expanded[0]))
+			}
+			expanded[i] = urls
+		}
+
+		for n, primary := range expanded[0] {
+			entry := Entry{URL: primary.URL}
+			for _, mirror := range expanded[1:] {
+				entry.Mirrors = append(entry.Mirrors, mirror[n].URL)
+			}
+			if output != "" {
+				if err := entry.setOutputName(output, primary.Values); err != nil {
+					return nil, err
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// setOutputName names the entry after the file name template, splitting off the
+// subdirectories the name may include.
+func (e *Entry) setOutputName(template string, values []string) error {
+	name, err := ExpandFileNameTemplate(template, values)
+	if err != nil {
+		return err
+	}
+	name = path.Clean(filepath.ToSlash(name))
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("invalid file name %q for %s: must stay inside the download directory", name, RedactURL(e.URL))
+	}
+
+	e.FileName = path.Base(name)
+	if dir := path.Dir(name); dir != "." {
+		e.Dir = filepath.FromSlash(dir)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandURLGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"https://host/file.bin", []string{"https://host/file.bin"}},
+		{"https://host/img[8-11].png", []string{"https://host/img8.png", "https://host/img9.png", "https://host/img10.png", "https://host/img11.png"}},
+		{"https://host/img[008-010].png", []string{"https://host/img008.png", "https://host/img009.png", "https://host/img010.png"}},
+		{"https://host/p[0-100:40]", []string{"https://host/p0", "https://host/p40", "https://host/p80"}},
+		{"https://host/p[0-9223372036854775807:4611686018427387904]", []string{"https://host/p0", "https://host/p4611686018427387904"}},
+		{"https://host/[a-z:9223372036854775807]", []string{"https://host/a"}},
+		{"https://host/[a-e:2]", []string{"https://host/a", "https://host/c", "https://host/e"}},
+		{"https://host/{a,b}/[1-2].csv", []string{"https://host/a/1.csv", "https://host/a/2.csv", "https://host/b/1.csv", "https://host/b/2.csv"}},
+		{"https://host/data{,.sig}", []string{"https://host/data", "https://host/data.sig"}},
+		{`https://host/\[1-2\]{x\,y}`, []string{"https://host/[1-2]x,y"}},
+		{"http://[::1]:8080/[1-2]", []string{"http://[::1]:8080/1", "http://[::1]:8080/2"}},
+	}
+	for _, tt := range tests {
+		urls, err := ExpandURLGlob(tt.pattern)
+		if err != nil {
+			t.Errorf("ExpandURLGlob(%q) error = %v", tt.pattern, err)
+			continue
+		}
+		var got []string
+		for _, u := range urls {
+			got = append(got, u.URL)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ExpandURLGlob(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+
+	urls, _ := ExpandURLGlob("https://host/{a,b}/[01-02].csv")
+	if !slices.Equal(urls[2].Values, []string{"b", "01"}) {
+		t.Errorf("values = %v, want [b 01]", urls[2].Values)
+	}
+}
+
+func TestExpandURLGlobErrors(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr string
+	}{
+		{"https://host/[1-3", "unmatched '['"},
+		{"https://host/{a,b", "unmatched '{'"},
+		{"https://host/a]", "unmatched ']'"},
+		{"https://host/{a,{b}}", "nested '{'"},
+		{"https://host/[3-1]", "invalid range"},
+		{"https://host/[a-Z]", "invalid range"},
+		{"https://host/[1-9:0]", "invalid step"},
+		{"https://host/[1-]", "expected start-end"},
+		{"https://host/[0-999][0-999]", "more than 100000 URLs"},
+	}
+	for _, tt := range tests {
+		_, err := ExpandURLGlob(tt.pattern)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ExpandURLGlob(%q) error = %v, want %q", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExpandFileNameTemplate(t *testing.T) {
+	got, err := ExpandFileNameTemplate("#2-#1#10.#ext", []string{"a", "b"})
+	if err == nil {
+		t.Errorf("ExpandFileNameTemplate() = %q, want an error for #10", got)
+	}
+
+	got, err = ExpandFileNameTemplate("shard-#1/#2#.csv", []string{"007", "x"})
+	if err != nil || got != "shard-007/x#.csv" {
+		t.Errorf("ExpandFileNameTemplate() = %q, %v, want shard-007/x#.csv", got, err)
+	}
+}
+
+func TestSplitURLList(t *testing.T) {
+	got := SplitURLList(`https://a/{x,y}.csv,https://b/[1-2],https://c/d\,e`)
+	want := []string{"https://a/{x,y}.csv", "https://b/[1-2]", `https://c/d\,e`}
+	if !slices.Equal(got, want) {
+		t.Errorf("SplitURLList() = %q, want %q", got, want)
+	}
+}
+
+func TestEntriesFromURLPatterns(t *testing.T) {
+	entries, err := EntriesFromURLPatterns([]string{"https://a/s[1-2].bin|https://b/s[1-2].bin"}, "shards/#1.bin", false)
+	if err != nil {
+		t.Fatalf("EntriesFromURLPatterns() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("EntriesFromURLPatterns() returned %d entries, want 2", len(entries))
+	}
+	second := entries[1]
+	if second.URL != "https://a/s2.bin" || !slices.Equal(second.Mirrors, []string{"https://b/s2.bin"}) ||
+		second.Dir != "shards" || second.FileName != "2.bin" {
+		t.Errorf("entry = %+v", second)
+	}
+
+	entries, err = EntriesFromURLPatterns([]string{"https://a/[1-2]"}, "", true)
+	if err != nil || len(entries) != 1 || entries[0].URL != "https://a/[1-2]" {
+		t.Errorf("EntriesFromURLPatterns() with globOff = %+v, %v", entries, err)
+	}
+
+	if _, err := EntriesFromURLPatterns([]string{"https://a/s[1-2]|https://b/s1"}, "", false); err == nil {
+		t.Error("mirror with fewer URLs was accepted")
+	}
+	if _, err := EntriesFromURLPatterns([]string{"https://a/{x,..}"}, filepath.Join("#1", "..", "..", "f"), false); err == nil {
+		t.Error("file name outside the download directory was accepted")
+	}
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HostBackoffBase is the wait between requests to a host after it first answered
+	// 429 Too Many Requests or 503 Service Unavailable without a Retry-After header.
+	// It doubles with every further such answer and halves with every other one.
+	HostBackoffBase = time.Second
+
+	// MaxHostBackoff caps the wait between requests to a host that keeps refusing them,
+	// including the wait asked for by a Retry-After header.
+	MaxHostBackoff = 5 * time.Minute
+)
+
+// HostLimiter spreads downloads and requests over the hosts they go to. It caps the
+// number of downloads running per host, keeps a minimum delay between the requests to
+// a host, and backs off from a host that answers 429 or 503 for every download of
+// that host at once. A nil *HostLimiter limits nothing. It is safe for concurrent use.
+type HostLimiter struct {
+	maxPerHost int
+	delay      time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+	// freed is closed, and cleared, when a download slot is released.
+	freed chan struct{}
+}
+
+// hostState is what the HostLimiter knows about one host.
+type hostState struct {
+	// running is the number of downloads holding a slot of the host.
+	running int
+	// next is the earliest time of the next request to the host.
+	next time.Time
+	// backoff is the extra wait between requests after the host refused some.
+	backoff time.Duration
+}
+
+// NewHostLimiter returns a limiter running at most maxPerHost downloads per host, zero
+// or less for no cap, and sending requests to a host at least delay apart.
+func NewHostLimiter(maxPerHost int, delay time.Duration) *HostLimiter {
+	return &HostLimiter{maxPerHost: maxPerHost, delay: max(delay, 0), hosts: make(map[string]*hostState)}
+}
+
+// host returns the state of a host. Must be called with l.mu locked.
+func (l *HostLimiter) host(name string) *hostState {
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &hostState{}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// capped reports whether the limiter caps the number of downloads per host.
+func (l *HostLimiter) capped() bool {
+	return l != nil && l.maxPerHost > 0
+}
+
+// available reports whether a download slot of the host of rawURL is free.
+func (l *HostLimiter) available(rawURL string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxPerHost <= 0 || l.host(urlHost(rawURL)).running < l.maxPerHost
+}
+
+// tryAcquire takes a download slot of the host of rawURL if one is free.
+func (l *HostLimiter) tryAcquire(rawURL string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(urlHost(rawURL))
+	if l.maxPerHost > 0 && h.running >= l.maxPerHost {
+		return false
+	}
+	h.running++
+	return true
+}
+
+// acquire takes a download slot of the host of rawURL, waiting until one is free.
+func (l *HostLimiter) acquire(ctx context.Context, rawURL string) error {
+	for {
+		freed := l.released()
+		if l.tryAcquire(rawURL) {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns a download slot taken by tryAcquire or acquire.
+func (l *HostLimiter) release(rawURL string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.host(urlHost(rawURL)).running--
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+}
+
+// released returns a channel that is closed when the next download slot is released.
+// A nil *HostLimiter returns a nil channel, which never is.
+func (l *HostLimiter) released() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.freed == nil {
+		l.freed = make(chan struct{})
+	}
+	return l.freed
+}
+
+// readyAt returns when the next request to the host of rawURL may be sent.
+func (l *HostLimiter) readyAt(rawURL string) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.host(urlHost(rawURL)).next
+}
+
+// wait blocks until a request to the host of rawURL may be sent and moves the next
+// request to the host back by the delay and the backoff. Waiting requests check again
+// when they wake up, so a host that starts refusing requests meanwhile holds them all.
+func (l *HostLimiter) wait(ctx context.Context, rawURL string) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		l.mu.Lock()
+		h := l.host(urlHost(rawURL))
+		now := time.Now()
+		if !h.next.After(now) {
+			h.next = now.Add(l.delay + h.backoff)
+			l.mu.Unlock()
+			return nil
+		}
+		pause := h.next.Sub(now)
+		l.mu.Unlock()
+
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+	}
+}
+
+// observe adapts the backoff of the host of rawURL to the outcome of a request. A
+// 429 or 503 answer doubles the wait, or waits as long as its Retry-After header asks
+// up to MaxHostBackoff; other answers halve it.
+func (l *HostLimiter) observe(rawURL string, err error) {
+	if l == nil {
+		return
+	}
+	var statusErr *StatusError
+	throttled := errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusServiceUnavailable)
+	if err != nil && !throttled {
+		// Errors that are not answers say nothing about the load of the host.
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(urlHost(rawURL))
+	if !throttled {
+		h.backoff /= 2
+		if h.backoff < HostBackoffBase {
+			h.backoff = 0
+		}
+		return
+	}
+
+	h.backoff = min(max(h.backoff*2, HostBackoffBase), MaxHostBackoff)
+	pause := h.backoff
+	if statusErr.RetryAfter > 0 {
+		pause = min(statusErr.RetryAfter, MaxHostBackoff)
+	}
+	if next := time.Now().Add(pause); next.After(h.next) {
+		h.next = next
+	}
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// takeSlot records the download slot of the host of rawURL that the scheduler took for
+// the download.
+func (f *FileDownload) takeSlot(rawURL string) {
+	f.slotMu.Lock()
+	defer f.slotMu.Unlock()
+	f.slot = rawURL
+}
+
+// releaseSlot returns the download slot the download holds, if any.
+func (f *FileDownload) releaseSlot() {
+	f.slotMu.Lock()
+	defer f.slotMu.Unlock()
+	if f.slot != "" {
+		f.opts.Hosts.release(f.slot)
+		f.slot = ""
+	}
+}
+
+// holdSlot moves the download slot of the download to the host of rawURL before it
+// requests from another host than the one it holds, such as the host of a mirror. The
+// old slot is released first, so two downloads swapping hosts cannot wait on each
+// other, and the wait for a new one does not count towards the stall timeout.
+// Downloads that were started without a slot are not counted.
+func (f *FileDownload) holdSlot(ctx context.Context, rawURL string) error {
+	f.slotMu.Lock()
+	defer f.slotMu.Unlock()
+	if f.slot == "" || urlHost(f.slot) == urlHost(rawURL) {
+		return nil
+	}
+
+	hosts := f.opts.Hosts
+	hosts.release(f.slot)
+	f.slot = ""
+
+	resume := f.pauseStall()
+	err := hosts.acquire(ctx, rawURL)
+	resume()
+	if err != nil {
+		return err
+	}
+	f.slot = rawURL
+	return nil
+}
+
+// request sends a request to the host of rawURL through the host limiter: it waits
+// for its turn, which does not count towards the stall timeout, and reports the
+// outcome of send.
+func (f *FileDownload) request(ctx context.Context, rawURL string, send func() (*FetchResult, error)) (*FetchResult, error) {
+	hosts := f.opts.Hosts
+	if hosts != nil {
+		resume := f.pauseStall()
+		err := hosts.wait(ctx, rawURL)
+		resume()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := send()
+	hosts.observe(rawURL, err)
+	return result, err
+}
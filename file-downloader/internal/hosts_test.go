@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimits(t *testing.T) {
+	var running, peak atomic.Int32
+	var mu sync.Mutex
+	var slowRequests []time.Time
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		mu.Lock()
+		slowRequests = append(slowRequests, time.Now())
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	var fastDone time.Time
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fastDone = time.Now()
+		mu.Unlock()
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	// The fast host comes last, yet must not wait for the slow one.
+	entries := []Entry{
+		{URL: slow.URL + "/1.bin"},
+		{URL: slow.URL + "/2.bin"},
+		{URL: slow.URL + "/3.bin"},
+		{URL: fast.URL + "/4.bin"},
+	}
+	const delay = 80 * time.Millisecond
+	startBatch(t, entries, Options{Hosts: NewHostLimiter(1, delay)}, 2)
+
+	if got := peak.Load(); got != 1 {
+		t.Errorf("at most %d downloads ran at once on one host, want 1", got)
+	}
+	if len(slowRequests) != 3 {
+		t.Fatalf("slow host received %d requests, want 3", len(slowRequests))
+	}
+	if !fastDone.Before(slowRequests[1]) {
+		t.Error("the download from the other host waited for the busy host")
+	}
+	for i := 1; i < len(slowRequests); i++ {
+		// Measured by the server, so allow for some scheduling jitter.
+		if gap := slowRequests[i].Sub(slowRequests[i-1]); gap < delay-20*time.Millisecond {
+			t.Errorf("requests %d and %d were %v apart, want at least %v", i, i+1, gap, delay)
+		}
+	}
+}
+
+func TestHostLimitsFollowMirrors(t *testing.T) {
+	var running, peak, served atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		served.Add(1)
+
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("mirror"))
+	}))
+	defer mirror.Close()
+
+	// Every file starts from a host of its own that fails, so the scheduler starts them
+	// all at once and each one moves on to the shared mirror host.
+	var entries []Entry
+	for i := range 3 {
+		broken := httptest.NewServer(http.NotFoundHandler())
+		defer broken.Close()
+		name := fmt.Sprintf("/%d.bin", i)
+		entries = append(entries, Entry{URL: broken.URL + name, Mirrors: []string{mirror.URL + name}})
+	}
+	opts := Options{Hosts: NewHostLimiter(1, 0), Retry: RetryPolicy{MaxAttempts: 1}}
+	startBatch(t, entries, opts, 0)
+
+	if got := peak.Load(); got != 1 {
+		t.Errorf("at most %d downloads ran at once on the mirror host, want 1", got)
+	}
+	if got := served.Load(); got != int32(len(entries)) {
+		t.Errorf("mirror host served %d files, want %d", got, len(entries))
+	}
+}
+
+func TestHostBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var requests []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		first := len(requests) == 1
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	opts := Options{
+		Hosts: NewHostLimiter(0, 100*time.Millisecond),
+		Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+	}
+	startBatch(t, []Entry{{URL: server.URL + "/a.bin"}, {URL: server.URL + "/b.bin"}}, opts, 0)
+
+	if len(requests) != 3 {
+		t.Fatalf("server received %d requests, want 3", len(requests))
+	}
+	// Every download of the host waits as long as the refusal asked.
+	for i, at := range requests[1:] {
+		if wait := at.Sub(requests[0]); wait < 900*time.Millisecond {
+			t.Errorf("request %d was sent %v after the 429 answer, want about 1s", i+2, wait)
+		}
+	}
+}
+
+func TestHostLimiterObserve(t *testing.T) {
+	l := NewHostLimiter(0, 0)
+	const rawURL = "https://example.com/file.bin"
+	throttled := &StatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+
+	tests := []struct {
+		name        string
+		err         error
+		wantBackoff time.Duration
+		wantPause   time.Duration
+	}{
+		{name: "first refusal", err: throttled, wantBackoff: HostBackoffBase, wantPause: HostBackoffBase},
+		{name: "second refusal", err: throttled, wantBackoff: 2 * HostBackoffBase, wantPause: 2 * HostBackoffBase},
+		{
+			name:        "retry after",
+			err:         &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute},
+			wantBackoff: 4 * HostBackoffBase,
+			wantPause:   time.Minute,
+		},
+		{
+			name:        "retry after beyond the cap",
+			err:         &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 365 * 24 * time.Hour},
+			wantBackoff: 8 * HostBackoffBase,
+			wantPause:   MaxHostBackoff,
+		},
+		{name: "other error", err: &StatusError{StatusCode: http.StatusNotFound}, wantBackoff: 8 * HostBackoffBase},
+		{name: "success", wantBackoff: 4 * HostBackoffBase},
+		{name: "success again", wantBackoff: 2 * HostBackoffBase},
+		{name: "recovering", wantBackoff: HostBackoffBase},
+		{name: "recovered", wantBackoff: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := l.readyAt(rawURL)
+			now := time.Now()
+			l.observe(rawURL, tt.err)
+
+			if got := l.hosts["example.com"].backoff; got != tt.wantBackoff {
+				t.Errorf("backoff = %v, want %v", got, tt.wantBackoff)
+			}
+			after := l.readyAt(rawURL)
+			if tt.wantPause == 0 {
+				if !after.Equal(before) {
+					t.Errorf("next request moved from %v to %v", before, after)
+				}
+				return
+			}
+			if pause := after.Sub(now); pause < tt.wantPause || pause > tt.wantPause+time.Second {
+				t.Errorf("next request in %v, want %v", pause, tt.wantPause)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// JournalFileName is the name of the file in the download directory that records the
+	// state of every download of the last batch.
+	JournalFileName = ".file-downloader-journal.json"
+
+	// JournalSaveInterval is how often the journal is saved while only progress changes.
+	// Lifecycle events are saved right away.
+	JournalSaveInterval = 5 * time.Second
+)
+
+// ErrNoJournal is returned by LoadJournal when the download directory has no journal.
+var ErrNoJournal = errors.New("no journal in the download directory")
+
+// JournalState is the state of a download recorded in the journal.
+type JournalState string
+
+const (
+	// JournalPending is recorded for a download that did not start yet.
+	JournalPending JournalState = "pending"
+	// JournalInProgress is recorded for a download that started, with the bytes on disk.
+	JournalInProgress JournalState = "in_progress"
+	// JournalDone is recorded for a download whose file is complete, with its digest.
+	JournalDone JournalState = "done"
+	// JournalFailed is recorded for a download that stopped with an error.
+	JournalFailed JournalState = "failed"
+)
+
+// sensitiveHeaders are not written to the journal, like credentials.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// journalRecord is the journal entry of a download: the manifest entry it came from,
+// without credentials, and how far it got.
+type journalRecord struct {
+	manifestEntry
+	// Credentials is set when credentials were left out of the entry, so it cannot be
+	// downloaded from the journal alone.
+	Credentials bool         `json:"credentials,omitempty"`
+	State       JournalState `json:"state"`
+	Path        string       `json:"path,omitempty"`
+	// Offset is the number of bytes on disk, including the partial file.
+	Offset int64 `json:"offset"`
+	// Size is the size of the file, or -1 while it is unknown.
+	Size       int64     `json:"size"`
+	Digest     string    `json:"digest,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ExtractDir string    `json:"extract_dir,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// newJournalRecord returns a pending record for entry, leaving out its credentials.
+func newJournalRecord(entry Entry) *journalRecord {
+	m := newManifestEntry(entry)
+	record := &journalRecord{manifestEntry: m, State: JournalPending, Size: -1}
+
+	record.URL = RedactURL(m.URL)
+	record.Mirrors = nil
+	for _, mirror := range m.Mirrors {
+		record.Mirrors = append(record.Mirrors, RedactURL(mirror))
+	}
+	record.Credentials = record.URL != m.URL || m.User != "" || m.BearerToken != ""
+	record.User = ""
+	record.BearerToken = ""
+	for _, name := range sensitiveHeaders {
+		if _, ok := record.Headers[http.CanonicalHeaderKey(name)]; ok {
+			delete(record.Headers, http.CanonicalHeaderKey(name))
+			record.Credentials = true
+		}
+	}
+	return record
+}
+
+// journalKey identifies the record of an entry across runs.
+func journalKey(entry Entry) string {
+	return RedactURL(entry.URL) + "\x00" + entry.Dir + "\x00" + entry.FileName
+}
+
+func (r *journalRecord) key() string {
+	return r.URL + "\x00" + r.Dir + "\x00" + r.FileName
+}
+
+// complete reports whether the record describes a file that was downloaded and is still
+// on disk with the recorded size, or was unpacked into a directory that still exists.
+func (r *journalRecord) complete() bool {
+	if r.State != JournalDone {
+		return false
+	}
+	if r.ExtractDir != "" {
+		if info, err := os.Stat(r.ExtractDir); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	info, err := os.Stat(r.Path)
+	return err == nil && info.Mode().IsRegular() && (r.Size < 0 || info.Size() == r.Size)
+}
+
+// Journal records the state of every download of a batch in a JournalFileName file in
+// the download directory, so a batch that was interrupted can be resumed. It is a
+// Renderer that saves the state as the events arrive, and removes the file once every
+// download is done. It is safe for concurrent use.
+type Journal struct {
+	path string
+	// interval is how often progress is saved.
+	interval time.Duration
+
+	mu      sync.Mutex
+	records []*journalRecord
+	tracked map[int]*journalRecord
+	saved   time.Time
+}
+
+// NewJournal returns an empty journal for the download directory, replacing the
+// journal of an earlier batch once it is saved.
+func NewJournal(directory string) *Journal {
+	return &Journal{
+		path:     filepath.Join(directory, JournalFileName),
+		interval: JournalSaveInterval,
+		tracked:  make(map[int]*journalRecord),
+	}
+}
+
+// LoadJournal reads the journal of the download directory. It returns ErrNoJournal
+// when there is none.
+func LoadJournal(directory string) (*Journal, error) {
+	j := NewJournal(directory)
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoJournal
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if err := json.Unmarshal(data, &j.records); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %w", j.path, err)
+	}
+	return j, nil
+}
+
+// Entries returns the entries of the journaled batch. It fails when credentials of an
+// entry were left out of the journal; the batch must then be given again.
+func (j *Journal) Entries() ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]Entry, 0, len(j.records))
+	for i, record := range j.records {
+		if record.Credentials {
+			return nil, fmt.Errorf("journal entry %d: credentials of %s are not journaled, give the URLs or manifest again", i+1, record.URL)
+		}
+		entry, err := record.entry(0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("journal entry %d: %w", i+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Pending returns the entries whose downloads are not complete according to the
+// journal, dropping those whose file is still on disk with the recorded size.
+func (j *Journal) Pending(entries []Entry) []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	done := make(map[string]bool)
+	for _, record := range j.records {
+		if record.complete() {
+			done[record.key()] = true
+		}
+	}
+
+	pending := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !done[journalKey(entry)] {
+			pending = append(pending, entry)
+		}
+	}
+	return pending
+}
+
+// Track adds the downloads to the journal as pending, replacing their records from an
+// earlier run, and saves it. Records of downloads that are not tracked are kept, so the
+// completed files of an interrupted batch stay in the journal.
+func (j *Journal) Track(downloads []*FileDownload) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	existing := make(map[string]int, len(j.records))
+	for i, record := range j.records {
+		existing[record.key()] = i
+	}
+
+	for _, d := range downloads {
+		record := newJournalRecord(d.entry)
+		record.Path = d.FilePath
+		record.Updated = time.Now()
+		if i, ok := existing[record.key()]; ok {
+			j.records[i] = record
+		} else {
+			existing[record.key()] = len(j.records)
+			j.records = append(j.records, record)
+		}
+		j.tracked[d.index+1] = record
+	}
+	return j.save()
+}
+
+// Render records the events of the tracked downloads until the channel is closed.
+// Lifecycle events are saved right away, progress at most every JournalSaveInterval.
+func (j *Journal) Render(events <-chan Event) {
+	for event := range events {
+		j.record(event)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.finished() {
+		// Nothing is left to resume, so the batch leaves no journal behind.
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: failed to remove journal: %v", err)
+		}
+		return
+	}
+	j.saveOrWarn()
+}
+
+// finished reports whether every recorded download is done. Must be called with j.mu locked.
+func (j *Journal) finished() bool {
+	for _, record := range j.records {
+		if record.State != JournalDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (j *Journal) record(event Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	record := j.tracked[event.Index]
+	if record == nil {
+		return
+	}
+	if event.Path != "" {
+		record.Path = event.Path
+	}
+	if event.ExtractDir != "" {
+		record.ExtractDir = event.ExtractDir
+	}
+	record.Offset = event.Bytes
+	record.Size = event.Total
+	record.Updated = event.Time
+
+	switch event.Type {
+	case EventQueued:
+		record.State = JournalPending
+	case EventCompleted, EventUpToDate, EventSkipped:
+		record.State = JournalDone
+		record.Digest = event.Digest
+		record.Error = ""
+		if event.Type == EventSkipped {
+			// The existing file was kept, so its size is whatever it is on disk.
+			record.Size = -1
+		}
+	case EventFailed, EventCancelled:
+		record.State = JournalFailed
+		record.Error = event.Error
+	case EventPaused:
+		record.State = JournalPending
+	case EventProgress:
+		if record.State == JournalInProgress && event.Time.Sub(j.saved) < j.interval {
+			return
+		}
+		record.State = JournalInProgress
+	default:
+		record.State = JournalInProgress
+	}
+	j.saveOrWarn()
+}
+
+// saveOrWarn saves the journal, logging a failure instead of stopping the downloads.
+// Must be called with j.mu locked.
+func (j *Journal) saveOrWarn() {
+	if err := j.save(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// save atomically rewrites the journal file. Must be called with j.mu locked.
+func (j *Journal) save() error {
+	data, err := json.MarshalIndent(j.records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(j.path+PartSuffix, data, 0o600)
+	if err == nil {
+		err = os.Rename(j.path+PartSuffix, j.path)
+	}
+	if err != nil {
+		safeRemove(j.path + PartSuffix)
+		return fmt.Errorf("failed to save journal: %w", err)
+	}
+	j.saved = time.Now()
+	return nil
+}
@@ -0,0 +1,460 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Entry describes a single file to download, either from the command line or a manifest.
+type Entry struct {
+	URL string
+	// Mirrors lists alternative URLs for the same file, tried when URL fails.
+	Mirrors []string
+	// Dir is the destination directory, relative to the download directory unless absolute.
+	Dir string
+	// FileName overrides the file name taken from the URL.
+	FileName string
+	// Checksum is the expected digest in "algorithm=hex" form.
+	Checksum string
+	// Size is the expected size of the file in bytes, or 0 if it is not known.
+	Size int64
+	// Pieces holds the expected digests of the pieces of the file, so corrupted pieces
+	// are downloaded again on their own. It may be nil.
+	Pieces *Pieces
+	// Locations holds the country code of the server of URL and of every mirror, in
+	// that order, for preferring mirrors by Options.Locations. It may be nil.
+	Locations []string
+	Header    http.Header
+	// Auth authenticates the requests to the host of URL, overriding Options.Auth.
+	Auth *Credentials
+	// Priority orders the download queue; higher priorities start first.
+	Priority int
+	// RateLimit caps the download speed of this entry in bytes per second; 0 means no limit.
+	RateLimit int64
+	// Line is the manifest line the entry was read from, or 0 for command line entries.
+	Line int
+}
+
+// manifestEntry is the JSON representation of an Entry.
+type manifestEntry struct {
+	URL         string            `json:"url"`
+	Mirrors     []string          `json:"mirrors"`
+	Dir         string            `json:"dir"`
+	FileName    string            `json:"filename"`
+	Checksum    string            `json:"checksum"`
+	Size        int64             `json:"size"`
+	Pieces      *Pieces           `json:"pieces"`
+	Locations   []string          `json:"locations"`
+	Headers     map[string]string `json:"headers"`
+	User        string            `json:"user"`
+	BearerToken string            `json:"bearer_token"`
+	Priority    int               `json:"priority"`
+	RateLimit   string            `json:"rate_limit"`
+}
+
+// entry converts m to an Entry. lookupEnv, if set, resolves credentials that name an
+// environment variable; entries sent to the daemon keep them as written, so they cannot
+// read its environment.
+func (m manifestEntry) entry(line int, lookupEnv func(string) (string, bool)) (Entry, error) {
+	rateLimit, err := parseRateLimit(m.RateLimit)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	auth, err := parseEntryAuth(m.User, m.BearerToken, lookupEnv)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return Entry{
+		URL:       m.URL,
+		Mirrors:   m.Mirrors,
+		Dir:       m.Dir,
+		FileName:  m.FileName,
+		Checksum:  m.Checksum,
+		Size:      m.Size,
+		Pieces:    m.Pieces,
+		Locations: m.Locations,
+		Header:    headerFromMap(m.Headers),
+		Auth:      auth,
+		Priority:  m.Priority,
+		RateLimit: rateLimit,
+		Line:      line,
+	}, nil
+}
+
+// newManifestEntry returns the JSON representation of an entry.
+func newManifestEntry(entry Entry) manifestEntry {
+	m := manifestEntry{
+		URL:       entry.URL,
+		Mirrors:   entry.Mirrors,
+		Dir:       entry.Dir,
+		FileName:  entry.FileName,
+		Checksum:  entry.Checksum,
+		Size:      entry.Size,
+		Pieces:    entry.Pieces,
+		Locations: entry.Locations,
+		Priority:  entry.Priority,
+	}
+	if len(entry.Header) > 0 {
+		m.Headers = make(map[string]string, len(entry.Header))
+		for name, values := range entry.Header {
+			m.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	if entry.RateLimit > 0 {
+		m.RateLimit = strconv.FormatInt(entry.RateLimit, 10)
+	}
+	if auth := entry.Auth; auth != nil {
+		if auth.BearerToken != "" {
+			m.BearerToken = auth.BearerToken
+		} else {
+			m.User = auth.Username + ":" + auth.Password
+		}
+	}
+	return m
+}
+
+// EntriesFromURLs creates entries for URLs given on the command line.
+// Mirrors of a file are appended to its URL separated by "|".
+func EntriesFromURLs(urls []string) []Entry {
+	entries := make([]Entry, 0, len(urls))
+	for _, url := range urls {
+		url, mirrors, _ := strings.Cut(url, "|")
+		entry := Entry{URL: url}
+		if mirrors != "" {
+			entry.Mirrors = strings.Split(mirrors, "|")
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// LoadManifest reads download entries from a manifest file, or from standard input
+// when path is "-". The format is chosen by file extension: ".json" for a JSON array of
+// entries, ".csv" for CSV with a header row, ".meta4" or ".metalink" for a Metalink 4
+// file, and a plain list of URLs otherwise. A manifest without a known extension that
+// starts with "[" is read as JSON, and one that starts with "<" as Metalink.
+func LoadManifest(path string) ([]Entry, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return parseJSONManifest(data)
+	case ".csv":
+		return parseCSVManifest(data)
+	case ".meta4", ".metalink":
+		return parseMetalink(data)
+	}
+
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return parseJSONManifest(data)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return parseMetalink(data)
+	}
+	return parsePlainManifest(data)
+}
+
+// parsePlainManifest reads one URL per line, skipping blank lines and "#" comments.
+// Further URLs on the same line, separated by whitespace, are mirrors of the first.
+func parsePlainManifest(data []byte) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls := strings.Fields(line)
+		entries = append(entries, Entry{URL: urls[0], Mirrors: urls[1:], Line: lineNumber})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	return entries, nil
+}
+
+// parseJSONManifest reads a JSON array of entries, recording the line each entry starts on.
+func parseJSONManifest(data []byte) ([]Entry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON manifest: %w", err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("invalid JSON manifest: expected an array of entries")
+	}
+
+	var entries []Entry
+	for decoder.More() {
+		line := lineAt(data, decoder.InputOffset())
+
+		var m manifestEntry
+		err := decoder.Decode(&m)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid manifest entry: %w", line, err)
+		}
+
+		entry, err := m.entry(line, os.LookupEnv)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON manifest: %w", err)
+	}
+
+	return entries, nil
+}
+
+// lineAt returns the line number of the first non-whitespace byte at or after offset,
+// skipping the separating comma between array elements.
+func lineAt(data []byte, offset int64) int {
+	for offset < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[offset])) {
+		offset++
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// parseCSVManifest reads CSV with a header row naming the columns. The url column is
+// required; mirrors, dir, filename, checksum, headers, user, bearer_token, priority and
+// rate_limit are optional.
+// Mirrors are separated by whitespace, headers are written as "Name: value" pairs
+// separated by semicolons, and rate_limit as a size per second such as "500K".
+func parseCSVManifest(data []byte) ([]Entry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV manifest: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, errors.New("invalid CSV manifest: missing url column")
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV manifest: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		entry := Entry{
+			URL:      field(record, "url"),
+			Mirrors:  strings.Fields(field(record, "mirrors")),
+			Dir:      field(record, "dir"),
+			FileName: field(record, "filename"),
+			Checksum: field(record, "checksum"),
+			Line:     line,
+		}
+
+		entry.Header, err = parseHeaderList(field(record, "headers"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		entry.RateLimit, err = parseRateLimit(field(record, "rate_limit"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		entry.Auth, err = parseEntryAuth(field(record, "user"), field(record, "bearer_token"), os.LookupEnv)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if priority := field(record, "priority"); priority != "" {
+			entry.Priority, err = strconv.Atoi(priority)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid priority %q", line, priority)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// parseRateLimit parses an optional rate limit such as "500K" in bytes per second.
+func parseRateLimit(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	rate, err := ParseByteSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate limit: %w", err)
+	}
+	return rate, nil
+}
+
+// parseEntryAuth parses the optional "user" ("name:password") and "bearer_token" fields
+// of a manifest entry. A field written as "${NAME}" is replaced with the environment
+// variable NAME, looked up with lookupEnv if set, so manifests do not have to contain the
+// secrets themselves. Any other "$" is part of the value.
+func parseEntryAuth(user, bearerToken string, lookupEnv func(string) (string, bool)) (*Credentials, error) {
+	if lookupEnv != nil {
+		var err error
+		if user, err = envValue(user, lookupEnv); err != nil {
+			return nil, fmt.Errorf("user: %w", err)
+		}
+		if bearerToken, err = envValue(bearerToken, lookupEnv); err != nil {
+			return nil, fmt.Errorf("bearer_token: %w", err)
+		}
+	}
+	switch {
+	case user != "" && bearerToken != "":
+		return nil, errors.New("user and bearer_token cannot be used together")
+	case bearerToken != "":
+		return &Credentials{BearerToken: bearerToken}, nil
+	case user != "":
+		return ParseBasicAuth(user)
+	}
+	return nil, nil
+}
+
+// envValue returns the environment variable NAME if value is exactly "${NAME}", and
+// value itself otherwise. A variable that is not set is an error rather than an empty
+// credential.
+func envValue(value string, lookupEnv func(string) (string, bool)) (string, error) {
+	name, ok := strings.CutPrefix(value, "${")
+	if !ok {
+		return value, nil
+	}
+	name, ok = strings.CutSuffix(name, "}")
+	if !ok || name == "" || strings.ContainsFunc(name, func(r rune) bool {
+		return r != '_' && !('0' <= r && r <= '9') && !('A' <= r && r <= 'Z') && !('a' <= r && r <= 'z')
+	}) {
+		return value, nil
+	}
+	env, ok := lookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return env, nil
+}
+
+// parseHeaderList parses "Name: value" pairs separated by semicolons.
+func parseHeaderList(list string) (http.Header, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	header := http.Header{}
+	for _, pair := range strings.Split(list, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, err := parseHeader(pair)
+		if err != nil {
+			return nil, err
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+// ParseHeaders parses headers given as "Name: value", such as the values of repeated
+// command line flags. Repeated names keep all their values.
+func ParseHeaders(lines []string) (http.Header, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	header := http.Header{}
+	for _, line := range lines {
+		name, value, err := parseHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+// mergeHeaders returns base with the headers of override added, replacing the values
+// of headers present in both.
+func mergeHeaders(base, override http.Header) http.Header {
+	if len(base) == 0 {
+		return override.Clone()
+	}
+	header := base.Clone()
+	for name, values := range override {
+		header[name] = slices.Clone(values)
+	}
+	return header
+}
+
+// parseHeader parses a single "Name: value" header.
+func parseHeader(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		// Only the name is quoted: the value of a mistyped header may be a credential.
+		name, _, _ = strings.Cut(strings.TrimSpace(s), ":")
+		name, _, _ = strings.Cut(name, " ")
+		name, _, _ = strings.Cut(name, "\t")
+		return "", "", fmt.Errorf("invalid header %q: expected \"Name: value\"", name)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+func headerFromMap(m map[string]string) http.Header {
+	if len(m) == 0 {
+		return nil
+	}
+	header := make(http.Header, len(m))
+	for name, value := range m {
+		header.Set(name, value)
+	}
+	return header
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePlainManifest(t *testing.T) {
+	input := `# nightly artifacts
+https://example.com/a.tar.gz
+
+https://example.com/b,c.tar.gz
+https://example.com/d.iso	https://mirror.example.org/d.iso
+`
+	entries, err := parsePlainManifest([]byte(input))
+	if err != nil {
+		t.Fatalf("parsePlainManifest() error = %v", err)
+	}
+
+	want := []Entry{
+		{URL: "https://example.com/a.tar.gz", Line: 2},
+		{URL: "https://example.com/b,c.tar.gz", Line: 4},
+		{URL: "https://example.com/d.iso", Mirrors: []string{"https://mirror.example.org/d.iso"}, Line: 5},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("parsePlainManifest() returned %d entries, want %d", len(entries), len(want))
+	}
+	for i := range want {
+		if entries[i].URL != want[i].URL || entries[i].Line != want[i].Line || !slices.Equal(entries[i].Mirrors, want[i].Mirrors) {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestEntriesFromURLs(t *testing.T) {
+	entries := EntriesFromURLs([]string{"https://a.example.com/x.iso|https://b.example.com/x.iso|https://c.example.com/x.iso", "https://a.example.com/y.iso"})
+
+	if len(entries) != 2 {
+		t.Fatalf("EntriesFromURLs() returned %d entries, want 2", len(entries))
+	}
+	if entries[0].URL != "https://a.example.com/x.iso" ||
+		!slices.Equal(entries[0].Mirrors, []string{"https://b.example.com/x.iso", "https://c.example.com/x.iso"}) {
+		t.Errorf("entry 0 = %+v", entries[0])
+	}
+	if entries[1].URL != "https://a.example.com/y.iso" || entries[1].Mirrors != nil {
+		t.Errorf("entry 1 = %+v", entries[1])
+	}
+}
+
+func TestParseJSONManifest(t *testing.T) {
+	input := `[
+  {"url": "https://example.com/a.bin", "dir": "sub", "filename": "renamed.bin"},
+  {
+    "url": "https://example.com/b.bin",
+    "headers": {"X-Token": "abc"},
+    "priority": 5
+  }
+]`
+	entries, err := parseJSONManifest([]byte(input))
+	if err != nil {
+		t.Fatalf("parseJSONManifest() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("parseJSONManifest() returned %d entries, want 2", len(entries))
+	}
+
+	if entries[0].Line != 2 || entries[0].Dir != "sub" || entries[0].FileName != "renamed.bin" {
+		t.Errorf("entry 0 = %+v", entries[0])
+	}
+	if entries[1].Line != 3 || entries[1].Priority != 5 || entries[1].Header.Get("X-Token") != "abc" {
+		t.Errorf("entry 1 = %+v", entries[1])
+	}
+
+	_, err = parseJSONManifest([]byte(`[{"url": "x", "unknown": 1}]`))
+	if err == nil {
+		t.Error("parseJSONManifest() expected error for unknown field")
+	}
+}
+
+func TestParseCSVManifest(t *testing.T) {
+	input := `url,filename,headers,priority
+https://example.com/a.bin,first.bin,"Accept: */*; X-Token: abc",1
+# skipped
+"https://example.com/b,c.bin",,,
+`
+	entries, err := parseCSVManifest([]byte(input))
+	if err != nil {
+		t.Fatalf("parseCSVManifest() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("parseCSVManifest() returned %d entries, want 2", len(entries))
+	}
+
+	first := entries[0]
+	if first.Line != 2 || first.FileName != "first.bin" || first.Priority != 1 ||
+		first.Header.Get("X-Token") != "abc" || first.Header.Get("Accept") != "*/*" {
+		t.Errorf("entry 0 = %+v", first)
+	}
+	if entries[1].URL != "https://example.com/b,c.bin" || entries[1].Line != 4 {
+		t.Errorf("entry 1 = %+v", entries[1])
+	}
+
+	_, err = parseCSVManifest([]byte("filename\nx\n"))
+	if err == nil {
+		t.Error("parseCSVManifest() expected error for missing url column")
+	}
+}
+
+func TestParseEntryAuth(t *testing.T) {
+	t.Setenv("MANIFEST_TEST_TOKEN", "s3cret")
+
+	tests := []struct {
+		name        string
+		user        string
+		bearerToken string
+		want        Credentials
+		wantErr     bool
+	}{
+		{name: "dollar in password", user: "user:pa$$w0rd", want: Credentials{Username: "user", Password: "pa$$w0rd"}},
+		{name: "dollar in token", bearerToken: "tok$en", want: Credentials{BearerToken: "tok$en"}},
+		{name: "bare variable kept", bearerToken: "$MANIFEST_TEST_TOKEN", want: Credentials{BearerToken: "$MANIFEST_TEST_TOKEN"}},
+		{name: "variable", bearerToken: "${MANIFEST_TEST_TOKEN}", want: Credentials{BearerToken: "s3cret"}},
+		{name: "variable inside value kept", user: "user:${MANIFEST_TEST_TOKEN}x", want: Credentials{Username: "user", Password: "${MANIFEST_TEST_TOKEN}x"}},
+		{name: "unset variable", bearerToken: "${MANIFEST_TEST_UNSET}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEntryAuth(tt.user, tt.bearerToken, os.LookupEnv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEntryAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if *got != tt.want {
+				t.Errorf("parseEntryAuth() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareDownloadsManifestErrors(t *testing.T) {
+	entries := []Entry{
+		{URL: "https://example.com/ok.bin", Line: 1},
+		{URL: "ftp://example.com/bad.bin", Line: 7},
+	}
+
+	_, err := PrepareDownloads(entries, t.TempDir(), Options{})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 7:") {
+		t.Errorf("PrepareDownloads() error = %v, want error for line 7", err)
+	}
+}
+
+func TestPrepareDownloadsEntryOptions(t *testing.T) {
+	dir := t.TempDir()
+	entries := []Entry{
+		{URL: "https://example.com/low.bin"},
+		{URL: "https://example.com/high.bin", Dir: "nested", FileName: "custom.bin", Priority: 10},
+	}
+
+	downloads, err := PrepareDownloads(entries, dir, Options{})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+
+	if got, want := downloads[0].FilePath, filepath.Join(dir, "nested", "custom.bin"); got != want {
+		t.Errorf("first download path = %v, want %v", got, want)
+	}
+	if got, want := downloads[1].FilePath, filepath.Join(dir, "low.bin"); got != want {
+		t.Errorf("second download path = %v, want %v", got, want)
+	}
+
+	_, err = PrepareDownloads([]Entry{{URL: "https://example.com/x", FileName: "../x"}}, dir, Options{})
+	if err == nil {
+		t.Error("PrepareDownloads() expected error for file name with path separators")
+	}
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// metalinkNamespace is the XML namespace of Metalink 4 (RFC 5854).
+	metalinkNamespace = "urn:ietf:params:xml:ns:metalink"
+
+	// metalink3Namespace is the XML namespace of the older Metalink 3 format.
+	metalink3Namespace = "http://www.metalinker.org/"
+
+	// metalinkLowestPriority is the priority of a Metalink URL without one.
+	metalinkLowestPriority = 999999
+)
+
+// metalinkFile is a <file> element of a Metalink document.
+type metalinkFile struct {
+	Name   string           `xml:"name,attr"`
+	Size   int64            `xml:"size"`
+	Hashes []metalinkHash   `xml:"hash"`
+	Pieces []metalinkPieces `xml:"pieces"`
+	URLs   []metalinkURL    `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Type   string   `xml:"type,attr"`
+	Length int64    `xml:"length,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Location string `xml:"location,attr"`
+	Priority int    `xml:"priority,attr"`
+	URL      string `xml:",chardata"`
+}
+
+// parseMetalink reads the files of a Metalink 4 document (RFC 5854), recording the
+// line each <file> element starts on. The URLs of a file are ordered by priority, the
+// first becoming the URL of the entry and the others its mirrors; URLs with a scheme no
+// fetcher is registered for, such as ftp, are left out. Of several hashes, the strongest
+// supported one is kept.
+func parseMetalink(data []byte) ([]Entry, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var entries []Entry
+	depth := 0
+	root := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid Metalink file: %w", err)
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if token.Name.Space == metalink3Namespace {
+					return nil, errors.New("invalid Metalink file: Metalink 3 is not supported, only Metalink 4 (.meta4)")
+				}
+				if token.Name.Space != metalinkNamespace || token.Name.Local != "metalink" {
+					return nil, errors.New("invalid Metalink file: expected a metalink element")
+				}
+				root = true
+				continue
+			}
+			if depth != 2 || token.Name.Local != "file" {
+				continue
+			}
+
+			line, _ := decoder.InputPos()
+			var file metalinkFile
+			if err := decoder.DecodeElement(&file, &token); err != nil {
+				return nil, fmt.Errorf("line %d: invalid Metalink file element: %w", line, err)
+			}
+			depth--
+
+			entry, err := file.entry(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			entries = append(entries, entry)
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if !root {
+		return nil, errors.New("invalid Metalink file: expected a metalink element")
+	}
+	return entries, nil
+}
+
+// entry converts a <file> element to an Entry.
+func (m metalinkFile) entry(line int) (Entry, error) {
+	name := path.Clean(strings.TrimSpace(m.Name))
+	if m.Name == "" || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return Entry{}, fmt.Errorf("invalid Metalink file name %q", m.Name)
+	}
+
+	entry := Entry{FileName: path.Base(name), Size: m.Size, Line: line}
+	if dir := path.Dir(name); dir != "." {
+		entry.Dir = filepath.FromSlash(dir)
+	}
+
+	urls := slices.Clone(m.URLs)
+	for i := range urls {
+		if urls[i].Priority <= 0 {
+			urls[i].Priority = metalinkLowestPriority
+		}
+	}
+	slices.SortStableFunc(urls, func(a, b metalinkURL) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+	for _, u := range urls {
+		rawURL := strings.TrimSpace(u.URL)
+		if parsed, err := url.Parse(rawURL); err != nil || !supportedScheme(parsed.Scheme) {
+			continue
+		}
+		if entry.URL == "" {
+			entry.URL = rawURL
+		} else {
+			entry.Mirrors = append(entry.Mirrors, rawURL)
+		}
+		entry.Locations = append(entry.Locations, strings.ToLower(strings.TrimSpace(u.Location)))
+	}
+	if entry.URL == "" {
+		return Entry{}, fmt.Errorf("no supported URL for %s", name)
+	}
+
+	if hash, ok := strongest(m.Hashes, func(h metalinkHash) string { return h.Type }); ok {
+		checksum, err := newChecksum(hash.Type, hash.Value)
+		if err != nil {
+			return Entry{}, err
+		}
+		entry.Checksum = checksum.String()
+	}
+
+	if pieces, ok := strongest(m.Pieces, func(p metalinkPieces) string { return p.Type }); ok {
+		entry.Pieces = &Pieces{
+			Algorithm: normalizeAlgorithm(pieces.Type),
+			Length:    pieces.Length,
+			Hashes:    pieces.Hashes,
+		}
+		if _, err := entry.Pieces.digests(entry.Size); err != nil {
+			return Entry{}, err
+		}
+	}
+
+	return entry, nil
+}
+
+// supportedScheme reports whether a fetcher is registered for a URL scheme.
+func supportedScheme(scheme string) bool {
+	_, ok := LookupFetcher(scheme)
+	return ok
+}
+
+// strongest returns the element whose algorithm comes first in hashPreference, or false
+// when none uses a supported algorithm.
+func strongest[T any](elements []T, algorithm func(T) string) (T, bool) {
+	best, bestRank := -1, len(hashPreference)
+	for i, element := range elements {
+		rank := slices.Index(hashPreference, normalizeAlgorithm(algorithm(element)))
+		if rank >= 0 && rank < bestRank {
+			best, bestRank = i, rank
+		}
+	}
+	if best < 0 {
+		var zero T
+		return zero, false
+	}
+	return elements[best], true
+}
+
+// preferLocations orders sources so those whose location comes first in preferred are
+// tried first, keeping the order of sources with the same rank. locations holds the
+// location of every source, in the same order.
+func preferLocations(sources, locations, preferred []string) []string {
+	if len(preferred) == 0 || len(locations) != len(sources) {
+		return sources
+	}
+
+	rank := func(i int) int {
+		for r, location := range preferred {
+			if strings.EqualFold(location, locations[i]) {
+				return r
+			}
+		}
+		return len(preferred)
+	}
+
+	order := make([]int, len(sources))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+
+	sorted := make([]string, len(sources))
+	for i, j := range order {
+		sorted[i] = sources[j]
+	}
+	return sorted
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseMetalink(t *testing.T) {
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <published>2024-05-01T12:00:00Z</published>
+  <file name="ubuntu.iso">
+    <size>2000</size>
+    <hash type="md5">d41d8cd98f00b204e9800998ecf8427e</hash>
+    <hash type="sha-256">e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855</hash>
+    <pieces length="1024" type="sha-256">
+      <hash>e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855</hash>
+      <hash>e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855</hash>
+    </pieces>
+    <url location="us" priority="2">https://us.example.com/ubuntu.iso</url>
+    <url location="de" priority="1">https://de.example.com/ubuntu.iso</url>
+    <url priority="1">ftp://ftp.example.com/ubuntu.iso</url>
+    <url>https://fallback.example.com/ubuntu.iso</url>
+    <metaurl mediatype="torrent">https://example.com/ubuntu.iso.torrent</metaurl>
+  </file>
+  <file name="data/2024/readings.csv">
+    <url>https://example.com/readings.csv</url>
+  </file>
+</metalink>`
+
+	entries, err := parseMetalink([]byte(input))
+	if err != nil {
+		t.Fatalf("parseMetalink() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("parseMetalink() returned %d entries, want 2", len(entries))
+	}
+
+	iso := entries[0]
+	if iso.URL != "https://de.example.com/ubuntu.iso" ||
+		!slices.Equal(iso.Mirrors, []string{"https://us.example.com/ubuntu.iso", "https://fallback.example.com/ubuntu.iso"}) ||
+		!slices.Equal(iso.Locations, []string{"de", "us", ""}) {
+		t.Errorf("URLs = %s %v in %v, want by priority without ftp", iso.URL, iso.Mirrors, iso.Locations)
+	}
+	if iso.FileName != "ubuntu.iso" || iso.Dir != "" || iso.Size != 2000 || iso.Line != 4 {
+		t.Errorf("entry = %+v", iso)
+	}
+	if !strings.HasPrefix(iso.Checksum, "sha256=") {
+		t.Errorf("Checksum = %q, want the sha256 hash", iso.Checksum)
+	}
+	if iso.Pieces == nil || iso.Pieces.Algorithm != "sha256" || iso.Pieces.Length != 1024 || len(iso.Pieces.Hashes) != 2 {
+		t.Errorf("Pieces = %+v", iso.Pieces)
+	}
+
+	csv := entries[1]
+	if csv.FileName != "readings.csv" || csv.Dir != "data/2024" || csv.Checksum != "" || csv.Pieces != nil {
+		t.Errorf("entry = %+v", csv)
+	}
+}
+
+func TestParseMetalinkErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{
+			name:    "metalink 3",
+			input:   `<metalink version="3.0" xmlns="http://www.metalinker.org/"><files/></metalink>`,
+			wantErr: "Metalink 3 is not supported",
+		},
+		{
+			name:    "not metalink",
+			input:   `<html><body/></html>`,
+			wantErr: "expected a metalink element",
+		},
+		{
+			name: "escaping name",
+			input: `<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="../passwd"><url>https://example.com/passwd</url></file>
+</metalink>`,
+			wantErr: `line 2: invalid Metalink file name "../passwd"`,
+		},
+		{
+			name: "no supported URL",
+			input: `<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.iso"><url>ftp://example.com/a.iso</url></file>
+</metalink>`,
+			wantErr: "no supported URL",
+		},
+		{
+			name: "pieces do not cover size",
+			input: `<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.iso">
+    <size>5000</size>
+    <pieces length="1024" type="sha-1"><hash>da39a3ee5e6b4b0d3255bfef95601890afd80709</hash></pieces>
+    <url>https://example.com/a.iso</url>
+  </file>
+</metalink>`,
+			wantErr: "do not cover 5000 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMetalink([]byte(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseMetalink() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPreferLocations(t *testing.T) {
+	sources := []string{"a", "b", "c", "d"}
+	locations := []string{"us", "de", "", "fr"}
+
+	got := preferLocations(sources, locations, []string{"FR", "de"})
+	if want := []string{"d", "b", "a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("preferLocations() = %v, want %v", got, want)
+	}
+	if got := preferLocations(sources, nil, []string{"de"}); !slices.Equal(got, sources) {
+		t.Errorf("preferLocations() without locations = %v, want %v", got, sources)
+	}
+}
+
+// piecesOf returns the sha256 pieces of content.
+func piecesOf(content []byte, length int) *Pieces {
+	pieces := &Pieces{Algorithm: "sha256", Length: int64(length)}
+	for start := 0; start < len(content); start += length {
+		sum := sha256.Sum256(content[start:min(start+length, len(content))])
+		pieces.Hashes = append(pieces.Hashes, hex.EncodeToString(sum[:]))
+	}
+	return pieces
+}
+
+// pieceServer serves content, with the byte at corruptAt flipped in whole-file
+// responses, and in range responses too when corruptRanges is set. It counts the
+// range requests.
+func pieceServer(t *testing.T, content []byte, corruptAt int, corruptRanges bool, ranges *atomic.Int32) *httptest.Server {
+	corrupted := bytes.Clone(content)
+	corrupted[corruptAt] ^= 0xff
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := corrupted
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+			if !corruptRanges {
+				data = content
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPieceRepair(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 950)
+	const pieceLength = 1000
+
+	t.Run("corrupted piece fetched again", func(t *testing.T) {
+		var ranges atomic.Int32
+		server := pieceServer(t, content, 3500, false, &ranges)
+
+		entry := Entry{URL: server.URL + "/file.bin", Size: int64(len(content)), Pieces: piecesOf(content, pieceLength)}
+		d := runDownload(t, entry, Options{Retry: RetryPolicy{MaxAttempts: 1}})
+
+		if err := d.Err(); err != nil {
+			t.Fatalf("download error = %v", err)
+		}
+		checkContent(t, d, content)
+		if got := ranges.Load(); got != 1 {
+			t.Errorf("%d range requests, want 1 for the corrupted piece", got)
+		}
+	})
+
+	t.Run("corrupted piece fetched from mirror", func(t *testing.T) {
+		var primaryRanges, mirrorRanges atomic.Int32
+		primary := pieceServer(t, content, 9499, true, &primaryRanges)
+		mirror := pieceServer(t, content, 0, false, &mirrorRanges)
+
+		sum := sha256.Sum256(content)
+		entry := Entry{
+			URL:      primary.URL + "/file.bin",
+			Mirrors:  []string{mirror.URL + "/file.bin"},
+			Checksum: "sha256=" + hex.EncodeToString(sum[:]),
+			Pieces:   piecesOf(content, pieceLength),
+		}
+		d := runDownload(t, entry, Options{Retry: RetryPolicy{MaxAttempts: 1}})
+
+		if err := d.Err(); err != nil {
+			t.Fatalf("download error = %v", err)
+		}
+		checkContent(t, d, content)
+		if primaryRanges.Load() != 0 || mirrorRanges.Load() != 1 {
+			t.Errorf("range requests: %d to the primary, %d to the mirror, want only one to the mirror", primaryRanges.Load(), mirrorRanges.Load())
+		}
+	})
+
+	t.Run("piece stays corrupted", func(t *testing.T) {
+		var ranges atomic.Int32
+		server := pieceServer(t, content, 5000, true, &ranges)
+
+		entry := Entry{URL: server.URL + "/file.bin", Pieces: piecesOf(content, pieceLength)}
+		d := runDownload(t, entry, Options{Retry: RetryPolicy{MaxAttempts: 1}, Resume: true})
+
+		var pieceErr *PieceError
+		if !errors.As(d.Err(), &pieceErr) || !slices.Equal(pieceErr.Pieces, []int{5}) {
+			t.Fatalf("download error = %v, want a PieceError for piece 5", d.Err())
+		}
+		if _, err := os.Stat(d.partPath()); !os.IsNotExist(err) {
+			t.Errorf("corrupted partial file was kept: %v", err)
+		}
+	})
+}
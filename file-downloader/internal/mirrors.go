@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MirrorProbeSize is the number of bytes fetched from every mirror to measure its speed.
+	MirrorProbeSize = 64 * 1024
+
+	// MirrorProbeTimeout bounds how long probing the mirrors of a download may take.
+	MirrorProbeTimeout = 5 * time.Second
+)
+
+// MirrorStrategy decides in which order the URLs of a download with mirrors are tried.
+type MirrorStrategy string
+
+const (
+	// MirrorOrder tries the URL first and the mirrors in the order they are listed.
+	MirrorOrder MirrorStrategy = "order"
+	// MirrorFastest downloads a small probe from every URL and tries the fastest first.
+	MirrorFastest MirrorStrategy = "fastest"
+)
+
+// ParseMirrorStrategy parses the name of a mirror selection strategy.
+func ParseMirrorStrategy(s string) (MirrorStrategy, error) {
+	switch strategy := MirrorStrategy(strings.ToLower(s)); strategy {
+	case MirrorOrder, MirrorFastest:
+		return strategy, nil
+	case "":
+		return MirrorOrder, nil
+	default:
+		return "", fmt.Errorf("invalid mirror strategy %q: expected order or fastest", s)
+	}
+}
+
+// MirrorError is the error of an attempt made from one of several mirrors.
+type MirrorError struct {
+	URL string
+	Err error
+}
+
+func (e *MirrorError) Error() string {
+	return fmt.Sprintf("mirror %s: %v", RedactURL(e.URL), e.Err)
+}
+
+func (e *MirrorError) Unwrap() error {
+	return e.Err
+}
+
+// Mirror returns the URL the file is currently downloaded from, which is either
+// URL or one of Mirrors.
+func (f *FileDownload) Mirror() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mirror()
+}
+
+// mirror returns the current source URL. Must be called with f.mu locked.
+func (f *FileDownload) mirror() string {
+	if len(f.sources) == 0 {
+		return f.URL
+	}
+	return f.sources[f.source]
+}
+
+// nextMirror switches to the next source URL, wrapping around after the last one.
+func (f *FileDownload) nextMirror() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sources) > 0 {
+		f.source = (f.source + 1) % len(f.sources)
+	}
+}
+
+// rankMirrors orders the source URLs by the speed of a small probe download, fastest
+// first. URLs that fail the probe keep their relative order after the others.
+func (f *FileDownload) rankMirrors(ctx context.Context) {
+	if len(f.sources) < 2 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MirrorProbeTimeout)
+	defer cancel()
+
+	speeds := make([]float64, len(f.sources))
+	var wg sync.WaitGroup
+	for i, source := range f.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			speed, err := f.probeMirror(ctx, source)
+			if err == nil {
+				speeds[i] = speed
+			}
+		}()
+	}
+	wg.Wait()
+
+	ranked := make([]int, len(f.sources))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	slices.SortStableFunc(ranked, func(a, b int) int {
+		return cmp.Compare(speeds[b], speeds[a])
+	})
+
+	sources := make([]string, len(f.sources))
+	for i, j := range ranked {
+		sources[i] = f.sources[j]
+	}
+
+	f.mu.Lock()
+	f.sources = sources
+	f.source = 0
+	f.mu.Unlock()
+}
+
+// probeMirror fetches the first MirrorProbeSize bytes from a URL and returns the speed
+// in bytes per second, including the time to connect and receive the response.
+func (f *FileDownload) probeMirror(ctx context.Context, source string) (float64, error) {
+	req := f.fetchRequest(source)
+	req.Length = MirrorProbeSize
+
+	fetcher, err := fetcherFor(source, f.opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var start time.Time
+	result, err := f.request(ctx, source, func() (*FetchResult, error) {
+		start = time.Now()
+		return fetcher.Fetch(ctx, req)
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer safeClose(result.Body)
+
+	n, err := io.Copy(io.Discard, io.LimitReader(result.Body, MirrorProbeSize))
+	if err != nil {
+		return 0, err
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
+
+// mirrorHost returns the host of a mirror URL for display.
+func mirrorHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Host
+}
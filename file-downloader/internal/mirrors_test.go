@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runDownload prepares and runs a single download to completion.
+func runDownload(t *testing.T, entry Entry, opts Options) *FileDownload {
+	t.Helper()
+	return runDownloadIn(t, t.TempDir(), entry, opts)
+}
+
+// runDownloadIn is runDownload for a download into dir.
+func runDownloadIn(t *testing.T, dir string, entry Entry, opts Options) *FileDownload {
+	t.Helper()
+
+	downloads, err := PrepareDownloads([]Entry{entry}, dir, opts)
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	var wg sync.WaitGroup
+	if err := d.Start(context.Background(), &wg); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for range d.LoadedBytes {
+	}
+	wg.Wait()
+
+	return d
+}
+
+func checkContent(t *testing.T, d *FileDownload, content []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(d.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded file does not match the source (%d bytes, want %d)", len(got), len(content))
+	}
+}
+
+func TestMirrorFailover(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	primary := httptest.NewServer(http.NotFoundHandler())
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer mirror.Close()
+
+	entry := Entry{URL: primary.URL + "/file.bin", Mirrors: []string{mirror.URL + "/file.bin"}}
+	d := runDownload(t, entry, Options{Retry: RetryPolicy{MaxAttempts: 1}})
+
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if got := d.Mirror(); got != mirror.URL+"/file.bin" {
+		t.Errorf("Mirror() = %q, want the mirror", got)
+	}
+	checkContent(t, d, content)
+}
+
+func TestMirrorSwitchContinuesPartialFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	tests := []struct {
+		name    string
+		primary http.HandlerFunc
+		opts    Options
+	}{
+		{
+			name: "connection dropped",
+			primary: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"primary"`)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				_, _ = w.Write(content[:4000])
+			},
+		},
+		{
+			name: "stalled",
+			primary: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"primary"`)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				_, _ = w.Write(content[:4000])
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			},
+			opts: Options{StallTimeout: 100 * time.Millisecond},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := httptest.NewServer(tt.primary)
+			defer primary.Close()
+
+			var gotRange, gotIfRange string
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRange, gotIfRange = r.Header.Get("Range"), r.Header.Get("If-Range")
+				w.Header().Set("ETag", `"mirror"`)
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+			}))
+			defer mirror.Close()
+
+			entry := Entry{URL: primary.URL + "/file.bin", Mirrors: []string{mirror.URL + "/file.bin"}}
+			d := runDownload(t, entry, tt.opts)
+
+			if err := d.Err(); err != nil {
+				t.Fatalf("download error = %v", err)
+			}
+			if gotRange != "bytes=4000-" || gotIfRange != "" {
+				t.Errorf("mirror request Range = %q, If-Range = %q, want %q without If-Range", gotRange, gotIfRange, "bytes=4000-")
+			}
+			checkContent(t, d, content)
+		})
+	}
+}
+
+func TestRankMirrors(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), MirrorProbeSize)
+	serve := func(delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+		}))
+	}
+
+	slow := serve(200 * time.Millisecond)
+	defer slow.Close()
+	fast := serve(0)
+	defer fast.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	entry := Entry{URL: broken.URL + "/file.bin", Mirrors: []string{slow.URL + "/file.bin", fast.URL + "/file.bin"}}
+	downloads, err := PrepareDownloads([]Entry{entry}, t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	d.rankMirrors(context.Background())
+
+	want := []string{fast.URL + "/file.bin", slow.URL + "/file.bin", broken.URL + "/file.bin"}
+	for i := range want {
+		if d.sources[i] != want[i] {
+			t.Fatalf("ranked mirrors = %v, want %v", d.sources, want)
+		}
+	}
+}
+
+func TestPartialMismatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		result    FetchResult
+		validator string
+		want      bool
+	}{
+		{name: "validated range", result: FetchResult{Offset: 10, Size: 50}, validator: `"v1"`, want: false},
+		{name: "same size on other mirror", result: FetchResult{Offset: 10, Size: 100}, want: false},
+		{name: "different size on other mirror", result: FetchResult{Offset: 10, Size: 120}, want: true},
+		{name: "whole file", result: FetchResult{Offset: 0, Size: 120}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partialMismatch(&tt.result, tt.validator, 100); got != tt.want {
+				t.Errorf("partialMismatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
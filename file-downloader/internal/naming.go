@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ConflictPolicy decides what happens when a download's target file already exists
+// or is used by another download in the same batch.
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite replaces existing files. Two downloads of one batch
+	// targeting the same path are still rejected.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip leaves existing files alone and skips the download.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictRename saves the download under a numbered name such as "file-1.txt".
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictFail rejects the batch, or fails the download when the conflict
+	// only becomes known from the server's response.
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// errSkipped is returned by a download that was skipped because its file already exists.
+var errSkipped = errors.New("skipped: file already exists")
+
+// ParseConflictPolicy parses the name of a conflict policy.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(s)); policy {
+	case ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail:
+		return policy, nil
+	case "":
+		return ConflictOverwrite, nil
+	default:
+		return "", fmt.Errorf("invalid conflict policy %q: expected overwrite, skip, rename or fail", s)
+	}
+}
+
+// pathClaims records the target paths used by a batch so that no two downloads
+// write the same file, including names only learned from Content-Disposition.
+type pathClaims struct {
+	mu    sync.Mutex
+	paths map[string]*FileDownload
+}
+
+func newPathClaims() *pathClaims {
+	return &pathClaims{paths: make(map[string]*FileDownload)}
+}
+
+// resolve picks the target path of a download at prepare time according to the policy.
+// It returns errSkipped when the download should not run.
+func (c *pathClaims) resolve(f *FileDownload, policy ConflictPolicy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := f.FilePath
+	if other, ok := c.paths[path]; ok {
+		switch policy {
+		case ConflictRename:
+			path = c.nextFreePath(path)
+		case ConflictSkip:
+			return errSkipped
+		default:
+			return fmt.Errorf("duplicate target path %s, also used by %s", path, RedactURL(other.URL))
+		}
+	}
+
+	if fileExists(path) {
+		switch policy {
+		case ConflictRename:
+			path = c.nextFreePath(path)
+		case ConflictSkip:
+			return errSkipped
+		case ConflictFail:
+			return fmt.Errorf("file already exists: %s", path)
+		}
+	}
+
+	f.FilePath = path
+	c.paths[path] = f
+	return nil
+}
+
+// rename moves a download to a file name learned from the response.
+// A name used by another download of the batch is ignored, keeping the current name.
+func (c *pathClaims) rename(f *FileDownload, name string, policy ConflictPolicy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := filepath.Join(filepath.Dir(f.FilePath), name)
+	if path == f.FilePath {
+		return nil
+	}
+	if other, ok := c.paths[path]; ok && other != f {
+		return nil
+	}
+
+	if fileExists(path) {
+		switch policy {
+		case ConflictRename:
+			path = c.nextFreePath(path)
+		case ConflictSkip:
+			return errSkipped
+		case ConflictFail:
+			return fmt.Errorf("file already exists: %s", path)
+		}
+	}
+
+	delete(c.paths, f.FilePath)
+	c.paths[path] = f
+	f.setFilePath(path)
+	return nil
+}
+
+// claimUnpacked picks the path a download unpacks a compressed file to by the rules of
+// its target path: a path used by another download of the batch is never replaced, and
+// an existing file is handled according to the policy. It returns errSkipped when the
+// file should not be unpacked.
+func (c *pathClaims) claimUnpacked(f *FileDownload, path string, policy ConflictPolicy) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if other, ok := c.paths[path]; ok {
+		if other == f {
+			// Claimed by an earlier attempt of the same download.
+			return path, nil
+		}
+		switch policy {
+		case ConflictRename:
+			path = c.nextFreePath(path)
+		case ConflictSkip:
+			return "", errSkipped
+		default:
+			return "", fmt.Errorf("cannot unpack to %s, also used by %s", path, RedactURL(other.URL))
+		}
+	}
+
+	if fileExists(path) {
+		switch policy {
+		case ConflictRename:
+			path = c.nextFreePath(path)
+		case ConflictSkip:
+			return "", errSkipped
+		case ConflictFail:
+			return "", fmt.Errorf("file already exists: %s", path)
+		}
+	}
+
+	c.paths[path] = f
+	return path, nil
+}
+
+// nextFreePath returns the first numbered variant of path that neither exists nor is
+// claimed, keeping the extension: "data.tar.gz" becomes "data-1.tar.gz".
+// Must be called with c.mu locked.
+func (c *pathClaims) nextFreePath(path string) string {
+	dir, name := filepath.Split(path)
+	base, ext := splitExt(name)
+
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+		if _, claimed := c.paths[candidate]; !claimed && !fileExists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// splitExt splits a file name into base and extension, treating compressed
+// tarballs such as ".tar.gz" as a single extension.
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if filepath.Ext(base) == ".tar" {
+		ext = ".tar" + ext
+		base = strings.TrimSuffix(base, ".tar")
+	}
+	if base == "" {
+		return name, ""
+	}
+	return base, ext
+}
+
+// fileExists reports whether a file or directory exists at path.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// contentDispositionFileName returns the sanitized file name from a Content-Disposition
+// header, or an empty string when the header has no usable name. RFC 5987 "filename*"
+// parameters take precedence over "filename".
+func contentDispositionFileName(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+
+	return sanitizeFileName(params["filename"])
+}
+
+// sanitizeFileName reduces a file name suggested by a server to a safe name inside the
+// download directory: directories are stripped so it cannot traverse paths, and
+// control characters and leading dots are removed.
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if validateFileName(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// useServerFileName renames the download's target to a sanitized name suggested by the
+// server, such as the Content-Disposition file name, unless the user chose the file name explicitly.
+func (f *FileDownload) useServerFileName(name string) error {
+	if name == "" || f.fixedName || f.claims == nil {
+		return nil
+	}
+	return f.claims.rename(f, name, f.opts.OnConflict)
+}
+
+// setFilePath sets the target path in a thread-safe manner.
+func (f *FileDownload) setFilePath(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.FilePath = path
+}
+
+// Path returns the target path in a thread-safe manner. FilePath changes during
+// the download when the server suggests a file name through Content-Disposition.
+func (f *FileDownload) Path() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.FilePath
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestContentDispositionFileName(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "quoted filename",
+			header: `attachment; filename="report.pdf"`,
+			want:   "report.pdf",
+		},
+		{
+			name:   "RFC 5987 filename takes precedence",
+			header: `attachment; filename="rates.txt"; filename*=UTF-8''%E2%82%AC%20rates.txt`,
+			want:   "€ rates.txt",
+		},
+		{
+			name:   "path traversal",
+			header: `attachment; filename="../../etc/passwd"`,
+			want:   "passwd",
+		},
+		{
+			name:   "windows path",
+			header: `attachment; filename="C:\\temp\\evil.exe"`,
+			want:   "evil.exe",
+		},
+		{
+			name:   "dot names",
+			header: `attachment; filename=".."`,
+			want:   "",
+		},
+		{
+			name:   "hidden file",
+			header: `attachment; filename=".bashrc"`,
+			want:   "bashrc",
+		},
+		{
+			name:   "no filename",
+			header: `inline`,
+			want:   "",
+		},
+		{
+			name:   "empty header",
+			header: "",
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentDispositionFileName(tt.header); got != tt.want {
+				t.Errorf("contentDispositionFileName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitExt(t *testing.T) {
+	tests := []struct {
+		name     string
+		wantBase string
+		wantExt  string
+	}{
+		{name: "file.txt", wantBase: "file", wantExt: ".txt"},
+		{name: "archive.tar.gz", wantBase: "archive", wantExt: ".tar.gz"},
+		{name: "README", wantBase: "README", wantExt: ""},
+		{name: ".profile", wantBase: ".profile", wantExt: ""},
+	}
+
+	for _, tt := range tests {
+		base, ext := splitExt(tt.name)
+		if base != tt.wantBase || ext != tt.wantExt {
+			t.Errorf("splitExt(%q) = %q, %q, want %q, %q", tt.name, base, ext, tt.wantBase, tt.wantExt)
+		}
+	}
+}
+
+func TestPrepareDownloadsConflicts(t *testing.T) {
+	urls := []string{"https://a.example.com/data.tar.gz", "https://b.example.com/data.tar.gz"}
+
+	tests := []struct {
+		name      string
+		policy    ConflictPolicy
+		existing  bool
+		wantErr   bool
+		wantNames []string
+		wantState []State
+	}{
+		{
+			name:    "duplicates fail by default",
+			policy:  ConflictOverwrite,
+			wantErr: true,
+		},
+		{
+			name:      "duplicates renamed",
+			policy:    ConflictRename,
+			wantNames: []string{"data.tar.gz", "data-1.tar.gz"},
+			wantState: []State{StateQueued, StateQueued},
+		},
+		{
+			name:      "existing file renamed",
+			policy:    ConflictRename,
+			existing:  true,
+			wantNames: []string{"data-1.tar.gz", "data-2.tar.gz"},
+			wantState: []State{StateQueued, StateQueued},
+		},
+		{
+			name:      "existing file skipped",
+			policy:    ConflictSkip,
+			existing:  true,
+			wantNames: []string{"data.tar.gz", "data.tar.gz"},
+			wantState: []State{StateSkipped, StateSkipped},
+		},
+		{
+			name:     "existing file fails",
+			policy:   ConflictFail,
+			existing: true,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.existing {
+				err := os.WriteFile(filepath.Join(dir, "data.tar.gz"), nil, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			downloads, err := PrepareDownloads(EntriesFromURLs(urls), dir, Options{OnConflict: tt.policy})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PrepareDownloads() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for i, d := range downloads {
+				if got := filepath.Base(d.FilePath); got != tt.wantNames[i] {
+					t.Errorf("download %d name = %v, want %v", i, got, tt.wantNames[i])
+				}
+				if got := d.State(); got != tt.wantState[i] {
+					t.Errorf("download %d state = %v, want %v", i, got, tt.wantState[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareKeepsURLNamesInDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, rawURL := range []string{"http://example.com/..", "http://example.com/.", "http://example.com/a/%2e%2e"} {
+		downloads, err := PrepareDownloads([]Entry{{URL: rawURL}}, dir, Options{})
+		if err != nil {
+			t.Fatalf("PrepareDownloads(%s) error = %v", rawURL, err)
+		}
+		if got, want := downloads[0].Path(), filepath.Join(dir, "download"); got != want {
+			t.Errorf("path of %s = %s, want %s", rawURL, got, want)
+		}
+	}
+}
+
+func TestContentDispositionRename(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="report-2024.csv"`)
+		_, _ = w.Write([]byte("a,b\n"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	downloads, err := PrepareDownloads(EntriesFromURLs([]string{server.URL + "/export?id=1"}), dir, Options{})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	var wg sync.WaitGroup
+	err = d.Start(context.Background(), &wg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for range d.LoadedBytes {
+	}
+	wg.Wait()
+
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	want := filepath.Join(dir, "report-2024.csv")
+	if d.Path() != want {
+		t.Errorf("Path() = %v, want %v", d.Path(), want)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("downloaded file not found: %v", err)
+	}
+}
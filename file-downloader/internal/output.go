@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// PlainProgressInterval is the minimum time between two progress lines for one
+// download in plain output, keeping logs short for long downloads.
+const PlainProgressInterval = 10 * time.Second
+
+// ProgressMode selects how progress is reported.
+type ProgressMode string
+
+const (
+	// ProgressAuto draws progress bars on a terminal and plain lines otherwise.
+	ProgressAuto ProgressMode = "auto"
+	// ProgressANSI draws progress bars that are redrawn in place.
+	ProgressANSI ProgressMode = "ansi"
+	// ProgressPlain writes a log line per event, suitable for CI logs.
+	ProgressPlain ProgressMode = "plain"
+	// ProgressJSON writes every event as a line of JSON.
+	ProgressJSON ProgressMode = "json"
+	// ProgressNone reports nothing.
+	ProgressNone ProgressMode = "none"
+)
+
+// ParseProgressMode parses the name of a progress mode.
+func ParseProgressMode(s string) (ProgressMode, error) {
+	switch mode := ProgressMode(strings.ToLower(s)); mode {
+	case ProgressAuto, ProgressANSI, ProgressPlain, ProgressJSON, ProgressNone:
+		return mode, nil
+	case "":
+		return ProgressAuto, nil
+	default:
+		return "", fmt.Errorf("invalid progress mode %q: expected auto, ansi, plain, json or none", s)
+	}
+}
+
+// NewRenderer returns the renderer for mode writing to out, or nil for ProgressNone.
+// ProgressAuto uses progress bars only when out is a terminal.
+func NewRenderer(mode ProgressMode, out *os.File) Renderer {
+	if mode == ProgressAuto {
+		mode = ProgressPlain
+		if isTerminal(out) {
+			mode = ProgressANSI
+		}
+	}
+
+	switch mode {
+	case ProgressANSI:
+		return NewTerminalRenderer(out)
+	case ProgressPlain:
+		return NewPlainRenderer(out)
+	case ProgressJSON:
+		return NewJSONRenderer(out)
+	default:
+		return nil
+	}
+}
+
+// isTerminal reports whether the file is a character device such as a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// JSONRenderer writes every event as a line of JSON.
+type JSONRenderer struct {
+	encoder *json.Encoder
+}
+
+// NewJSONRenderer returns a renderer writing newline-delimited JSON events to w.
+func NewJSONRenderer(w io.Writer) *JSONRenderer {
+	return &JSONRenderer{encoder: json.NewEncoder(w)}
+}
+
+// Render writes the events until the channel is closed.
+func (r *JSONRenderer) Render(events <-chan Event) {
+	for event := range events {
+		_ = r.encoder.Encode(event)
+	}
+}
+
+// PlainRenderer writes a timestamped line for every lifecycle event and a progress
+// line per download at most every PlainProgressInterval, without escape sequences.
+// A download that stalls is logged right away.
+type PlainRenderer struct {
+	w            io.Writer
+	lastProgress map[int]time.Time
+	stalled      map[int]bool
+}
+
+// NewPlainRenderer returns a renderer writing log lines to w.
+func NewPlainRenderer(w io.Writer) *PlainRenderer {
+	return &PlainRenderer{w: w, lastProgress: make(map[int]time.Time), stalled: make(map[int]bool)}
+}
+
+// Render writes the events until the channel is closed.
+func (r *PlainRenderer) Render(events <-chan Event) {
+	for event := range events {
+		line := r.format(event)
+		if line != "" {
+			fmt.Fprintf(r.w, "%s [%d] %s\n", event.Time.Format(time.TimeOnly), event.Index, line)
+		}
+	}
+}
+
+// format returns the log line for an event, or an empty string if it is not logged.
+func (r *PlainRenderer) format(event Event) string {
+	switch event.Type {
+	case EventStarted:
+		r.lastProgress[event.Index] = event.Time
+		return fmt.Sprintf("Started %s", event.URL)
+	case EventProgress:
+		wasStalled := r.stalled[event.Index]
+		r.stalled[event.Index] = event.Stalled
+		if event.Stalled && !wasStalled {
+			r.lastProgress[event.Index] = event.Time
+			return fmt.Sprintf("Stalled at %s, no data received", formatBytes(event.Bytes, event.Total))
+		}
+		if event.Time.Sub(r.lastProgress[event.Index]) < PlainProgressInterval || !event.RetryAt.IsZero() {
+			return ""
+		}
+		r.lastProgress[event.Index] = event.Time
+		if event.ExtractDir != "" {
+			return fmt.Sprintf("%s %s", StateExtracting, formatBytes(event.Extracted, event.Total))
+		}
+		line := fmt.Sprintf("%s at %s", formatBytes(event.Bytes, event.Total), formatSpeed(event.Speed))
+		if event.Mirror != "" {
+			line += " from " + mirrorHost(event.Mirror)
+		}
+		return line
+	case EventMirror:
+		return fmt.Sprintf("%s; switching to %s", event.Error, event.Mirror)
+	case EventRetry:
+		return fmt.Sprintf("Attempt %d/%d failed: %s; retrying in %s",
+			event.Attempt, event.MaxAttempts, event.Error, formatDuration(event.RetryAt.Sub(event.Time)))
+	case EventExtracting:
+		r.lastProgress[event.Index] = event.Time
+		return fmt.Sprintf("%s to %s", StateExtracting, event.ExtractDir)
+	case EventCompleted:
+		line := fmt.Sprintf("%s %s: %s in %s, avg %s", StateDone, event.Path, formatBytes(event.Bytes, -1),
+			formatDuration(time.Duration(event.Elapsed*float64(time.Second))), formatSpeed(event.Speed))
+		if event.ExtractDir != "" {
+			line += ", extracted to " + event.ExtractDir
+		}
+		return line
+	case EventFailed:
+		return fmt.Sprintf("%s: %s", StateFailed, event.Error)
+	case EventSkipped:
+		return fmt.Sprintf("%s: %s already exists", StateSkipped, event.Path)
+	case EventUpToDate:
+		return fmt.Sprintf("%s: %s", StateUpToDate, event.Path)
+	case EventPaused:
+		return fmt.Sprintf("Paused at %s", formatBytes(event.Bytes, event.Total))
+	case EventCancelled:
+		return "Cancelled"
+	default:
+		return ""
+	}
+}
+
+// formatBytes formats the downloaded and total size, with a percentage when the total is known.
+func formatBytes(downloaded, total int64) string {
+	downloadedMB := float64(downloaded) / (1024 * 1024)
+	if total <= 0 {
+		return fmt.Sprintf("%.2f MB", downloadedMB)
+	}
+	return fmt.Sprintf("%.2f/%.2f MB (%.1f%%)", downloadedMB, float64(total)/(1024*1024),
+		float64(downloaded)/float64(total)*100)
+}
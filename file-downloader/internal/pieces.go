@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Pieces lists the expected digests of the consecutive pieces of a file, as published
+// in Metalink files. Every piece is Length bytes long except the last one, which may
+// be shorter.
+type Pieces struct {
+	// Algorithm is the name of the hash, such as sha256.
+	Algorithm string `json:"type"`
+	Length    int64  `json:"length"`
+	// Hashes holds the hex digest of every piece, in file order.
+	Hashes []string `json:"hashes"`
+}
+
+// errPieceCount is returned when the downloaded file is too short or too long for its pieces.
+var errPieceCount = errors.New("file size does not match the pieces")
+
+// PieceError is returned when pieces of a file still do not match their digests after
+// every source was asked to send them again.
+type PieceError struct {
+	// Pieces holds the indexes of the corrupted pieces.
+	Pieces []int
+	// Length is the length of every piece but the last.
+	Length int64
+	// Err is the last error fetching a piece again, if any.
+	Err error
+}
+
+func (e *PieceError) Error() string {
+	msg := fmt.Sprintf("piece checksum mismatch: %d corrupted piece(s), first at byte %d", len(e.Pieces), int64(e.Pieces[0])*e.Length)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *PieceError) Unwrap() error {
+	return e.Err
+}
+
+// pieceDigests are the validated digests of Pieces.
+type pieceDigests struct {
+	length  int64
+	digests []*Checksum
+}
+
+// digests validates the piece hashes. A positive size must be covered by the pieces exactly.
+func (p *Pieces) digests(size int64) (*pieceDigests, error) {
+	if p.Length <= 0 {
+		return nil, fmt.Errorf("invalid piece length %d", p.Length)
+	}
+	if len(p.Hashes) == 0 {
+		return nil, errors.New("invalid pieces: no piece hashes")
+	}
+	if size > 0 && int64(len(p.Hashes)) != (size+p.Length-1)/p.Length {
+		return nil, fmt.Errorf("invalid pieces: %d pieces of %d bytes do not cover %d bytes", len(p.Hashes), p.Length, size)
+	}
+
+	pieces := &pieceDigests{length: p.Length, digests: make([]*Checksum, len(p.Hashes))}
+	for i, hash := range p.Hashes {
+		checksum, err := newChecksum(p.Algorithm, hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash of piece %d: %w", i, err)
+		}
+		pieces.digests[i] = checksum
+	}
+	return pieces, nil
+}
+
+// span returns the offset and length of piece i of a file of size bytes.
+func (p *pieceDigests) span(i int, size int64) (int64, int64) {
+	start := int64(i) * p.length
+	return start, min(p.length, size-start)
+}
+
+// corrupted returns those of the pieces at indexes whose data in file does not match
+// their digests.
+func (p *pieceDigests) corrupted(file io.ReaderAt, size int64, indexes []int) ([]int, error) {
+	var bad []int
+	for _, i := range indexes {
+		start, length := p.span(i, size)
+		h := p.digests[i].newHash()
+		_, err := io.Copy(h, io.NewSectionReader(file, start, length))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash piece %d: %w", i, err)
+		}
+		if !bytes.Equal(h.Sum(nil), p.digests[i].Digest) {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
+
+// repairPieces checks the partial file piece by piece and downloads the pieces that do
+// not match their digests again, on their own. The current source sent the corrupted
+// data, so every round switches to the next mirror when there is one, and every source
+// gets one round. A file that is still corrupted after that is deleted. It reports
+// whether any piece was downloaded again.
+func (f *FileDownload) repairPieces(ctx context.Context) (bool, error) {
+	if f.pieces == nil {
+		return false, nil
+	}
+
+	file, err := os.OpenFile(f.partPath(), os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file for piece verification: %w", err)
+	}
+	repaired, err := f.repairPiecesIn(ctx, file)
+	if err == nil {
+		err = syncFile(file)
+	}
+	closeErr := file.Close()
+
+	var pieceErr *PieceError
+	if errors.As(err, &pieceErr) || errors.Is(err, errPieceCount) {
+		f.removePartial()
+	}
+	if err != nil {
+		return repaired, err
+	}
+	if closeErr != nil {
+		return repaired, fmt.Errorf("failed to close file: %w", closeErr)
+	}
+	return repaired, nil
+}
+
+func (f *FileDownload) repairPiecesIn(ctx context.Context, file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to check downloaded file: %w", err)
+	}
+	size := info.Size()
+	if pieces := int64(len(f.pieces.digests)); pieces != (size+f.pieces.length-1)/f.pieces.length {
+		return false, fmt.Errorf("%w: got %d bytes for %d pieces of %d bytes", errPieceCount, size, pieces, f.pieces.length)
+	}
+
+	all := make([]int, len(f.pieces.digests))
+	for i := range all {
+		all[i] = i
+	}
+	bad, err := f.pieces.corrupted(file, size, all)
+	if err != nil || len(bad) == 0 {
+		return false, err
+	}
+
+	var fetchErr error
+	for round := 0; round < len(f.sources) && len(bad) > 0; round++ {
+		if len(f.sources) > 1 {
+			f.nextMirror()
+			f.emit(EventMirror, &PieceError{Pieces: bad, Length: f.pieces.length})
+		}
+
+		for _, i := range bad {
+			_, length := f.pieces.span(i, size)
+			f.setDownloaded(f.Downloaded() - length)
+		}
+		for _, i := range bad {
+			err := f.fetchPiece(ctx, file, i, size)
+			if ctx.Err() != nil {
+				return true, ctx.Err()
+			}
+			if err != nil {
+				fetchErr = err
+			}
+		}
+
+		bad, err = f.pieces.corrupted(file, size, bad)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	if len(bad) > 0 {
+		return true, &PieceError{Pieces: bad, Length: f.pieces.length, Err: fetchErr}
+	}
+	return true, nil
+}
+
+// fetchPiece downloads piece i from the current source and writes it at its offset.
+func (f *FileDownload) fetchPiece(ctx context.Context, file *os.File, i int, size int64) error {
+	start, length := f.pieces.span(i, size)
+	result, err := f.fetch(ctx, start, length, "")
+	if err != nil {
+		return err
+	}
+	defer safeClose(result.Body)
+
+	if !result.Ranged || result.Offset != start {
+		return fmt.Errorf("source cannot send piece %d on its own: range requests are not supported", i)
+	}
+	return f.copyBody(ctx, io.NewOffsetWriter(file, start), io.LimitReader(result.Body, length))
+}
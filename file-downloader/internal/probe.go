@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+)
+
+// LocalState tells how the local copy of a probed file compares to the remote file.
+type LocalState string
+
+const (
+	// LocalMissing means there is no local copy.
+	LocalMissing LocalState = "missing"
+	// LocalUpToDate means the local copy matches the remote file.
+	LocalUpToDate LocalState = "up_to_date"
+	// LocalChanged means the remote file differs from the local copy.
+	LocalChanged LocalState = "changed"
+	// LocalUnknown means a local copy exists but cannot be compared.
+	LocalUnknown LocalState = "unknown"
+)
+
+// ProbeResult is the remote metadata of a download, as reported by Probe.
+type ProbeResult struct {
+	URL string `json:"url"`
+	// FinalURL is the URL the file is served from after redirects.
+	FinalURL string `json:"final_url"`
+	// Path is where the file would be saved, with the name suggested by the source.
+	Path string `json:"path"`
+	// Size is the size of the remote file, or -1 if it is unknown.
+	Size         int64      `json:"size"`
+	ContentType  string     `json:"content_type,omitempty"`
+	LastModified string     `json:"last_modified,omitempty"`
+	AcceptRanges bool       `json:"accept_ranges"`
+	Local        LocalState `json:"local"`
+	// Needed is the number of bytes the download still has to write to disk.
+	Needed int64  `json:"needed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProbeAll probes the downloads, at most limit at once or all at once for a limit of
+// zero or less, and returns their results in the order of downloads.
+func ProbeAll(ctx context.Context, downloads []*FileDownload, limit int) []ProbeResult {
+	if limit <= 0 {
+		limit = len(downloads)
+	}
+
+	results := make([]ProbeResult, len(downloads))
+	slots := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i, d := range downloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = d.Probe(ctx)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Probe asks the source for the metadata of the file without downloading it, and
+// compares it with the local copy of a previous run. Only the current mirror is asked.
+func (f *FileDownload) Probe(ctx context.Context) ProbeResult {
+	probe := ProbeResult{URL: RedactURL(f.URL), Path: f.FilePath, Size: -1}
+
+	result, err := f.stat(ctx)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+
+	probe.FinalURL = RedactURL(cmp.Or(result.URL, f.Mirror()))
+	if !f.fixedName && result.FileName != "" {
+		probe.Path = filepath.Join(filepath.Dir(f.FilePath), result.FileName)
+	}
+	probe.Size = result.Size
+	probe.ContentType = result.ContentType
+	probe.LastModified = result.LastModified
+	probe.AcceptRanges = result.AcceptRanges
+	probe.Local = f.localState(probe.Path, result)
+
+	switch {
+	case probe.Local == LocalUpToDate || result.Size < 0:
+	case f.canResume() && result.AcceptRanges:
+		// An interrupted download continues from its partial file.
+		var partial int64
+		if info, err := os.Stat(f.partPath()); err == nil {
+			partial = min(info.Size(), result.Size)
+		}
+		probe.Needed = result.Size - partial
+	default:
+		probe.Needed = result.Size
+	}
+	return probe
+}
+
+// localState compares the file at path with the remote file. The validators recorded
+// in the download cache decide when there is a record of the file; otherwise a file of
+// the same size that is not older than the remote file is taken to be up to date.
+func (f *FileDownload) localState(path string, result *FetchResult) LocalState {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return LocalMissing
+	}
+
+	if record := f.revalidation(); record != nil && filepath.Base(path) == record.FileName {
+		if record.Size == result.Size && ((record.ETag != "" && record.ETag == result.ETag) ||
+			(record.ETag == "" && record.LastModified != "" && record.LastModified == result.LastModified)) {
+			return LocalUpToDate
+		}
+		return LocalChanged
+	}
+
+	if result.Size >= 0 && info.Size() != result.Size {
+		return LocalChanged
+	}
+	modified, err := http.ParseTime(result.LastModified)
+	if err != nil || result.Size < 0 {
+		return LocalUnknown
+	}
+	if info.ModTime().Before(modified) {
+		return LocalChanged
+	}
+	return LocalUpToDate
+}
+
+// ProbedSpace returns the bytes the probed downloads still have to write to each
+// directory, and the number of downloads whose size is unknown.
+func ProbedSpace(results []ProbeResult) (map[string]int64, int) {
+	needed := make(map[string]int64)
+	unknown := 0
+	for _, r := range results {
+		if r.Error != "" || r.Size < 0 {
+			unknown++
+			continue
+		}
+		needed[filepath.Dir(r.Path)] += r.Needed
+	}
+	return needed, unknown
+}
+
+// WriteProbeTable writes the probe results as a table, followed by the errors of the
+// files that could not be probed.
+func WriteProbeTable(w io.Writer, results []ProbeResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSIZE\tTYPE\tLAST MODIFIED\tRANGES\tLOCAL\tURL")
+	var failed []ProbeResult
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\terror\t%s\n", r.Path, r.URL)
+			failed = append(failed, r)
+			continue
+		}
+
+		size := "?"
+		if r.Size >= 0 {
+			size = formatBytes(r.Size, 0)
+		}
+		ranges := "no"
+		if r.AcceptRanges {
+			ranges = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Path, size, dash(r.ContentType), dash(r.LastModified), ranges, r.Local, r.FinalURL)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		fmt.Fprintln(w, "\nErrors:")
+	}
+	for _, r := range failed {
+		if _, err := fmt.Fprintf(w, "  %s: %s\n", r.Path, r.Error); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dash returns s, or "-" if s is empty.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// WriteProbeJSON writes the probe results as a JSON array.
+func WriteProbeJSON(w io.Writer, results []ProbeResult) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	content := bytes.Repeat([]byte("a,b,c\n"), 500)
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/v2/data", http.StatusFound)
+	})
+	mux.HandleFunc("/v2/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+		http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+	})
+	mux.HandleFunc("/no-head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", modified, bytes.NewReader(content))
+	})
+	mux.Handle("/missing", http.NotFoundHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir := t.TempDir()
+	downloads, err := PrepareDownloads([]Entry{
+		{URL: server.URL + "/latest"},
+		{URL: server.URL + "/no-head"},
+		{URL: server.URL + "/missing"},
+	}, dir, Options{Retry: RetryPolicy{MaxAttempts: 1}})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+
+	results := ProbeAll(context.Background(), downloads, 2)
+
+	redirected := results[0]
+	if redirected.Error != "" {
+		t.Fatalf("probe error = %s", redirected.Error)
+	}
+	if redirected.FinalURL != server.URL+"/v2/data" || redirected.Path != filepath.Join(dir, "report.csv") {
+		t.Errorf("probe = %s to %s, want the redirect target saved as report.csv", redirected.FinalURL, redirected.Path)
+	}
+	if redirected.Size != int64(len(content)) || redirected.ContentType != "text/csv" || !redirected.AcceptRanges ||
+		redirected.LastModified != modified.Format(http.TimeFormat) {
+		t.Errorf("probe = %+v", redirected)
+	}
+	if redirected.Local != LocalMissing || redirected.Needed != int64(len(content)) {
+		t.Errorf("local = %s needing %d bytes, want missing needing %d", redirected.Local, redirected.Needed, len(content))
+	}
+
+	if fallback := results[1]; fallback.Error != "" || fallback.Size != int64(len(content)) {
+		t.Errorf("probe without HEAD = %+v, want the size from a ranged GET", fallback)
+	}
+	if missing := results[2]; !strings.Contains(missing.Error, "404") {
+		t.Errorf("probe error = %q, want the 404 status", missing.Error)
+	}
+
+	needed, unknown := ProbedSpace(results)
+	if needed[dir] != 2*int64(len(content)) || unknown != 1 {
+		t.Errorf("ProbedSpace() = %v, %d", needed, unknown)
+	}
+
+	t.Run("local copy", func(t *testing.T) {
+		path := filepath.Join(dir, "report.csv")
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got := downloads[0].Probe(context.Background()); got.Local != LocalUpToDate || got.Needed != 0 {
+			t.Errorf("local = %s needing %d bytes, want up to date", got.Local, got.Needed)
+		}
+
+		if err := os.Chtimes(path, modified.Add(-time.Hour), modified.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if got := downloads[0].Probe(context.Background()); got.Local != LocalChanged {
+			t.Errorf("local = %s for an older copy, want changed", got.Local)
+		}
+	})
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := diskSpace(dir); err != nil {
+		t.Skipf("free disk space unavailable: %v", err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if shortages := CheckDiskSpace(map[string]int64{dir: 1}); len(shortages) != 0 {
+		t.Errorf("CheckDiskSpace() = %v for one byte", shortages)
+	}
+
+	shortages := CheckDiskSpace(map[string]int64{dir: math.MaxInt64 / 2, sub: math.MaxInt64 / 4})
+	if len(shortages) != 1 {
+		t.Fatalf("CheckDiskSpace() = %v, want one shortage for the shared file system", shortages)
+	}
+	if s := shortages[0]; s.Dir != dir || s.Needed != math.MaxInt64/2+math.MaxInt64/4 {
+		t.Errorf("shortage = %+v", s)
+	}
+}
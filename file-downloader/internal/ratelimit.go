@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that limits the combined throughput of every download
+// sharing it. Tokens are bytes and refill continuously at the configured rate.
+// A nil *RateLimiter does not limit anything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond on average,
+// or nil when bytesPerSecond is not positive.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	// A burst of one buffer keeps the rate smooth even for limits below the buffer size.
+	burst := float64(min(bytesPerSecond, DefaultBufferSize))
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes may be transferred or the context is cancelled.
+// Requests larger than the bucket reserve tokens in advance, so the bucket may go
+// negative and later callers wait for it to refill; this keeps the average rate exact
+// and serves concurrent callers in the order they asked.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle waits until n bytes fit within the global and the per-download limits.
+// Time spent waiting does not count towards the stall timeout.
+func (f *FileDownload) throttle(ctx context.Context, n int) error {
+	if f.opts.RateLimiter == nil && f.limiter == nil {
+		return nil
+	}
+	defer f.pauseStall()()
+
+	err := f.opts.RateLimiter.WaitN(ctx, n)
+	if err != nil {
+		return err
+	}
+	return f.limiter.WaitN(ctx, n)
+}
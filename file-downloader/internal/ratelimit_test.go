@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSharedAcrossCallers(t *testing.T) {
+	const rate = 1024 * 1024
+	limiter := NewRateLimiter(rate)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 4 {
+				if err := limiter.WaitN(context.Background(), DefaultBufferSize); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 16 chunks of 32 KiB minus the initial burst take about 0.47s at 1 MiB/s.
+	want := time.Duration(float64(15*DefaultBufferSize) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want-100*time.Millisecond {
+		t.Errorf("transfers took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.WaitN(ctx, DefaultBufferSize); err == nil {
+		t.Error("WaitN() expected error after context cancellation")
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var limiter *RateLimiter
+	if err := limiter.WaitN(context.Background(), 1<<30); err != nil {
+		t.Errorf("WaitN() on nil limiter error = %v", err)
+	}
+	if NewRateLimiter(0) != nil {
+		t.Error("NewRateLimiter(0) should return nil")
+	}
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportFormat is the file format of an end-of-run report.
+type ReportFormat string
+
+const (
+	// ReportJSON writes the report as a JSON object.
+	ReportJSON ReportFormat = "json"
+	// ReportJUnit writes the report as JUnit XML, with a test case per file.
+	ReportJUnit ReportFormat = "junit"
+)
+
+// ParseReportFormat parses the name of a report format. Without a name, the format
+// follows the extension of the report path: JUnit for ".xml", JSON otherwise.
+func ParseReportFormat(s, path string) (ReportFormat, error) {
+	switch format := ReportFormat(strings.ToLower(s)); format {
+	case ReportJSON, ReportJUnit:
+		return format, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".xml") {
+			return ReportJUnit, nil
+		}
+		return ReportJSON, nil
+	default:
+		return "", fmt.Errorf("invalid report format %q: expected json or junit", s)
+	}
+}
+
+// RunStatus is the outcome of a batch.
+type RunStatus string
+
+const (
+	// RunOK means every download completed, was up to date or was skipped.
+	RunOK RunStatus = "ok"
+	// RunFailed means at least one download failed.
+	RunFailed RunStatus = "failed"
+	// RunCancelled means the batch was cancelled before every download finished.
+	RunCancelled RunStatus = "cancelled"
+)
+
+// Report summarizes a batch once every download finished.
+type Report struct {
+	Status   RunStatus `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Duration is the time in seconds from the start of the batch to its end.
+	Duration float64      `json:"duration"`
+	Files    []ReportFile `json:"files"`
+}
+
+// ReportFile is the outcome of one download of a report.
+type ReportFile struct {
+	URL  string `json:"url"`
+	Path string `json:"path"`
+	// Status is the final event of the download: completed, up_to_date, skipped, failed
+	// or, for downloads stopped by cancelling the batch, cancelled.
+	Status EventType `json:"status"`
+	// Bytes is the number of bytes on disk, including bytes resumed from a previous run.
+	Bytes int64 `json:"bytes"`
+	// Duration is the time in seconds from the start of the download to its end.
+	Duration float64 `json:"duration"`
+	// Speed is the average speed in bytes per second of a completed download.
+	Speed    float64 `json:"speed"`
+	Attempts int     `json:"attempts"`
+	Digest   string  `json:"digest,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// ok reports whether the download ended without an error.
+func (f ReportFile) ok() bool {
+	return f.Status != EventFailed && f.Status != EventCancelled
+}
+
+// Reporter collects the final events of a batch for its Report. It is a Renderer
+// and safe for concurrent use.
+type Reporter struct {
+	downloads []*FileDownload
+	started   time.Time
+
+	mu     sync.Mutex
+	events map[int]Event
+}
+
+// NewReporter returns a reporter for the downloads of a batch starting now.
+func NewReporter(downloads []*FileDownload) *Reporter {
+	return &Reporter{
+		downloads: downloads,
+		started:   time.Now(),
+		events:    make(map[int]Event),
+	}
+}
+
+// Render records the final event of every download until the channel is closed.
+func (r *Reporter) Render(events <-chan Event) {
+	for event := range events {
+		if event.Type.Final() {
+			r.mu.Lock()
+			r.events[event.Index] = event
+			r.mu.Unlock()
+		}
+	}
+}
+
+// Report returns the report of the batch. It must be called after the downloads and
+// the renderers finished.
+func (r *Reporter) Report() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &Report{Status: RunOK, Started: r.started, Finished: time.Now(), Files: make([]ReportFile, 0, len(r.downloads))}
+	report.Duration = report.Finished.Sub(report.Started).Seconds()
+
+	for _, d := range r.downloads {
+		event, ok := r.events[d.index+1]
+		if !ok {
+			event = d.event(EventFailed, d.Err())
+		}
+
+		file := ReportFile{
+			URL:      event.URL,
+			Path:     event.Path,
+			Status:   event.Type,
+			Bytes:    event.Bytes,
+			Duration: event.Elapsed,
+			Speed:    event.Speed,
+			Attempts: event.Attempt,
+			Digest:   event.Digest,
+			Error:    event.Error,
+		}
+		if file.Status == EventFailed && errors.Is(d.Err(), context.Canceled) {
+			file.Status = EventCancelled
+		}
+
+		switch {
+		case file.Status == EventCancelled:
+			report.Status = RunCancelled
+		case !file.ok() && report.Status == RunOK:
+			report.Status = RunFailed
+		}
+		report.Files = append(report.Files, file)
+	}
+	return report
+}
+
+// WriteReport writes the report to path in the given format.
+func WriteReport(path string, format ReportFormat, report *Report) error {
+	var data []byte
+	var err error
+	if format == ReportJUnit {
+		data, err = xml.MarshalIndent(newJUnitReport(report), "", "  ")
+		data = append([]byte(xml.Header), data...)
+	} else {
+		data, err = json.MarshalIndent(report, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	err = os.WriteFile(path, append(data, '\n'), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// junitSuites is the root element of a JUnit XML report.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// newJUnitReport returns the report as a JUnit test suite with a test case per file.
+// Failed downloads are failures, cancelled ones errors and skipped ones skipped.
+func newJUnitReport(report *Report) *junitSuites {
+	suite := junitSuite{
+		Name:      "file-downloader",
+		Time:      junitTime(report.Duration),
+		Timestamp: report.Started.Format(time.RFC3339),
+	}
+
+	for _, file := range report.Files {
+		c := junitCase{
+			Name:      file.Path,
+			Classname: "file-downloader",
+			Time:      junitTime(file.Duration),
+			SystemOut: junitDetails(file),
+		}
+		switch file.Status {
+		case EventFailed:
+			c.Failure = &junitMessage{Message: file.Error, Type: string(file.Status), Text: file.Error}
+			suite.Failures++
+		case EventCancelled:
+			c.Error = &junitMessage{Message: "download cancelled", Type: string(file.Status), Text: file.Error}
+			suite.Errors++
+		case EventSkipped:
+			c.Skipped = &junitMessage{Message: "file exists"}
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Tests = len(suite.Cases)
+
+	return &junitSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+}
+
+// junitTime formats seconds for the time attributes of JUnit XML.
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// junitDetails returns the details of a file for the system-out of its test case.
+func junitDetails(file ReportFile) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "url: %s\n", file.URL)
+	fmt.Fprintf(&b, "status: %s\n", file.Status)
+	fmt.Fprintf(&b, "bytes: %d\n", file.Bytes)
+	fmt.Fprintf(&b, "speed: %.0f B/s\n", file.Speed)
+	fmt.Fprintf(&b, "attempts: %d\n", file.Attempts)
+	if file.Digest != "" {
+		fmt.Fprintf(&b, "digest: %s\n", file.Digest)
+	}
+	return b.String()
+}
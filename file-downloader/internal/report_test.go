@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runReportedBatch downloads entries into dir and returns the report of the batch.
+func runReportedBatch(t *testing.T, ctx context.Context, dir string, entries []Entry) *Report {
+	t.Helper()
+
+	downloads, err := PrepareDownloads(entries, dir, Options{Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	reporter := NewReporter(downloads)
+
+	var wg sync.WaitGroup
+	StartProgressListener(downloads, &wg, reporter)
+	if err := StartAll(ctx, downloads, 0, &wg); err != nil {
+		t.Fatalf("StartAll() error = %v", err)
+	}
+	wg.Wait()
+	return reporter.Report()
+}
+
+func TestReport(t *testing.T) {
+	content := []byte("hello report")
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.txt":
+			http.NotFound(w, r)
+		case "/slow.bin":
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			close(started)
+			<-r.Context().Done()
+		default:
+			http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	t.Run("failed", func(t *testing.T) {
+		dir := t.TempDir()
+		report := runReportedBatch(t, context.Background(), dir, EntriesFromURLs([]string{server.URL + "/ok.txt", server.URL + "/missing.txt"}))
+
+		if report.Status != RunFailed || len(report.Files) != 2 {
+			t.Fatalf("report = %+v, want failed with two files", report)
+		}
+		ok, missing := report.Files[0], report.Files[1]
+		if ok.Status != EventCompleted || ok.Path != filepath.Join(dir, "ok.txt") || ok.Bytes != int64(len(content)) || ok.Attempts != 1 || ok.Error != "" {
+			t.Errorf("ok.txt = %+v", ok)
+		}
+		if missing.Status != EventFailed || missing.Attempts != 1 || !strings.Contains(missing.Error, "404") {
+			t.Errorf("missing.txt = %+v, want a 404 failure without retries", missing)
+		}
+
+		path := filepath.Join(dir, "report.xml")
+		if err := WriteReport(path, ReportJUnit, report); err != nil {
+			t.Fatalf("WriteReport() error = %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var suites junitSuites
+		if err := xml.Unmarshal(data, &suites); err != nil {
+			t.Fatalf("invalid JUnit XML: %v\n%s", err, data)
+		}
+		if suites.Tests != 2 || suites.Failures != 1 || len(suites.Suites) != 1 {
+			t.Fatalf("JUnit report = %+v", suites)
+		}
+		cases := suites.Suites[0].Cases
+		if cases[0].Failure != nil || cases[1].Failure == nil || !strings.Contains(cases[1].Failure.Message, "404") {
+			t.Errorf("test cases = %+v, want only missing.txt failed", cases)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-started
+			cancel()
+		}()
+
+		dir := t.TempDir()
+		report := runReportedBatch(t, ctx, dir, EntriesFromURLs([]string{server.URL + "/slow.bin"}))
+		if report.Status != RunCancelled || report.Files[0].Status != EventCancelled {
+			t.Fatalf("report = %+v, want cancelled", report)
+		}
+
+		path := filepath.Join(dir, "report.json")
+		if err := WriteReport(path, ReportJSON, report); err != nil {
+			t.Fatalf("WriteReport() error = %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Report
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded.Status != RunCancelled || len(decoded.Files) != 1 {
+			t.Errorf("JSON report = %+v (%v)", decoded, err)
+		}
+	})
+}
+
+func TestParseReportFormat(t *testing.T) {
+	tests := []struct {
+		format, path string
+		want         ReportFormat
+	}{
+		{"", "report.json", ReportJSON},
+		{"", "results/downloads.XML", ReportJUnit},
+		{"json", "report.xml", ReportJSON},
+		{"JUnit", "report.txt", ReportJUnit},
+	}
+	for _, tt := range tests {
+		if got, err := ParseReportFormat(tt.format, tt.path); err != nil || got != tt.want {
+			t.Errorf("ParseReportFormat(%q, %q) = %q, %v, want %q", tt.format, tt.path, got, err, tt.want)
+		}
+	}
+	if _, err := ParseReportFormat("yaml", "report.yaml"); err == nil {
+		t.Error("ParseReportFormat(yaml) succeeded, want an error")
+	}
+}
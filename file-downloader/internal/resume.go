@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PartSuffix is appended to FilePath for the file that receives data while downloading.
+	PartSuffix = ".part"
+
+	// metaSuffix is appended to the partial file path for its resume metadata.
+	metaSuffix = ".meta"
+)
+
+// partialMeta is persisted next to a partial file so a later run can verify
+// that the remote file did not change before continuing from the partial data.
+type partialMeta struct {
+	URL string `json:"url"`
+	// Source is the mirror the validators were received from, if it is not URL.
+	Source       string `json:"source,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	TotalBytes   int64  `json:"total_bytes"`
+	// FileName is the name suggested by the server, applied again when resuming.
+	FileName string `json:"file_name,omitempty"`
+
+	// Segments is set when the partial file was written by a segmented download,
+	// in which case the file has holes and only the recorded ranges are valid.
+	Segments []segment `json:"segments,omitempty"`
+}
+
+// validator returns the value to send in If-Range, preferring a strong ETag.
+// Weak ETags are not allowed in If-Range, so Last-Modified is used instead.
+func (m *partialMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// source returns the URL the validators were received from.
+func (m *partialMeta) source() string {
+	if m.Source != "" {
+		return m.Source
+	}
+	return m.URL
+}
+
+// newPartialMeta builds the resume metadata for the download of url from a fetch
+// result received from source, which is url itself or one of its mirrors.
+func newPartialMeta(url, source string, result *FetchResult) *partialMeta {
+	meta := &partialMeta{
+		URL:          url,
+		ETag:         result.ETag,
+		LastModified: result.LastModified,
+		TotalBytes:   result.Size,
+		FileName:     result.FileName,
+	}
+	if source != url {
+		meta.Source = source
+	}
+	return meta
+}
+
+// partPath returns the path of the partial file. It is based on the path chosen when
+// the download was prepared, so it stays the same when Content-Disposition renames the target.
+func (f *FileDownload) partPath() string {
+	return f.partBase + PartSuffix
+}
+
+func (f *FileDownload) metaPath() string {
+	return f.partPath() + metaSuffix
+}
+
+// resumePoint returns the offset to continue from, the If-Range validator to send and
+// the expected size of the file. It returns a zero offset when resuming is disabled or
+// the partial file cannot be trusted.
+// Validators are not comparable across mirrors, so a partial file started from another
+// mirror is continued without a validator when the size of the file is known.
+func (f *FileDownload) resumePoint() (int64, string, int64) {
+	if !f.canResume() {
+		return 0, "", 0
+	}
+
+	info, err := os.Stat(f.partPath())
+	if err != nil || info.Size() == 0 {
+		return 0, "", 0
+	}
+
+	meta, err := loadPartialMeta(f.metaPath())
+	if err != nil || meta.URL != f.URL || len(meta.Segments) > 0 {
+		return 0, "", 0
+	}
+
+	if meta.TotalBytes > 0 && info.Size() > meta.TotalBytes {
+		return 0, "", 0
+	}
+
+	if meta.source() != f.Mirror() {
+		if meta.TotalBytes <= 0 {
+			return 0, "", 0
+		}
+		return info.Size(), "", meta.TotalBytes
+	}
+
+	validator := meta.validator()
+	if validator == "" {
+		return 0, "", 0
+	}
+
+	return info.Size(), validator, meta.TotalBytes
+}
+
+// partialMismatch reports whether a fetch continuing the partial file without validator,
+// because it was started from another mirror, found a file of a different size.
+func partialMismatch(result *FetchResult, validator string, expectedTotal int64) bool {
+	return validator == "" && result.Offset > 0 && result.Size != expectedTotal
+}
+
+// canResume reports whether an existing partial file may be continued. Partial files
+// from earlier runs are only used in resume mode, while retries and mirror switches
+// always continue the data written by the previous attempt.
+func (f *FileDownload) canResume() bool {
+	return f.opts.Resume || f.tries > 1
+}
+
+// removePartial deletes the partial file and its metadata.
+func (f *FileDownload) removePartial() {
+	safeRemove(f.partPath())
+	safeRemove(f.metaPath())
+}
+
+func loadPartialMeta(path string) (*partialMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta partialMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid resume metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func savePartialMeta(path string, meta *partialMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes start-end/total".
+// The total is -1 when the server reports it as unknown ("*").
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	startStr, endStr, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	start, err = strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range start: %w", err)
+	}
+	end, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range end: %w", err)
+	}
+	if end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	total = -1
+	if totalPart != "*" {
+		total, err = strconv.ParseInt(totalPart, 10, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range total: %w", err)
+		}
+	}
+
+	return start, end, total, nil
+}
+
+// CleanupPartials removes partial files left behind by earlier runs that crashed or
+// were killed, in every directory the downloads write to. Only partial files that have
+// resume metadata are considered, so unrelated ".part" files are never touched.
+// Metadata without its partial file is always removed; partial files themselves are
+// kept when keepResumable is set so they can be continued. It returns the number of
+// partial files removed.
+func CleanupPartials(downloads []*FileDownload, keepResumable bool) (int, error) {
+	dirs := make(map[string]bool)
+	for _, d := range downloads {
+		dirs[filepath.Dir(d.partPath())] = true
+	}
+
+	removed := 0
+	for dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, fmt.Errorf("failed to read directory: %w", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), PartSuffix+metaSuffix) {
+				continue
+			}
+
+			metaPath := filepath.Join(dir, entry.Name())
+			partPath := strings.TrimSuffix(metaPath, metaSuffix)
+			if !fileExists(partPath) {
+				safeRemove(metaPath)
+				continue
+			}
+			if keepResumable {
+				continue
+			}
+
+			err := os.Remove(partPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return removed, fmt.Errorf("failed to remove partial file: %w", err)
+			}
+			safeRemove(metaPath)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{
+			name:      "full range",
+			header:    "bytes 100-199/200",
+			wantStart: 100,
+			wantEnd:   199,
+			wantTotal: 200,
+		},
+		{
+			name:      "unknown total",
+			header:    "bytes 0-9/*",
+			wantStart: 0,
+			wantEnd:   9,
+			wantTotal: -1,
+		},
+		{
+			name:    "missing unit",
+			header:  "100-199/200",
+			wantErr: true,
+		},
+		{
+			name:    "unsatisfied range",
+			header:  "bytes */200",
+			wantErr: true,
+		},
+		{
+			name:    "end before start",
+			header:  "bytes 10-5/200",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseContentRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if start != tt.wantStart || end != tt.wantEnd || total != tt.wantTotal {
+				t.Errorf("parseContentRange() = %d, %d, %d, want %d, %d, %d",
+					start, end, total, tt.wantStart, tt.wantEnd, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestResumeFromPartialFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var gotRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.bin", modTime, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	downloads, err := PrepareDownloads(EntriesFromURLs([]string{server.URL + "/file.bin"}), dir, Options{Resume: true})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	err = os.WriteFile(d.partPath(), content[:4000], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = savePartialMeta(d.metaPath(), &partialMeta{URL: d.URL, ETag: `"v1"`, TotalBytes: int64(len(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	err = d.Start(context.Background(), &wg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for range d.LoadedBytes {
+	}
+	wg.Wait()
+
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if gotRange != "bytes=4000-" {
+		t.Errorf("Range header = %q, want %q", gotRange, "bytes=4000-")
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded file does not match the source (%d bytes, want %d)", len(got), len(content))
+	}
+	if _, err := os.Stat(d.partPath()); !os.IsNotExist(err) {
+		t.Errorf("partial file was not removed: %v", err)
+	}
+}
+
+func TestCleanupPartials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("stale.bin.part")
+	write("stale.bin.part.meta")
+	write("orphan.bin.part.meta")
+	write("unrelated.part")
+
+	downloads, err := PrepareDownloads(EntriesFromURLs([]string{"https://example.com/new.bin"}), dir, Options{})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+
+	removed, err := CleanupPartials(downloads, true)
+	if err != nil {
+		t.Fatalf("CleanupPartials() error = %v", err)
+	}
+	if removed != 0 || !fileExists(filepath.Join(dir, "stale.bin.part")) {
+		t.Errorf("CleanupPartials() removed resumable partial file")
+	}
+	if fileExists(filepath.Join(dir, "orphan.bin.part.meta")) {
+		t.Errorf("CleanupPartials() kept orphaned metadata")
+	}
+
+	removed, err = CleanupPartials(downloads, false)
+	if err != nil {
+		t.Fatalf("CleanupPartials() error = %v", err)
+	}
+	if removed != 1 || fileExists(filepath.Join(dir, "stale.bin.part")) || fileExists(filepath.Join(dir, "stale.bin.part.meta")) {
+		t.Errorf("CleanupPartials() removed %d files, want the stale partial file and its metadata", removed)
+	}
+	if !fileExists(filepath.Join(dir, "unrelated.part")) {
+		t.Errorf("CleanupPartials() removed a partial file without metadata")
+	}
+}
+
+func TestFailedDownloadRemovesPartialFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("truncated"))
+	}))
+	defer server.Close()
+
+	for _, resume := range []bool{false, true} {
+		downloads, err := PrepareDownloads(EntriesFromURLs([]string{server.URL + "/file.bin"}), t.TempDir(), Options{Resume: resume})
+		if err != nil {
+			t.Fatalf("PrepareDownloads() error = %v", err)
+		}
+		d := downloads[0]
+
+		var wg sync.WaitGroup
+		if err := d.Start(context.Background(), &wg); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		for range d.LoadedBytes {
+		}
+		wg.Wait()
+
+		if d.Err() == nil {
+			t.Fatal("expected truncated download to fail")
+		}
+		if fileExists(d.FilePath) {
+			t.Errorf("resume=%v: truncated download was moved into place", resume)
+		}
+		if got := fileExists(d.partPath()); got != resume {
+			t.Errorf("resume=%v: partial file exists = %v, want %v", resume, got, resume)
+		}
+	}
+}
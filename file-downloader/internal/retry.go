@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MaxRetryAfter caps the wait a Retry-After header may ask for before a retry, unless
+// MaxDelay is longer, so a server cannot hold a download and its slot for days.
+const MaxRetryAfter = 5 * time.Minute
+
+// RetryPolicy controls how failed downloads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Values below 1 are treated as 1.
+	MaxAttempts int
+
+	// BaseDelay is the wait before the first retry. It doubles with every attempt.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the exponential backoff; zero or less leaves it uncapped. A
+	// Retry-After header from the server is honored even when it is longer, up to
+	// MaxRetryAfter.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of the delay, between 0 and 1, that is randomly
+	// subtracted so that downloads failing together do not retry together.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   1 * time.Second,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// attempts returns the effective maximum number of attempts.
+func (p RetryPolicy) attempts() int {
+	return max(p.MaxAttempts, 1)
+}
+
+// backoff returns how long to wait after the given failed attempt (starting at 1).
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return min(statusErr.RetryAfter, max(p.MaxDelay, MaxRetryAfter))
+	}
+
+	// A MaxDelay of zero or less leaves the backoff uncapped, so doubling only stops
+	// before the delay would overflow.
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay > 0 && delay <= math.MaxInt64/2 && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	jitter := min(max(p.Jitter, 0), 1)
+	if jitter > 0 && delay > 0 {
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// StatusError is returned when the server answers with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+
+	// RetryAfter is the wait requested by the server through the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad status: %s", e.Status)
+}
+
+// RetryError is returned when a download failed on every attempt.
+// It lists the error of each attempt, oldest first.
+type RetryError struct {
+	Attempts []error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %v", len(e.Attempts), e.Attempts[len(e.Attempts)-1])
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetryError) Unwrap() error {
+	return e.Attempts[len(e.Attempts)-1]
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0)
+	}
+
+	return 0
+}
+
+// isRetryable reports whether a failed attempt may succeed if repeated.
+// Server errors, rate limiting, timeouts and dropped connections are retryable;
+// client errors such as 404 or 403, invalid requests, refused or impossible
+// connections and disk errors are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+			return true
+		case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+			return false
+		}
+		return statusErr.StatusCode >= 500
+	}
+
+	if errors.Is(err, errRangeIgnored) ||
+		errors.Is(err, errStalled) ||
+		errors.Is(err, errTooSlow) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.Timeout() || dnsErr.Temporary()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// run downloads the file, retrying failed attempts according to the retry policy.
+// A download with mirrors tries every mirror once per attempt, switching to the next
+// one as soon as the current one fails, and waits before retrying only when all
+// mirrors failed. The attempt is retried if any mirror failed with a retryable error.
+func (f *FileDownload) run(ctx context.Context) error {
+	policy := f.opts.Retry
+	var attempts []error
+
+	f.cached = f.revalidation()
+	if f.opts.MirrorStrategy == MirrorFastest && f.cached == nil {
+		f.rankMirrors(ctx)
+	}
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		retryable := false
+		for tried := 1; ; tried++ {
+			f.setAttempt(attempt, time.Time{})
+
+			err = f.try(ctx)
+			if err == nil {
+				return nil
+			}
+			if len(f.sources) > 1 {
+				err = &MirrorError{URL: f.Mirror(), Err: err}
+			}
+			attempts = append(attempts, err)
+			retryable = retryable || isRetryable(err)
+
+			if tried >= len(f.sources) || ctx.Err() != nil || errors.Is(err, errSkipped) || errors.Is(err, ErrNotModified) {
+				break
+			}
+			f.nextMirror()
+			f.emit(EventMirror, err)
+		}
+
+		if attempt >= policy.attempts() || ctx.Err() != nil || !retryable {
+			if len(attempts) == 1 {
+				return err
+			}
+			return &RetryError{Attempts: attempts}
+		}
+		f.nextMirror()
+
+		delay := policy.backoff(attempt, err)
+		f.setAttempt(attempt, time.Now().Add(delay))
+		f.emit(EventRetry, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &RetryError{Attempts: append(attempts, ctx.Err())}
+		}
+	}
+}
+
+// Attempt returns the number of the current attempt, starting at 1, and the time
+// the next attempt starts when the download is waiting to retry.
+func (f *FileDownload) Attempt() (int, time.Time) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.attempt, f.retryAt
+}
+
+// setAttempt sets the current attempt and retry time in a thread-safe manner.
+func (f *FileDownload) setAttempt(attempt int, retryAt time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempt = attempt
+	f.retryAt = retryAt
+}
+
+// MaxAttempts returns the maximum number of attempts allowed for the download.
+func (f *FileDownload) MaxAttempts() int {
+	return f.opts.Retry.attempts()
+}
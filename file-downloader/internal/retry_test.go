@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "server error",
+			err:  &StatusError{StatusCode: http.StatusBadGateway},
+			want: true,
+		},
+		{
+			name: "rate limited",
+			err:  &StatusError{StatusCode: http.StatusTooManyRequests},
+			want: true,
+		},
+		{
+			name: "not found",
+			err:  &StatusError{StatusCode: http.StatusNotFound},
+			want: false,
+		},
+		{
+			name: "forbidden",
+			err:  &StatusError{StatusCode: http.StatusForbidden},
+			want: false,
+		},
+		{
+			name: "not implemented",
+			err:  &StatusError{StatusCode: http.StatusNotImplemented},
+			want: false,
+		},
+		{
+			name: "connection reset",
+			err:  fmt.Errorf("failed to read response: %w", syscall.ECONNRESET),
+			want: true,
+		},
+		{
+			name: "connection reset while dialing",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNRESET)},
+			want: true,
+		},
+		{
+			name: "dial timeout",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}},
+			want: true,
+		},
+		{
+			name: "connection refused",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			want: false,
+		},
+		{
+			name: "invalid address",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{Err: "missing port in address", Addr: "example.com"}},
+			want: false,
+		},
+		{
+			name: "network unreachable",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)},
+			want: false,
+		},
+		{
+			name: "unexpected EOF",
+			err:  fmt.Errorf("failed to read response: %w", io.ErrUnexpectedEOF),
+			want: true,
+		},
+		{
+			name: "stalled",
+			err:  fmt.Errorf("%w: no data received for 30s", errStalled),
+			want: true,
+		},
+		{
+			name: "too slow",
+			err:  fmt.Errorf("%w: below 10.00 KB/s for 30s", errTooSlow),
+			want: true,
+		},
+		{
+			name: "cancelled",
+			err:  fmt.Errorf("failed to fetch URL: %w", context.Canceled),
+			want: false,
+		},
+		{
+			name: "disk error",
+			err:  fmt.Errorf("failed to write to file: %w", &os.PathError{Op: "write", Err: syscall.ENOSPC}),
+			want: false,
+		},
+		{
+			name: "unknown error",
+			err:  errors.New("unsupported protocol scheme"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	capped := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	uncapped := RetryPolicy{BaseDelay: time.Second}
+
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		err     error
+		want    time.Duration
+	}{
+		{policy: capped, attempt: 1, err: errors.New("x"), want: time.Second},
+		{policy: capped, attempt: 2, err: errors.New("x"), want: 2 * time.Second},
+		{policy: capped, attempt: 3, err: errors.New("x"), want: 4 * time.Second},
+		{policy: capped, attempt: 4, err: errors.New("x"), want: 5 * time.Second},
+		{policy: capped, attempt: 1, err: &StatusError{StatusCode: 429, RetryAfter: 10 * time.Second}, want: 10 * time.Second},
+		{policy: capped, attempt: 1, err: &StatusError{StatusCode: 503, RetryAfter: 365 * 24 * time.Hour}, want: MaxRetryAfter},
+		{policy: RetryPolicy{MaxDelay: time.Hour}, attempt: 1, err: &StatusError{StatusCode: 503, RetryAfter: 2 * time.Hour}, want: time.Hour},
+		{policy: uncapped, attempt: 1, err: &StatusError{StatusCode: 429, RetryAfter: 365 * 24 * time.Hour}, want: MaxRetryAfter},
+		{policy: uncapped, attempt: 1, err: errors.New("x"), want: time.Second},
+		{policy: uncapped, attempt: 3, err: errors.New("x"), want: 4 * time.Second},
+		{policy: uncapped, attempt: 8, err: errors.New("x"), want: 128 * time.Second},
+		{policy: uncapped, attempt: 100, err: errors.New("x"), want: time.Second << 33},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.backoff(tt.attempt, tt.err); got != tt.want {
+			t.Errorf("backoff(%d, %v) with MaxDelay %v = %v, want %v", tt.attempt, tt.err, tt.policy.MaxDelay, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: 0},
+		{header: "120", want: 2 * time.Minute},
+		{header: "Mon, 01 Jan 2024 12:00:30 GMT", want: 30 * time.Second},
+		{header: "Mon, 01 Jan 2024 11:00:00 GMT", want: 0},
+		{header: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterServerError(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	opts := Options{Retry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+	downloads, err := PrepareDownloads(EntriesFromURLs([]string{server.URL + "/file.txt"}), t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	var wg sync.WaitGroup
+	err = d.Start(context.Background(), &wg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	for range d.LoadedBytes {
+	}
+	wg.Wait()
+
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+}
@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// MinSegmentSize is the smallest byte range worth a connection of its own.
+	MinSegmentSize = 1024 * 1024
+)
+
+// errRangeIgnored is returned when a server answers a range request with the whole file,
+// which means the file changed since the segments were planned.
+var errRangeIgnored = errors.New("server ignored range request, remote file changed")
+
+// segment is an inclusive byte range of the file and how much of it is on disk.
+type segment struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Written int64 `json:"written"`
+}
+
+// remaining returns the number of bytes of the segment still to be downloaded.
+func (s segment) remaining() int64 {
+	return s.End - s.Start + 1 - s.Written
+}
+
+// splitSegments divides total bytes into at most n contiguous segments
+// of at least MinSegmentSize bytes each.
+func splitSegments(total int64, n int) []segment {
+	if maxSegments := total / MinSegmentSize; int64(n) > maxSegments {
+		n = int(maxSegments)
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	size := total / int64(n)
+	segments := make([]segment, n)
+	for i := range segments {
+		segments[i].Start = int64(i) * size
+		segments[i].End = segments[i].Start + size - 1
+	}
+	segments[n-1].End = total - 1
+
+	return segments
+}
+
+// downloadSegmented downloads the file as several concurrent byte ranges written at
+// their offsets in the partial file. It returns false without downloading anything
+// when the server does not support ranges or the file is too small to split.
+func (f *FileDownload) downloadSegmented(ctx context.Context) (bool, error) {
+	meta, err := f.segmentPlan(ctx)
+	if err != nil || meta == nil {
+		return err != nil, err
+	}
+
+	var downloaded int64
+	for _, s := range meta.Segments {
+		downloaded += s.Written
+	}
+	f.setTotalBytes(meta.TotalBytes)
+	f.setDownloaded(downloaded)
+
+	file, err := os.OpenFile(f.partPath(), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return true, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	err = file.Truncate(meta.TotalBytes)
+	if err != nil {
+		safeClose(file)
+		return true, fmt.Errorf("failed to allocate file: %w", err)
+	}
+
+	// The data is synced on every path, including failures and interruptions, before the
+	// metadata records it as written, so a crash cannot leave a resume point past what
+	// reached the disk.
+	err = f.fetchSegments(ctx, file, meta)
+	syncErr := syncFile(file)
+	if err == nil {
+		err = syncErr
+	}
+	closeErr := file.Close()
+
+	if errors.Is(err, errRangeIgnored) {
+		f.removePartial()
+		return true, err
+	}
+
+	var saveErr error
+	if syncErr == nil {
+		saveErr = savePartialMeta(f.metaPath(), meta)
+	}
+	if err != nil {
+		return true, err
+	}
+	if closeErr != nil {
+		return true, fmt.Errorf("failed to close file: %w", closeErr)
+	}
+	if saveErr != nil {
+		return true, fmt.Errorf("failed to save resume metadata: %w", saveErr)
+	}
+
+	return true, f.finish(ctx, nil)
+}
+
+// segmentPlan returns the segments to download, reusing those of a previous run
+// when resuming. It returns nil when the file should be downloaded in one stream.
+func (f *FileDownload) segmentPlan(ctx context.Context) (*partialMeta, error) {
+	if f.canResume() {
+		meta, err := loadPartialMeta(f.metaPath())
+		if err == nil && meta.URL == f.URL && len(meta.Segments) > 0 && meta.validator() != "" {
+			if info, err := os.Stat(f.partPath()); err == nil && info.Size() == meta.TotalBytes {
+				ok, err := f.adoptMirror(ctx, meta)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					return meta, f.useServerFileName(meta.FileName)
+				}
+			}
+		}
+
+		if offset, _, _ := f.resumePoint(); offset > 0 {
+			// Continue the partial file of a single-stream download as it was.
+			return nil, nil
+		}
+	}
+
+	result, err := f.stat(ctx)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.AcceptRanges || result.Size < 2*MinSegmentSize {
+		return nil, nil
+	}
+
+	meta := newPartialMeta(f.URL, f.Mirror(), result)
+	if meta.validator() == "" {
+		// Without a validator there is no way to tell if the file changes
+		// between segment requests.
+		return nil, nil
+	}
+	meta.Segments = splitSegments(result.Size, f.opts.Segments)
+
+	err = f.useServerFileName(result.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = savePartialMeta(f.metaPath(), meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save resume metadata: %w", err)
+	}
+
+	return meta, nil
+}
+
+// adoptMirror prepares segments planned from another mirror to be continued from the
+// current one. Validators differ between mirrors, so the current mirror's validators
+// replace them when it serves a file of the same size with range support.
+// It reports whether the segments can be continued.
+func (f *FileDownload) adoptMirror(ctx context.Context, meta *partialMeta) (bool, error) {
+	source := f.Mirror()
+	if meta.source() == source {
+		return true, nil
+	}
+
+	result, err := f.stat(ctx)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !result.AcceptRanges || result.Size != meta.TotalBytes {
+		return false, nil
+	}
+
+	adopted := newPartialMeta(f.URL, source, result)
+	if adopted.validator() == "" {
+		return false, nil
+	}
+	meta.Source = adopted.Source
+	meta.ETag = adopted.ETag
+	meta.LastModified = adopted.LastModified
+
+	err = savePartialMeta(f.metaPath(), meta)
+	if err != nil {
+		return false, fmt.Errorf("failed to save resume metadata: %w", err)
+	}
+	return true, nil
+}
+
+// fetchSegments downloads all unfinished segments concurrently.
+// The first failure cancels the remaining segments.
+func (f *FileDownload) fetchSegments(ctx context.Context, file *os.File, meta *partialMeta) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for i := range meta.Segments {
+		if meta.Segments[i].remaining() <= 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *segment) {
+			defer wg.Done()
+			err := f.fetchSegment(ctx, file, s, meta.validator(), &mu)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(&meta.Segments[i])
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// fetchSegment downloads the rest of one segment, writing at its offset in the file.
+// mu guards the segment's Written counter, which is read when metadata is saved.
+func (f *FileDownload) fetchSegment(ctx context.Context, file *os.File, s *segment, validator string, mu *sync.Mutex) error {
+	mu.Lock()
+	offset := s.Start + s.Written
+	mu.Unlock()
+
+	result, err := f.fetch(ctx, offset, s.End-offset+1, validator)
+	if err != nil {
+		return err
+	}
+	defer safeClose(result.Body)
+
+	if !result.Ranged {
+		return errRangeIgnored
+	}
+	if result.Offset != offset {
+		return fmt.Errorf("source sent range starting at byte %d, expected %d", result.Offset, offset)
+	}
+
+	body := io.LimitReader(result.Body, s.End-offset+1)
+	buffer := make([]byte, DefaultBufferSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if throttleErr := f.throttle(ctx, n); throttleErr != nil {
+				return throttleErr
+			}
+			_, writeErr := file.WriteAt(buffer[:n], offset)
+			if writeErr != nil {
+				return fmt.Errorf("failed to write to file: %w", writeErr)
+			}
+			offset += int64(n)
+
+			mu.Lock()
+			s.Written += int64(n)
+			mu.Unlock()
+
+			f.report(int64(n))
+		}
+		if err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("failed to read response: %w", err)
+			}
+			break
+		}
+	}
+
+	if offset <= s.End {
+		return fmt.Errorf("segment ended early at byte %d, expected %d", offset, s.End+1)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitSegments(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int64
+		n     int
+		want  []segment
+	}{
+		{
+			name:  "even split",
+			total: 4 * MinSegmentSize,
+			n:     2,
+			want: []segment{
+				{Start: 0, End: 2*MinSegmentSize - 1},
+				{Start: 2 * MinSegmentSize, End: 4*MinSegmentSize - 1},
+			},
+		},
+		{
+			name:  "remainder goes to last segment",
+			total: 3*MinSegmentSize + 1,
+			n:     3,
+			want: []segment{
+				{Start: 0, End: MinSegmentSize - 1},
+				{Start: MinSegmentSize, End: 2*MinSegmentSize - 1},
+				{Start: 2 * MinSegmentSize, End: 3 * MinSegmentSize},
+			},
+		},
+		{
+			name:  "capped by minimum segment size",
+			total: 2 * MinSegmentSize,
+			n:     8,
+			want: []segment{
+				{Start: 0, End: MinSegmentSize - 1},
+				{Start: MinSegmentSize, End: 2*MinSegmentSize - 1},
+			},
+		},
+		{
+			name:  "small file",
+			total: 100,
+			n:     4,
+			want:  []segment{{Start: 0, End: 99}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitSegments(tt.total, tt.n)
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitSegments() returned %d segments, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("segment %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentedDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefgh"), 3*MinSegmentSize/8)
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var rangeRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			rangeRequests.Add(1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.bin", modTime, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloads, err := PrepareDownloads(EntriesFromURLs([]string{server.URL + "/file.bin"}), t.TempDir(), Options{Segments: 3})
+	if err != nil {
+		t.Fatalf("PrepareDownloads() error = %v", err)
+	}
+	d := downloads[0]
+
+	var wg sync.WaitGroup
+	err = d.Start(context.Background(), &wg)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	var reported int64
+	for n := range d.LoadedBytes {
+		reported += n
+	}
+	wg.Wait()
+
+	if err := d.Err(); err != nil {
+		t.Fatalf("download error = %v", err)
+	}
+	if got := rangeRequests.Load(); got != 3 {
+		t.Errorf("range requests = %d, want 3", got)
+	}
+	if reported != int64(len(content)) {
+		t.Errorf("reported %d bytes, want %d", reported, len(content))
+	}
+
+	got, err := os.ReadFile(d.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file does not match the source")
+	}
+}
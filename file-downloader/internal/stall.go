@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StalledAfter is how long an active download receives no data before its progress
+// shows it as stalled, or half the stall timeout if that is shorter.
+const StalledAfter = 5 * time.Second
+
+var (
+	// errStalled is returned when a transfer receives no data for longer than the stall timeout.
+	errStalled = errors.New("transfer stalled")
+	// errTooSlow is returned when a transfer stays below the minimum speed.
+	errTooSlow = errors.New("transfer too slow")
+)
+
+// try makes one attempt to download the file from the current mirror.
+// The attempt fails with errStalled when no data arrives within the stall timeout,
+// and with errTooSlow when it stays below the minimum speed.
+func (f *FileDownload) try(ctx context.Context) error {
+	f.tries++
+	f.touch()
+
+	attemptCtx, stop := f.watchStall(ctx)
+	err := f.download(attemptCtx)
+	cause := context.Cause(attemptCtx)
+	stop()
+
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	switch {
+	case errors.Is(cause, errStalled):
+		return fmt.Errorf("%w: no data received for %s", errStalled, f.opts.StallTimeout)
+	case errors.Is(cause, errTooSlow):
+		return fmt.Errorf("%w: below %s for %s", errTooSlow, formatSpeed(float64(f.opts.MinSpeed)), f.opts.MinSpeedTime)
+	}
+	return err
+}
+
+// watchStall returns a context that is cancelled with errStalled when the download
+// makes no progress for the stall timeout, or with errTooSlow when it receives less
+// than the minimum speed over MinSpeedTime, and a function to stop watching.
+func (f *FileDownload) watchStall(ctx context.Context) (context.Context, func()) {
+	timeout := f.opts.StallTimeout
+	minSpeed, window := f.opts.MinSpeed, f.opts.MinSpeedTime
+	if minSpeed <= 0 || window <= 0 {
+		minSpeed, window = 0, 0
+	}
+	if timeout <= 0 && window <= 0 {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	interval := timeout
+	if interval <= 0 || (window > 0 && window < interval) {
+		interval = window
+	}
+
+	go func() {
+		ticker := time.NewTicker(max(interval/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		// The speed is measured over windows of MinSpeedTime, not counting the time spent
+		// waiting on purpose, such as for the rate limiter.
+		_, windowWaited, _ := f.lastActivity()
+		windowStart, windowBytes := time.Now(), f.receivedBytes()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				activeAt, waited, waiting := f.lastActivity()
+				if waiting {
+					continue
+				}
+				if timeout > 0 && now.Sub(activeAt) >= timeout {
+					cancel(errStalled)
+					return
+				}
+				elapsed := now.Sub(windowStart) - (waited - windowWaited)
+				if window <= 0 || elapsed < window {
+					continue
+				}
+				received := f.receivedBytes()
+				if float64(received-windowBytes)/elapsed.Seconds() < float64(minSpeed) {
+					cancel(errTooSlow)
+					return
+				}
+				windowStart, windowBytes, windowWaited = now, received, waited
+			}
+		}
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// stalledAfter returns how long the download receives no data before it is shown as stalled.
+func (f *FileDownload) stalledAfter() time.Duration {
+	if timeout := f.opts.StallTimeout; timeout > 0 {
+		return min(StalledAfter, timeout/2)
+	}
+	return StalledAfter
+}
+
+// receivedBytes returns the number of bytes received in this run.
+func (f *FileDownload) receivedBytes() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.received
+}
+
+// touch records that the download made progress.
+func (f *FileDownload) touch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.activeAt = time.Now()
+}
+
+// pauseStall stops the stall timeout while the download waits on purpose, such as
+// for the rate limiter, and returns the function that restarts it.
+func (f *FileDownload) pauseStall() func() {
+	start := time.Now()
+	f.mu.Lock()
+	f.stallPauses++
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.stallPauses--
+		f.activeAt = time.Now()
+		f.waited += f.activeAt.Sub(start)
+	}
+}
+
+// lastActivity returns the last time the download made progress, the time it spent
+// waiting on purpose, and whether it is waiting now.
+func (f *FileDownload) lastActivity() (activeAt time.Time, waited time.Duration, waiting bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.activeAt, f.waited, f.stallPauses > 0
+}
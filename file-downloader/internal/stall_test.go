@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAttemptTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		opts    Options
+		wantErr error
+	}{
+		{
+			name: "stalled",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "1000")
+				_, _ = w.Write(make([]byte, 100))
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			},
+			opts:    Options{StallTimeout: 100 * time.Millisecond},
+			wantErr: errStalled,
+		},
+		{
+			name: "too slow",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "100000")
+				for range 1000 {
+					if _, err := w.Write(make([]byte, 10)); err != nil {
+						return
+					}
+					w.(http.Flusher).Flush()
+					time.Sleep(10 * time.Millisecond)
+				}
+			},
+			opts:    Options{StallTimeout: time.Second, MinSpeed: 10000, MinSpeedTime: 200 * time.Millisecond},
+			wantErr: errTooSlow,
+		},
+		{
+			name: "response headers late",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			},
+			opts: Options{HTTPClient: NewHTTPClient(HTTPTimeouts{ResponseHeader: 50 * time.Millisecond})},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				tt.handler(w, r)
+			}))
+			defer server.Close()
+
+			opts := tt.opts
+			opts.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+			d := runDownload(t, Entry{URL: server.URL + "/file.bin"}, opts)
+
+			err := d.Err()
+			var retryErr *RetryError
+			if !errors.As(err, &retryErr) || len(retryErr.Attempts) != 2 || requests.Load() != 2 {
+				t.Fatalf("download error = %v after %d requests, want 2 failed attempts", err, requests.Load())
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("download error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStalledEvent(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		f      *FileDownload
+		wanted bool
+	}{
+		{
+			name:   "receiving",
+			f:      &FileDownload{state: StateActive, activeAt: now},
+			wanted: false,
+		},
+		{
+			name:   "no data",
+			f:      &FileDownload{state: StateActive, activeAt: now.Add(-StalledAfter)},
+			wanted: true,
+		},
+		{
+			name:   "no data within half the stall timeout",
+			f:      &FileDownload{state: StateActive, activeAt: now.Add(-time.Second), opts: Options{StallTimeout: 2 * time.Second}},
+			wanted: true,
+		},
+		{
+			name:   "rate limited",
+			f:      &FileDownload{state: StateActive, activeAt: now.Add(-StalledAfter), stallPauses: 1},
+			wanted: false,
+		},
+		{
+			name:   "waiting to retry",
+			f:      &FileDownload{state: StateActive, activeAt: now.Add(-StalledAfter), retryAt: now.Add(time.Minute)},
+			wanted: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.event(EventProgress, nil).Stalled; got != tt.wanted {
+				t.Errorf("Stalled = %v, want %v", got, tt.wanted)
+			}
+		})
+	}
+}
@@ -4,8 +4,9 @@ package internal
 
 import (
 	"fmt"
+	"io"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -20,113 +21,98 @@ const (
 	ProgressBarWidth = 50
 )
 
-// ProgressInfo tracks download progress and speed
-type ProgressInfo struct {
-	mu             sync.RWMutex
-	downloaded     int64
-	startTime      time.Time
-	completionTime time.Time
-	lastUpdate     time.Time
-	lastBytes      int64
-	currentSpeed   float64
-	complete       bool
+// TerminalRenderer draws progress bars on an ANSI terminal. Finished downloads are
+// printed once, while active downloads and a summary line are redrawn in place.
+type TerminalRenderer struct {
+	w         io.Writer
+	latest    map[int]Event
+	liveLines int
 }
 
-// StartProgressListener monitors downloads and displays progress bars with speed and ETA
-func StartProgressListener(downloads []*FileDownload, wg *sync.WaitGroup) {
-	progressInfos := make([]*ProgressInfo, len(downloads))
-	for i := range downloads {
-		progressInfos[i] = &ProgressInfo{
-			downloaded: 0,
-			startTime:  time.Now(),
-			lastUpdate: time.Now(),
-			lastBytes:  0,
-			complete:   false,
-		}
-	}
+// NewTerminalRenderer returns a renderer that draws progress bars to w.
+func NewTerminalRenderer(w io.Writer) *TerminalRenderer {
+	return &TerminalRenderer{w: w, latest: make(map[int]Event)}
+}
 
-	for range downloads {
-		fmt.Println()
+// Render draws the events until the channel is closed. Events that arrive together,
+// such as the periodic progress of every active download, are drawn in a single redraw.
+func (r *TerminalRenderer) Render(events <-chan Event) {
+	for event := range events {
+		r.update(event)
+		for drained := false; !drained; {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					r.render()
+					return
+				}
+				r.update(event)
+			default:
+				drained = true
+			}
+		}
+		r.render()
 	}
+}
 
-	for i, download := range downloads {
-		wg.Add(1)
-		go listenToProgress(download, progressInfos[i], wg)
+// update records the latest state of a download, printing it above the live area once it finished.
+func (r *TerminalRenderer) update(event Event) {
+	r.latest[event.Index] = event
+	if event.Type.Final() {
+		r.clearLive()
+		r.printProgress(event)
 	}
-
-	wg.Add(1)
-	go updateDisplay(downloads, progressInfos, wg)
 }
 
-func listenToProgress(download *FileDownload, info *ProgressInfo, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for bytes := range download.LoadedBytes {
-		info.mu.Lock()
-		info.downloaded += bytes
-		updateSpeed(info)
-		info.mu.Unlock()
+// clearLive moves the cursor to the start of the live area and clears it.
+func (r *TerminalRenderer) clearLive() {
+	if r.liveLines > 0 {
+		fmt.Fprintf(r.w, "\033[%dA\033[J", r.liveLines)
+		r.liveLines = 0
 	}
-	info.mu.Lock()
-	info.completionTime = time.Now()
-	info.complete = true
-	info.mu.Unlock()
 }
 
-func updateDisplay(downloads []*FileDownload, progressInfos []*ProgressInfo, wg *sync.WaitGroup) {
-	defer wg.Done()
-	ticker := time.NewTicker(ProgressUpdateInterval)
-	defer ticker.Stop()
-
-	allComplete := false
-	for !allComplete {
-		<-ticker.C
-
-		if len(downloads) > 0 {
-			fmt.Printf("\033[%dA", len(downloads))
-		}
-
-		allComplete = true
-		for i, download := range downloads {
-			info := progressInfos[i]
-			printProgress(download, info, i)
-
-			info.mu.RLock()
-			if !info.complete {
-				allComplete = false
-			}
-			info.mu.RUnlock()
+// render redraws the live area at the bottom of the terminal, which holds one line per
+// active download and a summary line. Finished downloads are printed once above the live
+// area so queued and completed downloads do not take up a row each.
+func (r *TerminalRenderer) render() {
+	r.clearLive()
+
+	var queued, done, failed, skipped int
+	var active []int
+	for index, event := range r.latest {
+		switch event.Type {
+		case EventQueued:
+			queued++
+		case EventCompleted, EventUpToDate:
+			done++
+		case EventFailed:
+			failed++
+		case EventSkipped:
+			skipped++
+		default:
+			active = append(active, index)
 		}
 	}
+	slices.Sort(active)
 
-	fmt.Printf("\033[%dA", len(downloads))
-	for i, download := range downloads {
-		info := progressInfos[i]
-		printProgress(download, info, i)
+	for _, index := range active {
+		r.printProgress(r.latest[index])
 	}
-}
-
-// updateSpeed updates the current download speed. Must be called with info.mu locked.
-func updateSpeed(info *ProgressInfo) {
-	now := time.Now()
-	timeDiff := now.Sub(info.lastUpdate).Seconds()
+	fmt.Fprintf(r.w, "\r\033[K%s: %d | %s: %d | %s: %d | %s: %d | %s: %d\n",
+		StateQueued, queued, StateActive, len(active), StateDone, done, StateFailed, failed, StateSkipped, skipped)
 
-	if timeDiff >= SpeedUpdateThreshold {
-		bytesDiff := info.downloaded - info.lastBytes
-		info.currentSpeed = float64(bytesDiff) / timeDiff
-		info.lastUpdate = now
-		info.lastBytes = info.downloaded
-	}
+	r.liveLines = len(active) + 1
 }
 
-func printProgress(download *FileDownload, info *ProgressInfo, index int) {
-	info.mu.RLock()
-	defer info.mu.RUnlock()
-
-	totalBytes := download.TotalBytes()
+func (r *TerminalRenderer) printProgress(event Event) {
+	totalBytes := event.Total
+	// Includes bytes resumed from a previous run, while the speed only counts this run.
+	downloaded := event.Bytes
 
 	var percentage float64
 	if totalBytes > 0 {
-		percentage = float64(info.downloaded) / float64(totalBytes) * 100
+		percentage = float64(downloaded) / float64(totalBytes) * 100
 	} else {
 		percentage = 0
 	}
@@ -134,28 +120,85 @@ func printProgress(download *FileDownload, info *ProgressInfo, index int) {
 	filledWidth := int(float64(ProgressBarWidth)*percentage/100 + 0.5)
 	bar := strings.Repeat("█", filledWidth) + strings.Repeat("░", ProgressBarWidth-filledWidth)
 
-	downloadedMB := float64(info.downloaded) / (1024 * 1024)
+	downloadedMB := float64(downloaded) / (1024 * 1024)
 	totalMB := float64(totalBytes) / (1024 * 1024)
 
-	if info.complete {
-		elapsed := info.completionTime.Sub(info.startTime)
-		avgSpeed := float64(info.downloaded) / elapsed.Seconds()
-		fmt.Printf("\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | Avg: %s | Time: %s\n",
-			index+1, bar, percentage, downloadedMB, totalMB,
-			formatSpeed(avgSpeed), formatDuration(elapsed))
-	} else {
+	switch event.Type {
+	case EventSkipped:
+		fmt.Fprintf(r.w, "\r\033[K[%d] %s: %s already exists\n", event.Index, StateSkipped, event.Path)
+	case EventUpToDate:
+		fmt.Fprintf(r.w, "\r\033[K[%d] %s: %s\n", event.Index, StateUpToDate, event.Path)
+	case EventFailed:
+		fmt.Fprintf(r.w, "\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | %s\n",
+			event.Index, bar, percentage, downloadedMB, totalMB, StateFailed)
+	case EventCompleted:
+		elapsed := time.Duration(event.Elapsed * float64(time.Second))
+		extracted := ""
+		if event.ExtractDir != "" {
+			extracted = " | Extracted to " + event.ExtractDir
+		}
+		fmt.Fprintf(r.w, "\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | Avg: %s | Time: %s%s\n",
+			event.Index, bar, percentage, downloadedMB, totalMB,
+			formatSpeed(event.Speed), formatDuration(elapsed), extracted)
+	default:
+		if wait := event.RetryAt.Sub(event.Time); wait > 0 {
+			fmt.Fprintf(r.w, "\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | Retrying in %s (attempt %d/%d failed)\n",
+				event.Index, bar, percentage, downloadedMB, totalMB,
+				formatDuration(wait), event.Attempt, event.MaxAttempts)
+			return
+		}
+
+		if event.ExtractDir != "" {
+			r.printExtraction(event)
+			return
+		}
+
+		if event.Stalled {
+			fmt.Fprintf(r.w, "\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | Stalled, no data received%s\n",
+				event.Index, bar, percentage, downloadedMB, totalMB, attemptSuffix(event))
+			return
+		}
+
 		eta := ""
-		if info.currentSpeed > 0 {
-			remainingBytes := totalBytes - info.downloaded
-			etaSeconds := float64(remainingBytes) / info.currentSpeed
+		if event.Speed > 0 {
+			remainingBytes := totalBytes - downloaded
+			etaSeconds := float64(remainingBytes) / event.Speed
 			eta = formatDuration(time.Duration(etaSeconds * float64(time.Second)))
 		} else {
 			eta = "calculating..."
 		}
-		fmt.Printf("\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | Speed: %s | ETA: %s\n",
-			index+1, bar, percentage, downloadedMB, totalMB,
-			formatSpeed(info.currentSpeed), eta)
+
+		fmt.Fprintf(r.w, "\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | Speed: %s | ETA: %s%s\n",
+			event.Index, bar, percentage, downloadedMB, totalMB,
+			formatSpeed(event.Speed), eta, attemptSuffix(event))
+	}
+}
+
+// attemptSuffix describes the attempt and mirror of a download after a retry or with mirrors.
+func attemptSuffix(event Event) string {
+	suffix := ""
+	if event.Attempt > 1 {
+		suffix = fmt.Sprintf(" | Attempt %d/%d", event.Attempt, event.MaxAttempts)
 	}
+	if event.Mirror != "" {
+		suffix += " | Mirror: " + mirrorHost(event.Mirror)
+	}
+	return suffix
+}
+
+// printExtraction prints the progress of unpacking an archive, measured in archive bytes.
+func (r *TerminalRenderer) printExtraction(event Event) {
+	var percentage float64
+	if event.Total > 0 {
+		percentage = min(float64(event.Extracted)/float64(event.Total)*100, 100)
+	}
+
+	filledWidth := int(float64(ProgressBarWidth)*percentage/100 + 0.5)
+	bar := strings.Repeat("█", filledWidth) + strings.Repeat("░", ProgressBarWidth-filledWidth)
+
+	fmt.Fprintf(r.w, "\r\033[K[%d] %s %.1f%% | %.2f/%.2f MB | %s to %s\n",
+		event.Index, bar, percentage, float64(event.Extracted)/(1024*1024), float64(event.Total)/(1024*1024),
+		StateExtracting, event.ExtractDir)
 }
 
 func formatSpeed(bps float64) string {
@@ -3,16 +3,20 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 )
 
 // validateURL checks if the given URL is in a proper format using url.Parse.
-// Only http and https schemes are allowed.
+// Only schemes with a registered Fetcher are allowed, and fetchers implementing
+// URLValidator check the rest of the URL.
 func validateURL(urlStr string) error {
 	if urlStr == "" {
 		return fmt.Errorf("URL cannot be empty")
@@ -20,17 +24,22 @@ func validateURL(urlStr string) error {
 
 	parsedURL, err := url.Parse(urlStr)
 	if err != nil {
+		// The parse error quotes the URL, which may hold credentials.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
 		return fmt.Errorf("invalid URL format: %w", err)
 	}
 
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return fmt.Errorf("invalid URL scheme '%s': only http and https are supported", parsedURL.Scheme)
+	fetcher, ok := LookupFetcher(parsedURL.Scheme)
+	if !ok {
+		return fmt.Errorf("invalid URL scheme '%s': no fetcher is registered for it", parsedURL.Scheme)
 	}
 
-	if parsedURL.Host == "" {
-		return fmt.Errorf("invalid URL: missing host")
+	if validator, ok := fetcher.(URLValidator); ok {
+		return validator.ValidateURL(parsedURL)
 	}
-
 	return nil
 }
 
@@ -61,7 +70,9 @@ func ensureDirectory(dir string) error {
 }
 
 // extractFileName extracts the filename from a URL by taking the last path segment
-// and removing any query parameters.
+// and removing any query parameters. The name is sanitized like a name sent by the
+// server, so segments such as ".." or an encoded "%2e%2e" fall back to "download"
+// instead of naming a directory.
 func extractFileName(urlStr string) (string, error) {
 	parsedURL, err := url.Parse(urlStr)
 	if err != nil {
@@ -71,7 +82,7 @@ func extractFileName(urlStr string) (string, error) {
 	// Get the path and extract the last segment
 	path := parsedURL.Path
 	segments := strings.Split(path, "/")
-	filename := segments[len(segments)-1]
+	filename := sanitizeFileName(segments[len(segments)-1])
 
 	if filename == "" {
 		return "download", nil
@@ -80,9 +91,86 @@ func extractFileName(urlStr string) (string, error) {
 	return filename, nil
 }
 
+// ParseByteSize parses a size such as "500", "64K", "1.5M" or "2G". Suffixes are
+// case-insensitive powers of 1024 and may be followed by "B" and "/s", so rate
+// limits like "500KB/s" are accepted too.
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "/S")
+	value = strings.TrimSuffix(value, "IB")
+	value = strings.TrimSuffix(value, "B")
+
+	multiplier := 1.0
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	size := number * multiplier
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(size), nil
+}
+
+// validateFileName checks that a file name given by the user names a file inside
+// the download directory rather than a path.
+func validateFileName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name %q: must not contain path separators", name)
+	}
+	return nil
+}
+
+// syncFile flushes a file's contents to stable storage.
+func syncFile(file *os.File) error {
+	err := file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory entry change such as a rename to stable storage.
+// Errors are ignored because not every platform supports syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	safeClose(d)
+}
+
 // safeClose safely closes an io.Closer and logs any error that occurs.
 func safeClose(c io.Closer) {
 	if err := c.Close(); err != nil {
 		log.Printf("error closing resource: %v", err)
 	}
 }
+
+// safeRemove removes a file and logs any error other than the file not existing.
+func safeRemove(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("error removing %s: %v", path, err)
+	}
+}
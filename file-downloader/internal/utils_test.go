@@ -32,6 +32,31 @@ func TestValidateURL(t *testing.T) {
 			url:     "https://example.com/file.txt?param=value",
 			wantErr: false,
 		},
+		{
+			name:    "file URL",
+			url:     "file:///mnt/share/file.txt",
+			wantErr: false,
+		},
+		{
+			name:    "relative file URL",
+			url:     "file:share/file.txt",
+			wantErr: true,
+		},
+		{
+			name:    "remote file URL",
+			url:     "file://server/share/file.txt",
+			wantErr: true,
+		},
+		{
+			name:    "data URI",
+			url:     "data:text/plain;base64,SGVsbG8=",
+			wantErr: false,
+		},
+		{
+			name:    "invalid data URI",
+			url:     "data:text/plain;base64,!!!",
+			wantErr: true,
+		},
 		{
 			name:    "empty URL",
 			url:     "",
@@ -95,6 +120,26 @@ func TestExtractFileName(t *testing.T) {
 			url:      "https://example.com/download",
 			expected: "download",
 		},
+		{
+			name:     "parent directory",
+			url:      "http://example.com/..",
+			expected: "download",
+		},
+		{
+			name:     "encoded parent directory",
+			url:      "http://example.com/files/%2e%2e",
+			expected: "download",
+		},
+		{
+			name:     "current directory",
+			url:      "http://example.com/.",
+			expected: "download",
+		},
+		{
+			name:     "encoded separator",
+			url:      "http://example.com/a%2F..%5C..",
+			expected: "download",
+		},
 		{
 			name:     "numeric filename",
 			url:      "https://httpbin.org/bytes/10000000",
@@ -174,3 +219,42 @@ func TestEnsureDirectoryExisting(t *testing.T) {
 		t.Errorf("ensureDirectory() on existing directory failed: %v", err)
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "500", want: 500},
+		{input: "64K", want: 64 * 1024},
+		{input: "64k", want: 64 * 1024},
+		{input: "1.5M", want: 1536 * 1024},
+		{input: "2G", want: 2 * 1024 * 1024 * 1024},
+		{input: "500KB/s", want: 500 * 1024},
+		{input: "1MiB", want: 1024 * 1024},
+		{input: "", wantErr: true},
+		{input: "fast", wantErr: true},
+		{input: "-1K", wantErr: true},
+		{input: "inf", wantErr: true},
+		{input: "-Inf", wantErr: true},
+		{input: "Infinity", wantErr: true},
+		{input: "NaN", wantErr: true},
+		{input: "nanK", wantErr: true},
+		{input: "1e19", wantErr: true},
+		{input: "8388608T", wantErr: true},
+		{input: "8388607T", want: 8388607 << 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseByteSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseByteSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,41 +2,240 @@ package main
 
 import (
 	"context"
+	"errors"
 	"file-downloader/internal"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
+// Exit codes of a batch. Errors before any download starts exit with exitFailed too.
+const (
+	exitFailed    = 1
+	exitCancelled = 130
+)
+
+// listFlag collects the values of a flag that may be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
-	urlsFlag := flag.String("urls", "", "Comma-separated list of URLs to download")
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	args := os.Args[1:]
+	daemonMode := len(args) > 0 && args[0] == "daemon"
+	if daemonMode {
+		args = args[1:]
+	}
+
+	var headersFlag, includeFlag, excludeFlag listFlag
+	urlsFlag := flag.String("urls", "", "Comma-separated list of URLs to download, with mirrors of a file separated by |; [1-100], [a-z], [0-100:10] and {a,b} expand into several URLs")
+	outputFlag := flag.String("output", "", "File name of each download of -urls, where #1, #2... stand for the values of the URL's globs, e.g. img-#1.png")
+	globOffFlag := flag.Bool("globoff", false, "Take brackets and braces in -urls literally instead of expanding them")
+	inputFlag := flag.String("input", "", "Manifest file with URLs to download: plain list, JSON, CSV or Metalink (- for stdin)")
 	dirFlag := flag.String("dir", "./downloads", "Directory to save downloaded files")
-	flag.Parse()
+	continueFlag := flag.Bool("continue", true, "Resume interrupted downloads from their .part files")
+	resumeFlag := flag.Bool("resume", false, "Resume the interrupted batch recorded in the journal of -dir, skipping completed files")
+	probeFlag := flag.Bool("probe", false, "Print the remote metadata of every file and check the free disk space instead of downloading")
+	cacheFlag := flag.Bool("cache", true, "Only download files that changed since the last run, asking the server with the recorded ETag/Last-Modified")
+	segmentsFlag := flag.Int("segments", 1, "Number of concurrent connections per file when the server supports ranges")
+	retriesFlag := flag.Int("retries", 3, "Maximum number of attempts per file, including the first one")
+	retryDelayFlag := flag.Duration("retry-delay", time.Second, "Delay before the first retry, doubled on every further retry")
+	retryMaxDelayFlag := flag.Duration("retry-max-delay", 30*time.Second, "Maximum delay between retries")
+	retryJitterFlag := flag.Float64("retry-jitter", 0.2, "Fraction of the retry delay that is randomized (0 to 1)")
+	checksumsFlag := flag.String("checksums", "", "Checksum file in sha256sum format to verify downloads against")
+	limitRateFlag := flag.String("limit-rate", "", "Maximum combined download speed in bytes per second, e.g. 500K or 2M")
+	onConflictFlag := flag.String("on-conflict", "overwrite", "What to do when a target file exists or is used twice: overwrite, skip, rename or fail")
+	concurrencyFlag := flag.Int("concurrency", 0, "Maximum number of files to download at once (0 for no limit)")
+	maxPerHostFlag := flag.Int("max-per-host", 0, "Maximum number of files to download at once from the same host (0 for no limit)")
+	hostDelayFlag := flag.Duration("host-delay", 0, "Minimum delay between requests to the same host")
+	mirrorSelectFlag := flag.String("mirror-select", "order", "Order in which mirrors are tried: order or fastest")
+	locationFlag := flag.String("location", "", "Comma-separated country codes of preferred Metalink mirror locations, e.g. de,fr")
+	stallTimeoutFlag := flag.Duration("stall-timeout", 30*time.Second, "Fail an attempt that receives no data for this long (0 to disable)")
+	connectTimeoutFlag := flag.Duration("connect-timeout", internal.DefaultHTTPTimeouts().Connect, "Fail an attempt that cannot connect within this time (0 to disable)")
+	tlsTimeoutFlag := flag.Duration("tls-timeout", internal.DefaultHTTPTimeouts().TLSHandshake, "Fail an attempt whose TLS handshake takes longer (0 to disable)")
+	responseTimeoutFlag := flag.Duration("response-timeout", internal.DefaultHTTPTimeouts().ResponseHeader, "Fail an attempt whose response headers take longer to arrive (0 to disable)")
+	minSpeedFlag := flag.String("min-speed", "", "Fail an attempt that stays below this speed in bytes per second for -min-speed-time, e.g. 10K")
+	minSpeedTimeFlag := flag.Duration("min-speed-time", 30*time.Second, "How long an attempt may stay below -min-speed")
+	progressFlag := flag.String("progress", "auto", "Progress output: auto, ansi, plain, json or none")
+	reportFlag := flag.String("report", "", "File to write a summary of every download to when the batch ends")
+	reportFormatFlag := flag.String("report-format", "", "Format of -report: json or junit (default: junit for .xml files, json otherwise)")
+	flag.Var(&headersFlag, "header", "Request header as \"Name: value\" sent with every download (repeatable)")
+	userAgentFlag := flag.String("user-agent", "", "User-Agent header sent with every download")
+	userFlag := flag.String("user", "", "Basic auth credentials as user:password, sent to the host of each URL")
+	bearerFlag := flag.String("bearer", "", "Bearer token sent to the host of each URL")
+	cookiesFlag := flag.String("cookies", "", "Cookie file in Netscape format (as written by curl -c) to send cookies from")
+	netrcFlag := flag.Bool("netrc", true, "Look up credentials by host in the netrc file")
+	netrcFileFlag := flag.String("netrc-file", internal.DefaultNetrcPath(), "Path of the netrc file")
+	recursiveFlag := flag.Bool("recursive", false, "Treat the URLs as HTML directory listings and download the files they link to")
+	maxDepthFlag := flag.Int("max-depth", 5, "Number of subdirectory levels crawled below each URL with -recursive")
+	flag.Var(&includeFlag, "include", "Glob pattern of files to download with -recursive, e.g. *.csv (repeatable)")
+	flag.Var(&excludeFlag, "exclude", "Glob pattern of files or directories to skip with -recursive (repeatable)")
+	sameHostFlag := flag.Bool("same-host", true, "Only download files from the host of each URL with -recursive")
+	extractFlag := flag.Bool("extract", false, "Unpack downloaded .tar, .tar.gz/.tgz, .gz and .zip archives")
+	extractDirFlag := flag.String("extract-dir", "", "Directory to unpack archives into (default: a directory named after each archive)")
+	deleteArchiveFlag := flag.Bool("delete-archive", false, "Delete archives after unpacking them with -extract")
+	listenFlag := flag.String("listen", internal.DefaultDaemonAddress, "Address of the control API in daemon mode: host:port on a loopback interface or unix:PATH")
+	_ = flag.CommandLine.Parse(args)
 
-	if *urlsFlag == "" {
-		log.Fatal("Error: -urls flag is required\nUsage: go run main.go -urls=url1,url2,... [-dir=download_directory]")
+	if !daemonMode && !*resumeFlag && *urlsFlag == "" && *inputFlag == "" {
+		log.Fatal("Error: -urls, -input or -resume flag is required\nUsage: go run . -urls=url1,url2,... [-dir=download_directory]\n       go run . -input=manifest.json [-dir=download_directory]\n       go run . -resume [-dir=download_directory]\n       go run . daemon [-listen=address] [-dir=download_directory]\n       go run . ctl [-addr=address] add|list|pause|resume|cancel|events|wait ...")
 	}
 
-	urls := strings.Split(*urlsFlag, ",")
+	var entries []internal.Entry
+	if *urlsFlag != "" {
+		urls := internal.SplitURLList(*urlsFlag)
+		if *globOffFlag {
+			urls = strings.Split(*urlsFlag, ",")
+		}
+		expanded, err := internal.EntriesFromURLPatterns(urls, *outputFlag, *globOffFlag)
+		if err != nil {
+			log.Fatalf("Error: invalid -urls: %v", err)
+		}
+		entries = expanded
+	}
+	if *inputFlag != "" {
+		manifest, err := internal.LoadManifest(*inputFlag)
+		if err != nil {
+			log.Fatalf("Error reading %s: %v", *inputFlag, err)
+		}
+		entries = append(entries, manifest...)
+	}
 	directory := *dirFlag
 
-	fmt.Printf("Preparing to download %d file(s) to %s\n\n", len(urls), directory)
+	progressMode, err := internal.ParseProgressMode(*progressFlag)
+	if err != nil {
+		log.Fatalf("Error: invalid -progress: %v", err)
+	}
 
-	downloads, err := internal.PrepareDownloads(urls, directory)
+	reportFormat, err := internal.ParseReportFormat(*reportFormatFlag, *reportFlag)
 	if err != nil {
-		log.Fatalf("Error preparing downloads: %v", err)
+		log.Fatalf("Error: invalid -report-format: %v", err)
 	}
 
-	for i, d := range downloads {
-		fmt.Printf("[%d] %s\n", i+1, d.FilePath)
+	// JSON events go to stdout on their own, so other messages move to stderr.
+	var out io.Writer = os.Stdout
+	if progressMode == internal.ProgressJSON {
+		out = os.Stderr
+	}
+
+	opts := internal.Options{
+		Resume:   *continueFlag,
+		Segments: *segmentsFlag,
+		Retry: internal.RetryPolicy{
+			MaxAttempts: *retriesFlag,
+			BaseDelay:   *retryDelayFlag,
+			MaxDelay:    *retryMaxDelayFlag,
+			Jitter:      *retryJitterFlag,
+		},
+		StallTimeout: *stallTimeoutFlag,
+		MinSpeedTime: *minSpeedTimeFlag,
+		HTTPClient: internal.NewHTTPClient(internal.HTTPTimeouts{
+			Connect:        *connectTimeoutFlag,
+			TLSHandshake:   *tlsTimeoutFlag,
+			ResponseHeader: *responseTimeoutFlag,
+		}),
+	}
+	if *cacheFlag {
+		opts.Cache = internal.NewCache()
+	}
+	if *extractFlag {
+		opts.Extract = &internal.ExtractOptions{Dir: *extractDirFlag, DeleteArchive: *deleteArchiveFlag}
 	}
-	fmt.Println()
 
+	onConflict, err := internal.ParseConflictPolicy(*onConflictFlag)
+	if err != nil {
+		log.Fatalf("Error: invalid -on-conflict: %v", err)
+	}
+	opts.OnConflict = onConflict
+
+	mirrorStrategy, err := internal.ParseMirrorStrategy(*mirrorSelectFlag)
+	if err != nil {
+		log.Fatalf("Error: invalid -mirror-select: %v", err)
+	}
+	opts.MirrorStrategy = mirrorStrategy
+	if *locationFlag != "" {
+		opts.Locations = strings.Split(*locationFlag, ",")
+	}
+
+	if *minSpeedFlag != "" {
+		opts.MinSpeed, err = internal.ParseByteSize(*minSpeedFlag)
+		if err != nil {
+			log.Fatalf("Error: invalid -min-speed: %v", err)
+		}
+	}
+
+	if *limitRateFlag != "" {
+		rate, err := internal.ParseByteSize(*limitRateFlag)
+		if err != nil {
+			log.Fatalf("Error: invalid -limit-rate: %v", err)
+		}
+		opts.RateLimiter = internal.NewRateLimiter(rate)
+	}
+	// Always set, as hosts answering 429 or 503 are backed off from even without limits.
+	opts.Hosts = internal.NewHostLimiter(*maxPerHostFlag, *hostDelayFlag)
+
+	header, err := internal.ParseHeaders(headersFlag)
+	if err != nil {
+		log.Fatalf("Error: invalid -header: %v", err)
+	}
+	if *userAgentFlag != "" {
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("User-Agent", *userAgentFlag)
+	}
+	opts.Header = header
+
+	switch {
+	case *userFlag != "" && *bearerFlag != "":
+		log.Fatal("Error: -user and -bearer cannot be used together")
+	case *userFlag != "":
+		opts.Auth, err = internal.ParseBasicAuth(*userFlag)
+		if err != nil {
+			log.Fatalf("Error: invalid -user: %v", err)
+		}
+	case *bearerFlag != "":
+		opts.Auth = &internal.Credentials{BearerToken: *bearerFlag}
+	}
+
+	if *netrcFlag && *netrcFileFlag != "" {
+		netrc, err := internal.LoadNetrc(*netrcFileFlag)
+		// A missing netrc file is only an error when it was asked for explicitly.
+		if err != nil && !(errors.Is(err, fs.ErrNotExist) && *netrcFileFlag == internal.DefaultNetrcPath()) {
+			log.Fatalf("Error loading netrc: %v", err)
+		}
+		opts.Netrc = netrc
+	}
+
+	if *cookiesFlag != "" {
+		jar, err := internal.LoadCookieFile(*cookiesFlag)
+		if err != nil {
+			log.Fatalf("Error loading cookies: %v", err)
+		}
+		opts.HTTPClient.Jar = jar
+	}
+
+	// The handler is installed before crawling, so an interrupt during a long crawl
+	// ends the run like one during the downloads.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -44,25 +243,130 @@ func main() {
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigChan
-		fmt.Println("\nReceived interrupt signal, cancelling downloads...")
+		fmt.Fprintln(out, "\nReceived interrupt signal, cancelling downloads...")
 		cancel()
 	}()
 
+	if *recursiveFlag {
+		crawlOpts := internal.CrawlOptions{
+			MaxDepth: *maxDepthFlag,
+			Include:  includeFlag,
+			Exclude:  excludeFlag,
+			SameHost: *sameHostFlag,
+		}
+		entries, err = internal.Crawl(ctx, entries, crawlOpts, opts)
+		if err != nil && ctx.Err() != nil {
+			// Nothing was downloaded yet, so the journal of the previous batch is kept.
+			report := internal.NewReporter(nil).Report()
+			report.Status = internal.RunCancelled
+			writeReport(*reportFlag, reportFormat, report)
+			fmt.Fprintln(os.Stderr, "Crawl cancelled")
+			os.Exit(exitCancelled)
+		}
+		if err != nil {
+			log.Fatalf("Error crawling: %v", err)
+		}
+	}
+
+	if *checksumsFlag != "" {
+		checksums, err := internal.LoadChecksumFile(*checksumsFlag)
+		if err != nil {
+			log.Fatalf("Error loading checksums: %v", err)
+		}
+		opts.Checksums = checksums
+	}
+
+	if daemonMode {
+		// The daemon pauses its jobs on interrupt signals itself.
+		signal.Stop(sigChan)
+		runDaemon(*listenFlag, directory, opts, *concurrencyFlag, progressMode, out, entries)
+		return
+	}
+
+	// A new batch replaces the journal of the previous one once it is saved, and
+	// removes it when every file is done.
+	journal := internal.NewJournal(directory)
+	if *resumeFlag {
+		journal, err = internal.LoadJournal(directory)
+		if err != nil {
+			log.Fatalf("Error: cannot resume: %v", err)
+		}
+		if *urlsFlag == "" && *inputFlag == "" {
+			entries, err = journal.Entries()
+			if err != nil {
+				log.Fatalf("Error: cannot resume: %v", err)
+			}
+		}
+		pending := journal.Pending(entries)
+		if done := len(entries) - len(pending); done > 0 {
+			fmt.Fprintf(out, "Skipping %d file(s) completed by the interrupted batch\n", done)
+		}
+		entries = pending
+		opts.Resume = true
+	}
+	opts.Journal = journal
+
+	if *probeFlag {
+		fmt.Fprintf(out, "Probing %d file(s) for %s\n\n", len(entries), directory)
+	} else {
+		fmt.Fprintf(out, "Preparing to download %d file(s) to %s\n\n", len(entries), directory)
+	}
+
+	downloads, err := internal.PrepareDownloads(entries, directory, opts)
+	if err != nil {
+		log.Fatalf("Error preparing downloads: %v", err)
+	}
+
+	if *probeFlag {
+		runProbe(ctx, downloads, *concurrencyFlag, progressMode, out)
+		return
+	}
+	warnDiskSpace(out, internal.PlannedSpace(downloads))
+
+	removed, err := internal.CleanupPartials(downloads, opts.Resume)
+	if err != nil {
+		log.Printf("Warning: cleaning up partial files: %v", err)
+	}
+	if removed > 0 {
+		fmt.Fprintf(out, "Removed %d stale partial file(s)\n\n", removed)
+	}
+
+	if err := journal.Track(downloads); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	for i, d := range downloads {
+		if d.State() == internal.StateSkipped {
+			fmt.Fprintf(out, "[%d] %s (skipped, file exists)\n", i+1, d.FilePath)
+			continue
+		}
+		fmt.Fprintf(out, "[%d] %s\n", i+1, d.FilePath)
+	}
+	fmt.Fprintln(out)
+
 	var wg sync.WaitGroup
 
-	internal.StartProgressListener(downloads, &wg)
+	reporter := internal.NewReporter(downloads)
+	renderers := []internal.Renderer{journal, reporter}
+	if renderer := internal.NewRenderer(progressMode, os.Stdout); renderer != nil {
+		renderers = append(renderers, renderer)
+	}
+	internal.StartProgressListener(downloads, &wg, renderers...)
 
-	err = internal.StartAll(ctx, downloads, &wg)
+	err = internal.StartAll(ctx, downloads, *concurrencyFlag, &wg)
 	if err != nil {
 		log.Fatalf("Error starting downloads: %v", err)
 	}
 
 	wg.Wait()
 
+	report := reporter.Report()
+	writeReport(*reportFlag, reportFormat, report)
+
 	var downloadErrors []error
 	for i, d := range downloads {
 		if err := d.Err(); err != nil {
-			downloadErrors = append(downloadErrors, fmt.Errorf("[%d] %s: %w", i+1, d.URL, err))
+			downloadErrors = append(downloadErrors, fmt.Errorf("[%d] %s: %w", i+1, internal.RedactURL(d.URL), err))
 		}
 	}
 
@@ -70,9 +374,31 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\n%d download(s) failed:\n", len(downloadErrors))
 		for _, err := range downloadErrors {
 			fmt.Fprintf(os.Stderr, "  %v\n", err)
+
+			var retryErr *internal.RetryError
+			if errors.As(err, &retryErr) {
+				for i, attemptErr := range retryErr.Attempts {
+					fmt.Fprintf(os.Stderr, "      attempt %d: %v\n", i+1, attemptErr)
+				}
+			}
 		}
-		os.Exit(1)
 	}
 
-	fmt.Println("\nAll downloads completed successfully!")
+	switch report.Status {
+	case internal.RunCancelled:
+		os.Exit(exitCancelled)
+	case internal.RunFailed:
+		os.Exit(exitFailed)
+	}
+	fmt.Fprintln(out, "\nAll downloads completed successfully!")
+}
+
+// writeReport writes the report of the run to path, if set.
+func writeReport(path string, format internal.ReportFormat, report *internal.Report) {
+	if path == "" {
+		return
+	}
+	if err := internal.WriteReport(path, format, report); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 }
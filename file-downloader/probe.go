@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"file-downloader/internal"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// runProbe prints the remote metadata of the downloads instead of downloading them, as
+// a table or, with JSON progress, as a JSON array, followed by a warning for every file
+// system without room for them. It exits with exitFailed if a file could not be probed,
+// or with exitCancelled when it was interrupted.
+func runProbe(ctx context.Context, downloads []*internal.FileDownload, concurrency int, mode internal.ProgressMode, out io.Writer) {
+	results := internal.ProbeAll(ctx, downloads, concurrency)
+
+	var err error
+	if mode == internal.ProgressJSON {
+		err = internal.WriteProbeJSON(os.Stdout, results)
+	} else {
+		err = internal.WriteProbeTable(os.Stdout, results)
+	}
+	if err != nil {
+		log.Fatalf("Error writing probe results: %v", err)
+	}
+
+	needed, unknown := internal.ProbedSpace(results)
+	warnDiskSpace(out, needed)
+	if unknown > 0 {
+		fmt.Fprintf(out, "\n%d file(s) of unknown size are not included in the disk space check\n", unknown)
+	}
+
+	if ctx.Err() != nil {
+		os.Exit(exitCancelled)
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			os.Exit(exitFailed)
+		}
+	}
+}
+
+// warnDiskSpace prints a warning for every file system without room for the bytes
+// needed in its directories.
+func warnDiskSpace(out io.Writer, needed map[string]int64) {
+	for _, shortage := range internal.CheckDiskSpace(needed) {
+		fmt.Fprintf(out, "Warning: not enough disk space: %s\n", shortage)
+	}
+}